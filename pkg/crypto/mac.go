@@ -2,21 +2,104 @@ package crypto
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	_ "crypto/sha512" // register SHA-384 and SHA-512 for crypto.Hash
+	"encoding/base32"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"math"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 var (
-	errMACTooLong = errors.New("mac: too long")
-	errMACExpired = errors.New("mac: expired")
-	errMACInvalid = errors.New("mac: the value is not valid")
+	// ErrMACTooLong is used when the encoded message exceeds the maximum
+	// length of the configuration
+	ErrMACTooLong = errors.New("mac: too long")
+	// ErrMACFromFuture is used when the message has been issued further in
+	// the future than the allowed clock skew
+	ErrMACFromFuture = errors.New("mac: issued in the future")
+	// ErrMACExpired is used when the message is older than the maximum age
+	// of the configuration
+	ErrMACExpired = errors.New("mac: expired")
+	// ErrMACInvalid is used when the message is malformed or its MAC does not
+	// match
+	ErrMACInvalid = errors.New("mac: the value is not valid")
+	// ErrMACTruncated is used when the message is too short to contain its
+	// header and its MAC, like a token cut by a proxy
+	ErrMACTruncated = errors.New("mac: truncated")
+	// ErrMACReplayed is used when a single-use message has already been used
+	ErrMACReplayed = errors.New("mac: already used")
+	// ErrMACUnsupportedVersion is used when the format version of the message
+	// is not known
+	ErrMACUnsupportedVersion = errors.New("mac: unsupported version")
+	// ErrMACRevoked is used when a revocable message has been revoked
+	ErrMACRevoked = errors.New("mac: revoked")
+	// ErrMACWrongPurpose is used when an authentic message has been issued for
+	// another purpose
+	ErrMACWrongPurpose = errors.New("mac: wrong purpose")
+	// ErrMissingKey is used when the key of a config is not set
+	ErrMissingKey = errors.New("mac: hash key is not set")
+	// ErrKeyTooShort is used when the key of a config is shorter than 16 bytes
+	ErrKeyTooShort = errors.New("mac: hash key is not long enough")
+	// ErrWeakKey is used when the key of a config is obviously not random,
+	// like a key with only zeros
+	ErrWeakKey = errors.New("mac: hash key is too weak")
 )
 
-const defaultMaxLen = 4096
-const macLen = 32
+// IsExpired returns true if the error is caused by an expired message.
+func IsExpired(err error) bool {
+	return errors.Is(err, ErrMACExpired)
+}
+
+// DefaultMaxLen is the maximum length of the encoded messages for the configs
+// with a MaxLen of 0. It can be raised for the deployments that sign larger
+// payloads, but it should stay bounded: the messages usually come from the
+// outside, and the length is checked before decoding and verifying them, so
+// that a client can't make the server allocate memory and compute MACs on
+// arbitrarily large inputs. It should be changed at startup, before the
+// configs are used.
+var DefaultMaxLen = 4096
+
+const defaultHash = crypto.SHA256
+
+// maxDuration is the maximum value, in seconds, of MaxAge, MaxSkew,
+// ExpiryGrace and EpochSeconds: 100 years. The larger values are mistakes.
+const maxDuration = 100 * 365 * 86400
+const maxKeyIDLen = 255
+const maxPrefixLen = 255
+const minTagLen = 16
+const subkeyLen = 32
+const minKeyLen = 16
+const defaultKeyLen = 32
+
+// The MAC inputs start with a byte telling what kind of data is MACed, so that
+// a tag computed for a stream can never be reused as the tag of a message.
+const (
+	macDomainMessage   byte = 'm'
+	macDomainStream    byte = 's'
+	macDomainSingleUse byte = 'n'
+	macDomainEncrypted byte = 'e'
+	macDomainRevocable byte = 'r'
+	macDomainFields    byte = 'f'
+	macDomainSecure    byte = 'v'
+	macDomainSIV       byte = 'd'
+
+	// macDomainPrefixed is set on the domain when the config has a Prefix
+	macDomainPrefixed byte = 0x80
+)
 
 // MACConfig contains all the options to encode or decode a message along with
 // a proof of integrity and authenticity.
@@ -25,131 +108,2180 @@ const macLen = 32
 // and should be generated by a PRNG.
 //
 // Name is an optional message name that won't be contained in the MACed
-// messaged itself but will be MACed against.
+// messaged itself but will be MACed against. NameBytes can be used instead
+// for a binary name, and takes precedence over Name when it is not nil.
+//
+// AltNames are the previous names of the messages, for a rename: the messages
+// are always issued with Name, but the messages MACed against one of the
+// AltNames are still accepted on decode. They are tried in order, after Name,
+// and DecodeAuthMessageWithName tells which name has matched. The encrypted
+// messages are only decrypted with Name.
+//
+// Hash is the hash function used by the HMAC. It defaults to SHA-256, and the
+// size of the tag appended to the message is the size of this hash.
+//
+// KeyID is an optional identifier of Key, at most 255 bytes long, that is
+// written in the header of the encoded messages. When KeyFunc is set, it is
+// called on decode with the key id of the message to resolve the key that
+// should be used to verify it, instead of Key. It allows to rotate the keys,
+// while still accepting the messages signed with the previous ones:
+//
+//  keys := map[string][]byte{"2": current, "1": previous}
+//  c := &MACConfig{
+//  	Key:   current,
+//  	KeyID: []byte("2"),
+//  	KeyFunc: func(keyID []byte) ([]byte, error) {
+//  		if key, ok := keys[string(keyID)]; ok {
+//  			return key, nil
+//  		}
+//  		return nil, errors.New("unknown key")
+//  	},
+//  }
+//
+// MaxAge is the duration, in seconds, after which the messages expire. When it
+// is 0, the messages never expire, and it can't be negative.
+//
+// MaxLen is the maximum length of the encoded messages, checked when they
+// are encoded and before they are decoded. It defaults to DefaultMaxLen when
+// it is 0, and it can't be negative.
+//
+// MaxDecodedLen is the maximum length of the messages once decoded from
+// base64, and of their values once decompressed. It bounds the memory used to
+// decode a message, whatever its encoded size. It defaults to 16 times MaxLen
+// when it is 0, and it can't be negative.
+//
+// MaxSkew is the tolerance, in seconds, for the clocks drift between the
+// servers issuing and verifying the messages. When it is set, a message issued
+// more than MaxSkew seconds in the future is rejected, and MaxSkew seconds
+// are added to MaxAge before considering a message as expired.
+//
+// ExpiryGrace is an extra delay, in seconds, during which a message that has
+// just expired is still accepted, for the clients on slow networks that send
+// a message right before its expiry. It is added to MaxAge, and to the ttl
+// and the expiry time of the messages, after MaxSkew. Unlike MaxSkew, it
+// doesn't accept the messages issued in the future. It defaults to 0, for a
+// strict expiry.
+//
+// Clock returns the current timestamp, in seconds, used to issue and verify
+// the messages. It defaults to Timestamp, and can be replaced in tests.
+//
+// TimeUnit is the unit of the time embedded in the messages. It defaults to
+// Seconds. With Milliseconds, MaxAge, MaxSkew, ExpiryGrace, the ttl of the messages and the
+// issued times are in milliseconds, and so is the timestamp returned by Clock.
+// The unit is written in the header of the messages, so a message issued with
+// one unit can still be verified by a config with the other.
+//
+// When NoTimestamp is true, the issued time is not written in the messages,
+// for tokens that never expire and should not tell when they were issued.
+// MaxAge must then be 0. The messages with and without a time can't be
+// decoded by the same config.
+//
+// Purpose is an optional kind of token, like session or password reset. When
+// it is not 0, it is written in the messages, and a message issued for
+// another purpose is rejected with ErrMACWrongPurpose. Contrary to Name, it
+// does not rely on the names being distinct.
+//
+// MaxAgeByPurpose gives the maximum age of the messages of some purposes,
+// instead of MaxAge. It is meant to be shared by the configs derived with
+// WithPurpose from a base config, like a reset token valid for 5 minutes and
+// a session valid for 30 days. The purposes without an entry get MaxAge, and
+// a maximum age of 0 means that the messages of the purpose never expire.
+//
+// When Compress is true, the values are compressed with flate before being
+// MACed, if it makes them smaller. The compressed messages are decompressed
+// after the verification of their MAC, whatever the value of Compress, and
+// their value, once decompressed, can't be longer than MaxDecodedLen, to
+// protect against the compression bombs. The encrypted messages are never
+// compressed, as it would leak information about their content.
+//
+// TagLen is the size of the MAC appended to the messages. The HMAC is
+// truncated to this size, that must be between 16 and Hash.Size(). It defaults
+// to the full size of the HMAC.
+//
+// Algorithm is the MAC construction. It defaults to HMAC, and KMAC256 can be
+// used where the SHA-3 family is required. With KMAC256, Hash is ignored, the
+// Name is also used as the customization string, and TagLen, between 16 and
+// 64, defaults to 32. With Poly1305, each message has a random nonce of 24
+// bytes, from which its one-time key is derived, followed by a tag of 16
+// bytes. Hash and TagLen can't be used with it. Its 40 bytes make it longer
+// than HMAC-SHA256, and it is not faster: it is only an alternative to HMAC
+// where Poly1305 is required.
+//
+// Encoding is the encoding of the messages. It defaults to the base64 URL
+// encoding without padding.
+//
+// When DeriveSubkey is true, the HMAC key is not Key itself, but a subkey
+// derived from it with HKDF-SHA256, using Name as the info parameter. It
+// allows to share a master key between several names: even if a weakness was
+// found in the way the name is MACed, each name would still be protected by
+// its own key. Enabling it changes the MAC of the messages, so the messages
+// issued before will not be valid anymore.
+//
+// Signer, when set, computes and verifies the MACs instead of the in-process
+// HMAC, for example with a key kept in a KMS. Key, KeyFunc, Hash, TagLen and
+// DeriveSubkey are then ignored for the MAC, and the size of the tag is given
+// by the signer. See MACSigner.
+//
+// AEAD is the authenticated encryption used by EncryptAuthMessage. It defaults
+// to AES-256-GCM.
+//
+// EncKeyFunc, when set, returns the key to decrypt the messages of
+// EncryptAuthMessage issued with the given key id, instead of KeyFunc. The
+// encryption keys can then be rotated independently of the MAC keys, and
+// the messages issued with a retired key can still be decrypted as long as
+// it is returned. The messages are always encrypted with Key and KeyID.
+//
+// When Unpredictable is true, a random salt of 8 bytes is written in the
+// messages, so that the messages for the same value, issued in the same
+// second, are different and can't be correlated. The salt is removed on
+// decode, and the messages with and without a salt are decoded by the same
+// configs.
+//
+// When CompactTime is true, the time is written in the messages as a varint
+// instead of 8 bytes, which saves 2 or 3 bytes for a time in seconds, and
+// makes shorter tokens for the URLs. The messages with a compact time are
+// decoded by all the configs, whatever their CompactTime.
+//
+// Prefix is an optional text written verbatim before the encoded messages,
+// like "sk_", to tell what kind of token it is in the logs. It is covered by
+// the MAC, and a message without the prefix is rejected with ErrMACInvalid.
+// It is not written in the binary messages, but is still covered by their MAC.
+// It counts in MaxLen, and can't be longer than 255 bytes.
+//
+// When CanonicalJSON is true, the JSON helpers (EncodeJSON, SignJSON and
+// VerifyJSON) authenticate the canonical form of the JSON, with the keys of
+// the objects sorted and without whitespace, instead of its raw bytes. A JSON
+// document that has been re-serialized, with its keys in another order, is
+// then still verified. The other functions are not affected.
+//
+// Rand is the source of the random bytes of the messages: the salts of
+// Unpredictable, the nonces of the encrypted, single-use and Poly1305
+// messages, the ids of the revocable messages, etc. It defaults to the
+// system's secure random number generator, and can be replaced by a
+// deterministic reader in tests. When a read from Rand fails, like at the end
+// of a bytes.Reader, its error is returned by the functions that need random
+// bytes.
+//
+// PadTo, when set, pads the values of the messages to this size, so that all
+// the messages of a config have the same length, whatever the length of their
+// value. It is meant for EncryptAuthMessage, where the length of the value
+// would otherwise tell something about it. The padding, with the length of
+// the value, is covered by the MAC and removed on decode. A value longer than
+// PadTo is rejected with ErrMACTooLong, and the padded messages must fit in
+// MaxLen. The padded values are not compressed, and the detached MACs, the
+// secure values and the deterministic messages are not padded.
+//
+// EpochSeconds, when set, is the length of the epochs, in seconds, like 86400
+// for a day: the issued time of the messages is rounded down to the start of
+// its epoch, so that it doesn't tell when a message was issued within the
+// epoch, and the maximum ages are rounded up to a whole number of epochs. All
+// the messages of an epoch then expire together, at the start of a later
+// epoch: with a MaxAge of one day, the messages of a day expire at midnight
+// UTC. It can't be used with NoTimestamp.
+//
+// OnExpired, OnInvalid and OnTooLong are optional hooks, called with the
+// encoded message when its decoding fails with ErrMACExpired, ErrMACInvalid
+// (or ErrMACTruncated) and ErrMACTooLong respectively, before the error is
+// returned. They can be
+// used for metrics and security logs. They are called synchronously, and must
+// neither keep nor modify the message.
+//
+// The HMAC instances keyed with Key are cached in the config, so a config can
+// be used concurrently, but must not be copied after its first use: use Clone
+// instead. The cache only helps when the config is reused: a config built for
+// each message still allocates and keys a new HMAC instance for it.
 type MACConfig struct {
-	Key    []byte
-	Name   string
-	MaxAge int64
-	MaxLen int
+	Key           []byte
+	Name          string
+	NameBytes     []byte
+	MaxAge        int64
+	MaxLen        int
+	Hash          crypto.Hash
+	KeyID         []byte
+	KeyFunc       func(keyID []byte) ([]byte, error)
+	MaxSkew       int64
+	Clock         func() int64
+	TagLen        int
+	Encoding      MessageEncoding
+	DeriveSubkey  bool
+	Signer        MACSigner
+	TimeUnit      TimeUnit
+	NoTimestamp   bool
+	Compress      bool
+	Purpose       uint8
+	AEAD          AEADAlgorithm
+	Algorithm     MACAlgorithm
+	OnExpired     func(enc []byte)
+	OnInvalid     func(enc []byte)
+	OnTooLong     func(enc []byte)
+	AltNames      []string
+	Unpredictable bool
+	CompactTime   bool
+	MaxDecodedLen int
+	Prefix        string
+	EncKeyFunc    func(keyID []byte) ([]byte, error)
+	CanonicalJSON bool
+	ExpiryGrace   int64
+	Rand          io.Reader
+	PadTo         int
+	EpochSeconds  int64
+
+	MaxAgeByPurpose map[uint8]int64
+
+	cache atomic.Pointer[macCache]
+}
+
+// MACAlgorithm is the MAC construction used for the messages.
+type MACAlgorithm int
+
+const (
+	// HMAC is HMAC with the Hash of the config. This is the default.
+	HMAC MACAlgorithm = iota
+	// KMAC256 is KMAC256 from NIST SP 800-185, based on SHA-3.
+	KMAC256
+	// Poly1305 is the one-time MAC Poly1305, with a key derived for each
+	// message from the key of the config and a random nonce, as done by
+	// XChaCha20-Poly1305. The nonce is sent with the tag, so it is neither
+	// more compact nor faster than HMAC.
+	Poly1305
+)
+
+// TimeUnit is the unit of the time embedded in the messages.
+type TimeUnit int
+
+const (
+	// Seconds is the default unit of time.
+	Seconds TimeUnit = iota
+	// Milliseconds can be used for the short-lived messages.
+	Milliseconds
+)
+
+// convert returns the time t, given in the unit from, in the unit u. The
+// conversion to seconds of a time is rounded down, and of a duration is
+// rounded up. The conversion to milliseconds saturates instead of
+// overflowing.
+func (u TimeUnit) convert(t int64, from TimeUnit, duration bool) int64 {
+	switch {
+	case u == from:
+		return t
+	case u == Milliseconds:
+		if t > math.MaxInt64/1000 {
+			return math.MaxInt64
+		}
+		if t < math.MinInt64/1000 {
+			return math.MinInt64
+		}
+		return t * 1000
+	case duration:
+		return (t + 999) / 1000
+	default:
+		return t / 1000
+	}
+}
+
+// MessageEncoding is the textual encoding used for the messages.
+type MessageEncoding int
+
+const (
+	// Base64RawURL is the base64 URL encoding, without padding. This is the
+	// default encoding.
+	Base64RawURL MessageEncoding = iota
+	// Base64URL is the base64 URL encoding, with padding.
+	//
+	// The messages are decoded with or without padding by the configs with
+	// either Base64RawURL or Base64URL, as some clients add or remove the
+	// padding: the messages are always encoded with the padding of the
+	// config, and a message must fit in MaxLen with the padding.
+	Base64URL
+	// Base32 is the base32 standard encoding, without padding. The messages
+	// only contain uppercase letters and digits, and are decoded regardless
+	// of the case, for the tokens typed or read aloud by humans. They are
+	// 60% longer than with base64.
+	Base32
+)
+
+// base32Raw is the encoding of Base32.
+var base32Raw = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// textEncoding is implemented by base64.Encoding and base32.Encoding.
+type textEncoding interface {
+	EncodedLen(n int) int
+	DecodedLen(n int) int
+	Encode(dst, src []byte)
+	Decode(dst, src []byte) (int, error)
+}
+
+func (e MessageEncoding) encoding() textEncoding {
+	switch e {
+	case Base64URL:
+		return base64.URLEncoding
+	case Base32:
+		return base32Raw
+	}
+	return base64.RawURLEncoding
+}
+
+// encodedLen returns the length of the encoding of n bytes.
+func (e MessageEncoding) encodedLen(n int) int {
+	return e.encoding().EncodedLen(n)
+}
+
+// appendEncode appends the encoding of value to dst.
+func (e MessageEncoding) appendEncode(dst, value []byte) []byte {
+	n := e.encodedLen(len(value))
+	if cap(dst)-len(dst) < n {
+		grown := make([]byte, len(dst), len(dst)+n)
+		copy(grown, dst)
+		dst = grown
+	}
+	e.encoding().Encode(dst[len(dst):len(dst)+n], value)
+	return dst[:len(dst)+n]
+}
+
+// decode returns the bytes represented by the encoded value.
+func (e MessageEncoding) decode(value []byte) ([]byte, error) {
+	return e.appendDecode(nil, value)
+}
+
+// maxEncodedLen returns the length of the encoding of n bytes, with the
+// padding for the base64 encodings, as a message can be given with or
+// without it.
+func (e MessageEncoding) maxEncodedLen(n int) int {
+	if e == Base32 {
+		return e.encodedLen(n)
+	}
+	return base64.URLEncoding.EncodedLen(n)
+}
+
+// trimBase64Padding returns the base64 value without its padding, if it has
+// a valid one, for the raw decoding.
+func trimBase64Padding(value []byte) ([]byte, error) {
+	pad := 0
+	for pad < 2 && len(value)-pad > 0 && value[len(value)-pad-1] == '=' {
+		pad++
+	}
+	if pad == 0 {
+		return value, nil
+	}
+	if len(value)%4 != 0 || pad != (4-(len(value)-pad)%4)%4 {
+		return nil, errBase64Invalid
+	}
+	return value[:len(value)-pad], nil
+}
+
+// appendDecode appends the bytes represented by the encoded value to dst.
+func (e MessageEncoding) appendDecode(dst, value []byte) ([]byte, error) {
+	enc := e.encoding()
+	if e == Base32 {
+		value = bytes.ToUpper(value)
+	} else {
+		var err error
+		if value, err = trimBase64Padding(value); err != nil {
+			return nil, err
+		}
+		enc = base64.RawURLEncoding
+	}
+	n := enc.DecodedLen(len(value))
+	if cap(dst)-len(dst) < n {
+		grown := make([]byte, len(dst), len(dst)+n)
+		copy(grown, dst)
+		dst = grown
+	}
+	n, err := enc.Decode(dst[len(dst):len(dst)+n], value)
+	if err != nil {
+		return nil, err
+	}
+	return dst[:len(dst)+n], nil
+}
+
+// decodeInto decodes the encoded value into dst, in constant time (see
+// base64DecodeInto), and returns the number of bytes written. dst must have
+// room for the decoded value. The base32 decoding is not in constant time.
+func (e MessageEncoding) decodeInto(dst, value []byte) (int, error) {
+	if e == Base32 {
+		return base32Raw.Decode(dst, bytes.ToUpper(value))
+	}
+	value, err := trimBase64Padding(value)
+	if err != nil {
+		return 0, err
+	}
+	return base64DecodeInto(dst, value)
+}
+
+// GenerateKey returns a new random key for MACConfig, of the given size, read
+// from the system's secure random number generator. A size of 0 gives a key
+// of 32 bytes, and an error is returned for a size smaller than 16 bytes.
+func GenerateKey(size int) ([]byte, error) {
+	if size == 0 {
+		size = defaultKeyLen
+	}
+	if size < minKeyLen {
+		return nil, errors.New("mac: key size is too small")
+	}
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// randomBytes returns n random bytes read from the Rand of the config, or from
+// the system's secure random number generator. The error of Rand is returned
+// unchanged.
+func (c *MACConfig) randomBytes(n int) ([]byte, error) {
+	if c.Rand == nil {
+		return GenerateRandomBytes(n), nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.Rand, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Validate checks that the config can be used to sign and verify messages. It
+// returns ErrMissingKey, ErrKeyTooShort or ErrWeakKey for a bad key, and an
+// error describing the problem for the other fields. It is called by the
+// functions using the config, but can be called at startup to detect a
+// misconfiguration early.
+func (c *MACConfig) Validate() error {
+	if c.Signer != nil {
+		if c.Signer.TagLen() < minTagLen {
+			return errors.New("mac: tag length is out of range")
+		}
+	} else if c.Key == nil {
+		return ErrMissingKey
+	} else if err := checkKey(c.Key); err != nil {
+		return err
+	}
+	if !c.hash().Available() {
+		return errors.New("mac: hash function is not available")
+	}
+	if len(c.KeyID) > maxKeyIDLen {
+		return errors.New("mac: key id is too long")
+	}
+	if len(c.Prefix) > maxPrefixLen {
+		return errors.New("mac: prefix is too long")
+	}
+	if c.Algorithm != HMAC && c.Algorithm != KMAC256 && c.Algorithm != Poly1305 {
+		return errors.New("mac: unknown algorithm")
+	}
+	if c.Algorithm == Poly1305 && c.TagLen != 0 {
+		return errors.New("mac: tag length can't be used with Poly1305")
+	}
+	if c.TagLen != 0 && (c.TagLen < minTagLen || c.TagLen > c.maxTagLen()) {
+		return errors.New("mac: tag length is out of range")
+	}
+	if c.Encoding != Base64RawURL && c.Encoding != Base64URL && c.Encoding != Base32 {
+		return errors.New("mac: unknown encoding")
+	}
+	if c.TimeUnit != Seconds && c.TimeUnit != Milliseconds {
+		return errors.New("mac: unknown time unit")
+	}
+	if c.AEAD != AESGCM && c.AEAD != XChaCha20Poly1305 {
+		return errors.New("mac: unknown AEAD")
+	}
+	if c.MaxAge < 0 {
+		return errors.New("mac: max age can't be negative")
+	}
+	if c.MaxAge > c.TimeUnit.convert(maxDuration, Seconds, true) {
+		return errors.New("mac: max age is too large")
+	}
+	if c.MaxSkew < 0 || c.MaxSkew > c.TimeUnit.convert(maxDuration, Seconds, true) {
+		return errors.New("mac: max skew is out of range")
+	}
+	if c.ExpiryGrace < 0 || c.ExpiryGrace > c.TimeUnit.convert(maxDuration, Seconds, true) {
+		return errors.New("mac: expiry grace is out of range")
+	}
+	if c.MaxLen < 0 || c.MaxDecodedLen < 0 {
+		return errors.New("mac: max length can't be negative")
+	}
+	if c.PadTo < 0 {
+		return errors.New("mac: padding can't be negative")
+	}
+	if c.PadTo > 0 && c.encodedLen(c.paddedLen()) > c.maxLen() {
+		return errors.New("mac: padded messages are longer than max length")
+	}
+	if c.NoTimestamp && c.MaxAge != 0 {
+		return errors.New("mac: max age can't be used without timestamp")
+	}
+	if c.EpochSeconds < 0 || c.EpochSeconds > maxDuration {
+		return errors.New("mac: epoch is out of range")
+	}
+	if c.NoTimestamp && c.EpochSeconds != 0 {
+		return errors.New("mac: epoch can't be used without timestamp")
+	}
+	for _, maxAge := range c.MaxAgeByPurpose {
+		if maxAge < 0 || maxAge > c.TimeUnit.convert(maxDuration, Seconds, true) {
+			return errors.New("mac: max age by purpose is out of range")
+		}
+		if c.NoTimestamp && maxAge != 0 {
+			return errors.New("mac: max age can't be used without timestamp")
+		}
+	}
+	return nil
+}
+
+// Zeroize overwrites the key of the config with zeros, and removes it from the
+// config, to limit the time it stays in memory once the config is retired. The
+// copies kept by the config are also overwritten.
+//
+// The config can't be used afterwards. The key slice must not be used
+// elsewhere, as its bytes are overwritten: the copies made by the caller, and
+// the internal state of the HMAC instances that have been created, can't be
+// wiped.
+func (c *MACConfig) Zeroize() {
+	if mc := c.cache.Swap(nil); mc != nil {
+		mc.zeroize()
+	}
+	zeroBytes(c.Key)
+	c.Key = nil
+}
+
+// zeroBytes overwrites b with zeros. The KeepAlive ensures that the writes
+// are not optimized away.
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
+
+// LogValue implements slog.LogValuer, so that a config can be logged without
+// its key: only the options that are not secret are written, and the key and
+// the signer are redacted.
+func (c *MACConfig) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("name", string(c.name())),
+		slog.String("key", redactedKey(c.Key)),
+		slog.String("key_id", string(c.KeyID)),
+		slog.String("hash", c.hash().String()),
+		slog.Int64("max_age", c.MaxAge),
+		slog.Int("max_len", c.maxLen()),
+		slog.Int("purpose", int(c.Purpose)),
+	}
+	if c.Prefix != "" {
+		attrs = append(attrs, slog.String("prefix", c.Prefix))
+	}
+	if c.Signer != nil {
+		attrs = append(attrs, slog.String("signer", "[redacted]"))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// redactedKey returns the text logged for a key.
+func redactedKey(key []byte) string {
+	if len(key) == 0 {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// now returns the current timestamp of the config clock.
+func (c *MACConfig) now() int64 {
+	if c.Clock == nil {
+		if c.TimeUnit == Milliseconds {
+			return time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		return Timestamp()
+	}
+	return c.Clock()
+}
+
+// key returns the key that should be used to verify a message signed with
+// the given key id.
+func (c *MACConfig) key(keyID []byte) ([]byte, error) {
+	if c.KeyFunc == nil {
+		return c.Key, nil
+	}
+	key, err := c.KeyFunc(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// minKeyBytes is the minimal number of distinct bytes in a key. A random key
+// of 16 bytes has less than 4 distinct bytes with a probability of about
+// 2^-80, so only the obvious mistakes are rejected: a key with only zeros, or
+// with a single repeated byte or short pattern.
+const minKeyBytes = 4
+
+// checkKey returns ErrKeyTooShort for a key shorter than 16 bytes, and
+// ErrWeakKey for a key with less than minKeyBytes distinct bytes.
+func checkKey(key []byte) error {
+	if len(key) < minKeyLen {
+		return ErrKeyTooShort
+	}
+	var seen [256]bool
+	distinct := 0
+	for _, b := range key {
+		if !seen[b] {
+			seen[b] = true
+			distinct++
+		}
+	}
+	if distinct < minKeyBytes {
+		return ErrWeakKey
+	}
+	return nil
 }
 
-func assertMACConfig(c *MACConfig) {
-	if c.Key == nil {
-		panic("hash key is not set")
+// encKey returns the key that should be used to decrypt a message encrypted
+// with the given key id.
+func (c *MACConfig) encKey(keyID []byte) ([]byte, error) {
+	if c.EncKeyFunc == nil {
+		return c.key(keyID)
 	}
-	if len(c.Key) < 16 {
-		panic("hash key is not long enough")
+	key, err := c.EncKeyFunc(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// name returns the name of the config, as bytes.
+func (c *MACConfig) name() []byte {
+	if c.NameBytes != nil {
+		return c.NameBytes
+	}
+	return []byte(c.Name)
+}
+
+// macKey returns the key of the HMAC for the given key, which is the key
+// itself, or the subkey derived from it for the name of the config.
+func (c *MACConfig) macKey(key []byte) []byte {
+	if !c.DeriveSubkey {
+		return key
+	}
+	subkey := make([]byte, subkeyLen)
+	r := hkdf.New(sha256.New, key, nil, c.name())
+	if _, err := io.ReadFull(r, subkey); err != nil {
+		panic(err)
+	}
+	return subkey
+}
+
+// hash returns the hash function of the HMAC.
+func (c *MACConfig) hash() crypto.Hash {
+	if c.Hash == 0 {
+		return defaultHash
+	}
+	return c.Hash
+}
+
+// macLen returns the size of the tag appended to the messages.
+func (c *MACConfig) macLen() int {
+	if c.Signer != nil {
+		return c.Signer.TagLen()
+	}
+	if c.TagLen != 0 {
+		return c.TagLen
+	}
+	switch c.Algorithm {
+	case KMAC256:
+		return 32
+	case Poly1305:
+		return poly1305NonceLen + poly1305TagLen
+	}
+	return c.hash().Size()
+}
+
+// maxTagLen returns the maximum size of the tags of the MAC algorithm.
+func (c *MACConfig) maxTagLen() int {
+	if c.Algorithm == KMAC256 {
+		return kmacMaxTagLen
+	}
+	return c.hash().Size()
+}
+
+// newHash returns a new MAC instance keyed with the given MAC key.
+func (c *MACConfig) newHash(macKey []byte) hash.Hash {
+	return newMACHash(c.Algorithm, c.hash(), macKey, c.name(), c.macLen())
+}
+
+// newMACHash returns a new MAC instance of the given algorithm. The name and
+// size are only used by KMAC256.
+func newMACHash(alg MACAlgorithm, h crypto.Hash, macKey, name []byte, size int) hash.Hash {
+	if alg == KMAC256 {
+		return newKMAC256(macKey, name, size)
 	}
+	return hmac.New(h.New, macKey)
 }
 
 // EncodeAuthMessage associates the given value with a message authentication
 // code for integrity and authenticity.
 //
-// If the value, when base64 encoded with a fixed size header is longer than
-// the configured maximum length, it will panic.
+// If the value, when encoded with a fixed size header is longer than the
+// configured maximum length, ErrMACTooLong is returned. The value can be nil
+// or empty: the message then only contains the header and the MAC, and is
+// decoded to an empty value.
 //
 // Message format (name prefix is in MAC but removed from message):
 //
-//  <------- MAC input ------->
-//         <---------- message ---------->
-//  | name |    time |  blob  |     hmac |
-//  |      | 8 bytes |  ----  | 32 bytes |
+//  <-------------------------- MAC input -------------------------->
+//                                             <------------- message ------------->
+//  | domain | name len |  name | aad len |  aad | header |  blob  |   hmac |
+//  | 1 byte |  4 bytes |  ---- | 4 bytes | ---- |   ---- |  ----  | TagLen |
+//
+// The name is prefixed by its length, so that two different names can never
+// produce the same MAC input for different values. The additional data (aad)
+// is empty, except for EncodeAuthMessageWithAAD.
+//
+// Header format:
+//
+//  | version |  flags | ext flags | key id len | key id | purpose |    time |     ttl | not after |    salt |
+//  |  1 byte | 1 byte |    1 byte |     1 byte |   ---- |  1 byte | 8 bytes | 8 bytes |   8 bytes | 8 bytes |
+//
+// The version is the version of the format, currently 1. The flags tell which
+// optional fields are present in the header: the extended flags are only
+// present when one of them is set, the purpose is only present when it is not
+// 0, the time is absent with NoTimestamp, the ttl is only present for
+// EncodeAuthMessageWithExpiry, the not after time for EncodeAuthMessageUntil,
+// and the salt with Unpredictable. With CompactTime, the time is a varint of
+// 1 to 10 bytes instead of 8 bytes.
 //
 func EncodeAuthMessage(c *MACConfig, value []byte) ([]byte, error) {
-	assertMACConfig(c)
+	return encodeAuthMessage(c, value, c.now(), messageOptions{})
+}
 
-	maxLength := c.MaxLen
-	if maxLength == 0 {
-		maxLength = defaultMaxLen
-	}
+// EncodeAuthMessageAt is the same as EncodeAuthMessage, but the message is
+// issued at the given time, in the time unit of the config, instead of now.
+// With the same config, value and time, the same message is returned, which
+// can be used for golden tests and reproducible fixtures.
+func EncodeAuthMessageAt(c *MACConfig, value []byte, issuedAt int64) ([]byte, error) {
+	return encodeAuthMessage(c, value, issuedAt, messageOptions{})
+}
 
-	time := Timestamp()
+// DecodeAuthMessage verifies a message authentified with message
+// authentication code and returns the message value.
+//
+// The MAC is compared in constant time. A malformed message is not rejected
+// before a MAC has been computed and compared over its data, so the time to
+// reject a message does not tell where it has been tampered with.
+//
+// The value of a message with an empty value is a non-nil empty slice.
+func DecodeAuthMessage(c *MACConfig, enc []byte) ([]byte, error) {
+	value, _, err := DecodeAuthMessageWithTime(c, enc)
+	return value, err
+}
 
-	// Create message with MAC
-	size := len(c.Name) + binary.Size(time) + len(value) + macLen
-	buf := bytes.NewBuffer(make([]byte, 0, size))
-	buf.Write([]byte(c.Name))
-	binary.Write(buf, binary.BigEndian, time)
-	buf.Write(value)
+// DecodeAuthMessageWithTime verifies a message authentified with message
+// authentication code and returns the message value along with the issued
+// time of the message.
+func DecodeAuthMessageWithTime(c *MACConfig, enc []byte) ([]byte, int64, error) {
+	return decodeAuthMessage(c, enc, nil, messageOptions{})
+}
 
-	// Append mac
-	buf.Write(createMAC(c.Key, buf.Bytes()))
+// VerifyAuthMessage verifies a message like DecodeAuthMessage, but only
+// returns its issued time. The value is not extracted: the message is decoded
+// in a pooled buffer, in constant time (see VerifyAuthMessageInto), and a
+// compressed value is not decompressed.
+func VerifyAuthMessage(c *MACConfig, enc []byte) (issuedAt int64, err error) {
+	if err = c.Validate(); err != nil {
+		return 0, err
+	}
+	if len(enc) > c.maxLen() {
+		return 0, c.notify(enc, ErrMACTooLong)
+	}
 
-	// Skip name
-	buf.Next(len(c.Name))
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.Grow(len(enc))
+	return verifyAuthMessageInto(c, buf.Bytes()[:buf.Cap()], enc)
+}
 
-	// Check length
-	if base64.RawURLEncoding.EncodedLen(buf.Len()) > maxLength {
-		panic("the value is too long")
+// VerifyAuthMessageInto is the same as VerifyAuthMessage, but the message is
+// decoded in the given scratch buffer, that can be reused between the calls.
+// A new buffer is allocated when the scratch buffer is too small: giving a
+// buffer of MaxLen bytes avoids it for all the messages. With a large enough
+// buffer, the valid messages of a config with Key are verified without any
+// allocation.
+//
+// The base64 decoding is done in constant time, so the time to reject a
+// malformed message does not tell where its invalid characters are.
+func VerifyAuthMessageInto(c *MACConfig, scratch, enc []byte) (issuedAt int64, err error) {
+	if err = c.Validate(); err != nil {
+		return 0, err
+	}
+	if len(enc) > c.maxLen() {
+		return 0, c.notify(enc, ErrMACTooLong)
 	}
+	return verifyAuthMessageInto(c, scratch[:cap(scratch)], enc)
+}
 
-	// Encode to base64
-	return Base64Encode(buf.Bytes()), nil
+// verifyAuthMessageInto verifies the message with the scratch buffer, once
+// the config and the length of the message have been checked.
+func verifyAuthMessageInto(c *MACConfig, scratch, enc []byte) (int64, error) {
+	if len(enc) < c.minEncodedLen() {
+		return 0, c.notify(enc, ErrMACTruncated)
+	}
+	text, ok := c.trimPrefix(enc)
+	if !ok {
+		return 0, c.notify(enc, ErrMACInvalid)
+	}
+	if n := len(text); len(scratch) < n {
+		scratch = make([]byte, n)
+	}
+	n, err := c.Encoding.decodeInto(scratch, text)
+	if err != nil {
+		return 0, c.notify(enc, ErrMACInvalid)
+	}
+	if n < c.minLen() {
+		return 0, c.notify(enc, ErrMACTruncated)
+	}
+	hdr := getHeader()
+	defer putHeader(hdr)
+	_, _, err = verifyMessage(c, scratch[:n], nil, messageOptions{verifyOnly: true, hdr: hdr})
+	if err != nil {
+		return 0, c.notify(enc, err)
+	}
+	return c.issuedAt(hdr), nil
 }
 
-// DecodeAuthMessage verifies a message authentified with message
-// authentication code and returns the message value algon with the issued time
-// of the message.
-func DecodeAuthMessage(c *MACConfig, enc []byte) ([]byte, error) {
-	assertMACConfig(c)
+// DecodeAuthMessageWithName is the same as DecodeAuthMessage, but also
+// returns the name the message has been verified with: the Name of the
+// config, or one of its AltNames.
+func DecodeAuthMessageWithName(c *MACConfig, enc []byte) (value []byte, name string, err error) {
+	value, hdr, err := decodeMessage(c, enc, nil, messageOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	return value, string(hdr.name), nil
+}
 
-	maxLength := c.MaxLen
-	if maxLength == 0 {
-		maxLength = defaultMaxLen
+// DecodeAuthMessageFull is the same as DecodeAuthMessageWithTime, but also
+// returns the time when the message expires: its issued time plus its own ttl
+// (see EncodeAuthMessageWithExpiry) or the MaxAge of the config, or its
+// absolute expiry time (see EncodeAuthMessageUntil) if it is earlier, or 0 if
+// it never expires. The MaxSkew and ExpiryGrace tolerances are not included.
+func DecodeAuthMessageFull(c *MACConfig, enc []byte) (value []byte, issuedAt, expiresAt int64, err error) {
+	value, hdr, err := decodeMessage(c, enc, nil, messageOptions{})
+	if err != nil {
+		return nil, 0, 0, err
 	}
+	return value, c.issuedAt(hdr), c.expiresAt(hdr), nil
+}
 
-	// Check length
-	if len(enc) > maxLength {
-		return nil, errMACTooLong
+// Header is the header of a message, returned by DecodeAuthMessageHeader
+// once the message has been verified: its fields are authenticated, and can
+// be trusted.
+type Header struct {
+	// Version is the version of the format of the message
+	Version uint8
+	// Prefix is the prefix of the message, from the config
+	Prefix string
+	// KeyID is the key id of the message, that has selected its key
+	KeyID []byte
+	// Name is the name the message has been verified with, that is the Name
+	// of the config or one of its AltNames
+	Name string
+	// Purpose is the purpose of the message, or 0
+	Purpose uint8
+	// IssuedAt is the issued time of the message, in the time unit of the
+	// config, or 0 without timestamp
+	IssuedAt int64
+	// ExpiresAt is the expiry time of the message, as returned by
+	// DecodeAuthMessageFull, or 0 if it never expires
+	ExpiresAt int64
+}
+
+// DecodeAuthMessageHeader is the same as DecodeAuthMessage, but also returns
+// the header of the message: its version, prefix, key id, etc. It replaces
+// the calls to DecodeAuthMessageFull and PeekHeader when the fields of the
+// header are needed after the verification. The header is only returned for
+// a valid message.
+func DecodeAuthMessageHeader(c *MACConfig, enc []byte) (value []byte, hdr Header, err error) {
+	value, h, err := decodeMessage(c, enc, nil, messageOptions{})
+	if err != nil {
+		return nil, Header{}, err
+	}
+	hdr = Header{
+		Version:   h.version,
+		Prefix:    c.Prefix,
+		KeyID:     append([]byte{}, h.keyID...),
+		Name:      string(h.name),
+		Purpose:   h.purpose,
+		ExpiresAt: c.expiresAt(h),
 	}
+	if h.flags&flagNoTime == 0 {
+		hdr.IssuedAt = c.issuedAt(h)
+	}
+	return value, hdr, nil
+}
 
-	// Decode from base64
-	dec, err := Base64Decode(enc)
+// RemainingTTL verifies a message and returns the time left before it
+// expires, in the time unit of the config: its expiry time, as returned by
+// DecodeAuthMessageFull, minus the current time. It can be used to refresh
+// the messages that will soon expire (see RefreshAuthMessage).
+//
+// ErrMACExpired is returned for an expired message. The time left is negative
+// for an expired message still accepted thanks to MaxSkew or ExpiryGrace, and
+// is math.MaxInt64 for a message that never expires.
+func RemainingTTL(c *MACConfig, enc []byte) (int64, error) {
+	_, hdr, err := decodeMessage(c, enc, nil, messageOptions{verifyOnly: true})
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	expiresAt := c.expiresAt(hdr)
+	if expiresAt == 0 {
+		return math.MaxInt64, nil
 	}
+	return expiresAt - c.now(), nil
+}
 
-	// Prepend name
-	dec = append([]byte(c.Name), dec...)
+// DecodeAuthMessageAllowExpired is the same as DecodeAuthMessageWithTime, but
+// when the message is authentic and only too old, its value is returned along
+// with ErrMACExpired. It can be used to show something from an expired
+// message, while still treating it as invalid. For the other errors, the
+// value is nil.
+func DecodeAuthMessageAllowExpired(c *MACConfig, enc []byte) (value []byte, issuedAt int64, err error) {
+	return decodeAuthMessage(c, enc, nil, messageOptions{allowExpired: true})
+}
 
-	// Verify message with MAC
-	{
-		if len(dec) < macLen {
-			return nil, errMACInvalid
-		}
-		var mac = dec[len(dec)-macLen:]
-		dec = dec[:len(dec)-macLen]
-		if !verifyMAC(c.Key, dec, mac) {
-			return nil, errMACInvalid
-		}
-	}
+// DecodeAuthMessageUnbounded is the same as DecodeAuthMessage, but the length
+// of the message is NOT checked against MaxLen and MaxDecodedLen. It must only
+// be used for trusted inputs, like the tokens exchanged between servers, that
+// can be longer than the public ones: an attacker could make the server
+// decode a message of any size. The MAC and the expiry are still verified,
+// and a compressed value still can't be longer than MaxDecodedLen once
+// decompressed.
+func DecodeAuthMessageUnbounded(c *MACConfig, enc []byte) ([]byte, error) {
+	value, _, err := decodeAuthMessage(c, enc, nil, messageOptions{unbounded: true})
+	return value, err
+}
+
+// contextCheckLen is the size of the decoded messages from which the context
+// is checked again by DecodeAuthMessageContext, before verifying their MAC.
+const contextCheckLen = 32 * 1024
+
+// DecodeAuthMessageContext is the same as DecodeAuthMessage, but the message
+// is not verified when the context is done, for example when the client of a
+// request has disconnected: the context is checked before decoding the
+// message, and again before verifying its MAC for a message longer than 32KB
+// once decoded. The error of the context is then returned, and the hooks of
+// the config are not called.
+func DecodeAuthMessageContext(ctx context.Context, c *MACConfig, enc []byte) ([]byte, error) {
+	value, _, err := decodeAuthMessage(c, enc, nil, messageOptions{ctx: ctx})
+	return value, err
+}
+
+// EncodeAuthMessageWithAAD is the same as EncodeAuthMessage, but the message is
+// also bound to the given additional data, that is not included in the
+// message. It can be used to tie a message to its context, like the session
+// or the resource it is made for, without revealing it.
+func EncodeAuthMessageWithAAD(c *MACConfig, value, aad []byte) ([]byte, error) {
+	return encodeAuthMessage(c, value, c.now(), messageOptions{aad: aad})
+}
 
-	// Skip name prefix
-	buf := bytes.NewBuffer(dec)
-	buf.Next(len(c.Name))
+// DecodeAuthMessageWithAAD verifies a message returned by
+// EncodeAuthMessageWithAAD. The same additional data must be given, or
+// ErrMACInvalid is returned.
+func DecodeAuthMessageWithAAD(c *MACConfig, enc, aad []byte) ([]byte, error) {
+	value, _, err := decodeAuthMessage(c, enc, nil, messageOptions{aad: aad})
+	return value, err
+}
 
-	// Read time and verify time ranges
-	var time int64
-	if err = binary.Read(buf, binary.BigEndian, &time); err != nil {
-		return nil, errMACInvalid
+// EncodeAuthMessageWithExpiry is the same as EncodeAuthMessage, but the message
+// expires after ttl seconds (or milliseconds, see TimeUnit), instead of the
+// MaxAge of the config. The ttl is
+// embedded in the message, and must be positive.
+func EncodeAuthMessageWithExpiry(c *MACConfig, value []byte, ttl int64) ([]byte, error) {
+	if ttl <= 0 {
+		return nil, errors.New("mac: the ttl must be positive")
 	}
-	if c.MaxAge != 0 && time < Timestamp()-c.MaxAge {
-		return nil, errMACExpired
+	if c.NoTimestamp {
+		return nil, errors.New("mac: the ttl can't be used without timestamp")
 	}
+	return encodeAuthMessage(c, value, c.now(), messageOptions{ttl: ttl})
+}
 
-	// Returns the value
-	return buf.Bytes(), nil
+// EncodeAuthMessageUntil is the same as EncodeAuthMessage, but the message
+// expires at the given time, in the time unit of the config, whatever the
+// time it has been issued. The time is embedded in the message, and must be
+// positive. The MaxAge of the config still applies, and the message expires
+// at the earliest of the two.
+func EncodeAuthMessageUntil(c *MACConfig, value []byte, notAfter int64) ([]byte, error) {
+	if notAfter <= 0 {
+		return nil, errors.New("mac: the expiry time must be positive")
+	}
+	if c.NoTimestamp {
+		return nil, errors.New("mac: the expiry time can't be used without timestamp")
+	}
+	return encodeAuthMessage(c, value, c.now(), messageOptions{notAfter: notAfter})
 }
 
-// createMAC creates a MAC with HMAC-SHA256
-func createMAC(key, value []byte) []byte {
+// keyFingerprintLen is the size of the key fingerprints.
+const keyFingerprintLen = 4
+
+// KeyFingerprint returns a short fingerprint of a key, that identifies it
+// without revealing it: the first 4 bytes of its HMAC-SHA256 over a fixed
+// string. It is stable for a given key, and can be compared by a KeyFunc.
+func KeyFingerprint(key []byte) []byte {
 	mac := hmac.New(sha256.New, key)
-	mac.Write(value)
-	return mac.Sum(nil)
+	mac.Write([]byte("mac key fingerprint"))
+	return mac.Sum(nil)[:keyFingerprintLen]
 }
 
-// verifyMAC returns true is the MAC is valid
-func verifyMAC(key, value []byte, mac []byte) bool {
-	expectedMAC := createMAC(key, value)
-	return hmac.Equal(mac, expectedMAC)
+// EncodeAuthMessageWithKeyID is the same as EncodeAuthMessage, but also
+// returns the key id of the message, for audit and rotation tracking. It is
+// the KeyID of the config, or when it is not set, the fingerprint of the key
+// (see KeyFingerprint), that is then written in the message instead. A config
+// with a Signer must have a KeyID.
+func EncodeAuthMessageWithKeyID(c *MACConfig, value []byte) (token, keyID []byte, err error) {
+	if err = c.Validate(); err != nil {
+		return nil, nil, err
+	}
+	keyID = c.KeyID
+	if keyID == nil {
+		if c.Signer != nil {
+			return nil, nil, errSignerUnsupported
+		}
+		keyID = c.macCache().keyFingerprint()
+	}
+	token, err = encodeAuthMessage(c, value, c.now(), messageOptions{keyID: keyID})
+	if err != nil {
+		return nil, nil, err
+	}
+	return token, cloneBytes(keyID), nil
+}
+
+// DecodeAuthMessageWithKeyID is the same as DecodeAuthMessage, but also
+// returns the key id written in the message, or nil if it has none.
+func DecodeAuthMessageWithKeyID(c *MACConfig, enc []byte) (value, keyID []byte, err error) {
+	value, hdr, err := decodeMessage(c, enc, nil, messageOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(hdr.keyID) > 0 {
+		keyID = cloneBytes(hdr.keyID)
+	}
+	return value, keyID, nil
+}
+
+// EncodeAuthMessageTo is the same as EncodeAuthMessage, but the encoded
+// message is appended to dst, and the extended slice is returned. It avoids
+// allocations when dst has enough capacity: a message of a config with Key,
+// without compression, padding nor salt, is then encoded without any
+// allocation.
+func EncodeAuthMessageTo(dst []byte, c *MACConfig, value []byte) ([]byte, error) {
+	return appendAuthMessage(dst, c, value, c.now(), messageOptions{})
+}
+
+// SignDetached returns the MAC of the given value, without the value itself.
+// It can be used when the value is already stored elsewhere. The returned
+// MAC is encoded in base64 and contains the header of the message, so it is
+// still bound to the name and the issued time.
+func SignDetached(c *MACConfig, value []byte) ([]byte, error) {
+	return encodeAuthMessage(c, value, c.now(), messageOptions{detached: true})
+}
+
+// VerifyDetached verifies a value against a MAC returned by SignDetached, and
+// returns the issued time of the MAC.
+func VerifyDetached(c *MACConfig, value, mac []byte) (int64, error) {
+	_, time, err := decodeAuthMessage(c, mac, value, messageOptions{detached: true})
+	return time, err
+}
+
+// RefreshAuthMessage verifies a message, and if it is valid, returns a new
+// message with the same value but issued now. It can be used for sliding
+// expiration. A message with its own ttl keeps it, so the refreshed message
+// expires ttl seconds after the refresh, and a message with an absolute
+// expiry time keeps it too, so it can't be refreshed past this time. The
+// errors of the verification are returned unchanged.
+func RefreshAuthMessage(c *MACConfig, enc []byte) ([]byte, error) {
+	value, hdr, err := decodeMessage(c, enc, nil, messageOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var opts messageOptions
+	if hdr.flags&flagTTL != 0 {
+		opts.ttl = c.TimeUnit.convert(hdr.ttl, hdr.unit(), true)
+	}
+	if hdr.flags&flagNotAfter != 0 {
+		opts.notAfter = c.notAfter(hdr)
+	}
+	return encodeAuthMessage(c, value, c.now(), opts)
+}
+
+// MigrateToken verifies a message with the old config, and if it is valid,
+// returns a new message with the same value for the new config. The message
+// keeps its issued time, and its own ttl or expiry time, so it does not live
+// longer than it would have. It can be used to move the messages to a new
+// key, name, hash or algorithm, without making the users authenticate again.
+// The errors of the verification are returned unchanged.
+//
+// A message without time gets the current time when the new config has
+// timestamps. A message with its own expiry can't be migrated to a config
+// with NoTimestamp.
+func MigrateToken(old, new *MACConfig, enc []byte) ([]byte, error) {
+	value, hdr, err := decodeMessage(old, enc, nil, messageOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var opts messageOptions
+	if hdr.flags&flagTTL != 0 {
+		opts.ttl = new.TimeUnit.convert(hdr.ttl, hdr.unit(), true)
+	}
+	if hdr.flags&flagNotAfter != 0 {
+		opts.notAfter = new.TimeUnit.convert(hdr.notAfter, hdr.unit(), false)
+	}
+	if new.NoTimestamp && (opts.ttl != 0 || opts.notAfter != 0) {
+		return nil, errors.New("mac: the expiry can't be migrated without timestamp")
+	}
+	issuedAt := new.now()
+	if hdr.flags&flagNoTime == 0 {
+		issuedAt = new.TimeUnit.convert(hdr.time, hdr.unit(), false)
+	}
+	return encodeAuthMessage(new, value, issuedAt, opts)
+}
+
+// Inspect returns the issued time and the length of the value of a message,
+// for debugging purposes. The length is the one of the value returned by
+// DecodeAuthMessage: a compressed value is decompressed, and the padding is
+// removed, to tell it.
+//
+// The MAC of the message is NOT verified: the returned data is not
+// authenticated and must not be trusted. ErrMACInvalid is returned if the
+// message is malformed, including when its header can't be read, like for an
+// unknown version, and ErrMACTooLong if its value can't be decompressed
+// within MaxDecodedLen.
+func Inspect(c *MACConfig, enc []byte) (issuedAt int64, valueLen int, err error) {
+	if err = c.Validate(); err != nil {
+		return 0, 0, err
+	}
+	dec, err := c.decode(enc)
+	if err != nil {
+		return 0, 0, ErrMACInvalid
+	}
+	hdr, hdrLen, err := readMACHeader(dec)
+	if err != nil {
+		return 0, 0, ErrMACInvalid
+	}
+	if len(dec) < hdrLen+c.macLen() {
+		return 0, 0, ErrMACInvalid
+	}
+	value := dec[hdrLen : len(dec)-c.macLen()]
+	if hdr.flags&flagCompressed != 0 {
+		if value, err = decompressValue(value, c.maxDecodedLen()); err != nil {
+			if err != ErrMACTooLong {
+				err = ErrMACInvalid
+			}
+			return 0, 0, err
+		}
+	}
+	if hdr.ext&extFlagPadded != 0 {
+		if value, err = unpadValue(value); err != nil {
+			return 0, 0, ErrMACInvalid
+		}
+	}
+	return c.issuedAt(hdr), len(value), nil
+}
+
+// maxHeaderLen is the maximal size of a header: version, flags, extended
+// flags, key id, purpose, time, ttl, notAfter and salt.
+const maxHeaderLen = 1 + 1 + 1 + 1 + maxKeyIDLen + 1 + 8 + 8 + 8 + saltLen
+
+// PeekHeader returns the version, the prefix and the key id of a message,
+// without any config. It is meant to select the config that will verify the
+// message, when several ones are possible, like the one of a tenant or of a
+// key id: only the beginning of the message is decoded, and the message must
+// still be decoded with DecodeAuthMessage afterward.
+//
+// The returned data is NOT authenticated and must not be trusted: anyone can
+// forge a message with any prefix or key id. They must not be used for an
+// authorization decision, only to choose how to verify the message.
+//
+// As the length of the prefix isn't known, it is the shortest one followed by
+// a valid header, in base64url with or without padding: a prefix that ends
+// like a header can be reported shorter than it is. ErrMACInvalid is returned
+// if no header is found, and ErrMACUnsupportedVersion with the version if the
+// message, without a prefix, has a version that can't be decoded.
+func PeekHeader(enc []byte) (version uint8, prefix string, keyID []byte, err error) {
+	err = ErrMACInvalid
+	for i := 0; i <= len(enc) && i <= maxPrefixLen; i++ {
+		dec, ok := peekDecode(enc[i:])
+		if !ok {
+			continue
+		}
+		hdr, _, herr := readMACHeader(dec)
+		if herr == nil {
+			return hdr.version, string(enc[:i]), append([]byte{}, hdr.keyID...), nil
+		}
+		if i == 0 && herr == ErrMACUnsupportedVersion {
+			version, err = dec[0], herr
+		}
+	}
+	return version, "", nil, err
+}
+
+// peekDecode decodes from base64url the beginning of a message, long enough
+// for its header.
+func peekDecode(enc []byte) ([]byte, bool) {
+	n := base64.RawURLEncoding.EncodedLen(maxHeaderLen)
+	n += (4 - n%4) % 4
+	if len(enc) > n {
+		enc = enc[:n]
+	} else {
+		enc = bytes.TrimRight(enc, "=")
+	}
+	dec := make([]byte, base64.RawURLEncoding.DecodedLen(len(enc)))
+	m, err := base64.RawURLEncoding.Decode(dec, enc)
+	if err != nil || m == 0 {
+		return nil, false
+	}
+	return dec[:m], true
+}
+
+// macVersion is the version of the format of the messages
+const macVersion byte = 1
+
+// versionCompact is set in the version byte of the compact messages, whose
+// time is always a varint, and whose tag is truncated to compactTagLen.
+const versionCompact byte = 0x80
+
+// The flags of the header
+const (
+	// flagTTL is set when the message has its own ttl
+	flagTTL byte = 1 << iota
+	// flagMilliseconds is set when the time and ttl are in milliseconds
+	flagMilliseconds
+	// flagNoTime is set when the message has no time
+	flagNoTime
+	// flagCompressed is set when the value is compressed
+	flagCompressed
+	// flagPurpose is set when the message has a purpose
+	flagPurpose
+	// flagXChaCha20 is set when an encrypted message uses XChaCha20Poly1305
+	flagXChaCha20
+	// flagNotAfter is set when the message has an absolute expiry time
+	flagNotAfter
+	// flagExtended is set when the header has a second byte of flags, the
+	// extended flags
+	flagExtended
+)
+
+const knownFlags = flagTTL | flagMilliseconds | flagNoTime | flagCompressed |
+	flagPurpose | flagXChaCha20 | flagNotAfter | flagExtended
+
+// The extended flags of the header
+const (
+	// extFlagSalt is set when the message has a random salt
+	extFlagSalt byte = 1 << iota
+	// extFlagCompactTime is set when the time is written as a varint
+	extFlagCompactTime
+	// extFlagPadded is set when the value is padded
+	extFlagPadded
+)
+
+const knownExtFlags = extFlagSalt | extFlagCompactTime | extFlagPadded
+
+// saltLen is the size of the salt of the messages with Unpredictable.
+const saltLen = 8
+
+// macHeader is the header of a message, between the MAC prefix and the value.
+type macHeader struct {
+	version  byte
+	compact  bool
+	flags    byte
+	ext      byte
+	keyID    []byte
+	purpose  uint8
+	time     int64
+	ttl      int64
+	notAfter int64
+	salt     []byte
+
+	// name is the name the message has been verified with, that is not
+	// written in the message
+	name []byte
+}
+
+// newMACHeader returns the header of a message with the given options, with
+// a random salt for Unpredictable.
+func newMACHeader(c *MACConfig, time int64, opts messageOptions) (*macHeader, error) {
+	h := new(macHeader)
+	if err := h.fill(c, time, opts); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// fill is the same as newMACHeader, but sets h instead of allocating a new
+// header.
+func (h *macHeader) fill(c *MACConfig, time int64, opts messageOptions) error {
+	h.init(c, time, opts)
+	if h.ext&extFlagSalt != 0 {
+		salt, err := c.randomBytes(saltLen)
+		if err != nil {
+			return err
+		}
+		h.salt = salt
+	}
+	return nil
+}
+
+// init sets h to the header of a message with the given options, without its
+// salt. It is enough to compute the size of the header.
+func (h *macHeader) init(c *MACConfig, time int64, opts messageOptions) {
+	*h = macHeader{version: macVersion, compact: opts.compact, keyID: c.KeyID, time: c.epochStart(time)}
+	if opts.keyID != nil {
+		h.keyID = opts.keyID
+	}
+	if c.TimeUnit == Milliseconds {
+		h.flags |= flagMilliseconds
+	}
+	if c.NoTimestamp || opts.macDomain() == macDomainSIV {
+		h.flags |= flagNoTime
+		h.time = 0
+	}
+	if opts.ttl != 0 {
+		h.flags |= flagTTL
+		h.ttl = opts.ttl
+	}
+	if opts.notAfter != 0 {
+		h.flags |= flagNotAfter
+		h.notAfter = opts.notAfter
+	}
+	if opts.compressed {
+		h.flags |= flagCompressed
+	}
+	if c.Purpose != 0 {
+		h.flags |= flagPurpose
+		h.purpose = c.Purpose
+	}
+	if opts.aead == XChaCha20Poly1305 {
+		h.flags |= flagXChaCha20
+	}
+	if c.Unpredictable && opts.macDomain() != macDomainEncrypted && opts.macDomain() != macDomainSIV {
+		h.ext |= extFlagSalt
+	}
+	if opts.padded {
+		h.ext |= extFlagPadded
+	}
+	if c.CompactTime && !h.compact && h.flags&flagNoTime == 0 {
+		h.ext |= extFlagCompactTime
+	}
+	if h.ext != 0 {
+		h.flags |= flagExtended
+	}
+}
+
+// size returns the size of the header in the message.
+func (h *macHeader) size() int {
+	size := 1 + 1 + 1 + len(h.keyID)
+	if h.flags&flagExtended != 0 {
+		size++
+	}
+	if h.ext&extFlagSalt != 0 {
+		size += saltLen
+	}
+	if h.flags&flagPurpose != 0 {
+		size++
+	}
+	if h.flags&flagNoTime == 0 {
+		size += h.timeLen()
+	}
+	if h.flags&flagTTL != 0 {
+		size += 8
+	}
+	if h.flags&flagNotAfter != 0 {
+		size += 8
+	}
+	return size
+}
+
+// timeLen returns the size of the time in the message.
+func (h *macHeader) timeLen() int {
+	if !h.varintTime() {
+		return 8
+	}
+	var field [binary.MaxVarintLen64]byte
+	return binary.PutVarint(field[:], h.time)
+}
+
+// varintTime returns true when the time is written as a varint.
+func (h *macHeader) varintTime() bool {
+	return h.compact || h.ext&extFlagCompactTime != 0
+}
+
+// write writes the header in the MAC input.
+func (h *macHeader) write(buf *bytes.Buffer) {
+	var field [binary.MaxVarintLen64]byte
+	if h.compact {
+		buf.WriteByte(h.version | versionCompact)
+	} else {
+		buf.WriteByte(h.version)
+	}
+	buf.WriteByte(h.flags)
+	if h.flags&flagExtended != 0 {
+		buf.WriteByte(h.ext)
+	}
+	buf.WriteByte(byte(len(h.keyID)))
+	buf.Write(h.keyID)
+	if h.flags&flagPurpose != 0 {
+		buf.WriteByte(h.purpose)
+	}
+	if h.flags&flagNoTime == 0 && h.varintTime() {
+		buf.Write(field[:binary.PutVarint(field[:], h.time)])
+	} else if h.flags&flagNoTime == 0 {
+		binary.BigEndian.PutUint64(field[:], uint64(h.time))
+		buf.Write(field[:8])
+	}
+	if h.flags&flagTTL != 0 {
+		binary.BigEndian.PutUint64(field[:], uint64(h.ttl))
+		buf.Write(field[:8])
+	}
+	if h.flags&flagNotAfter != 0 {
+		binary.BigEndian.PutUint64(field[:], uint64(h.notAfter))
+		buf.Write(field[:8])
+	}
+	buf.Write(h.salt)
+}
+
+// readMACHeader reads the header at the start of a decoded message, and
+// returns it along with its size.
+func readMACHeader(dec []byte) (*macHeader, int, error) {
+	h := new(macHeader)
+	n, err := readMACHeaderInto(h, dec)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h, n, nil
+}
+
+// readMACHeaderInto is the same as readMACHeader, but the header is read in
+// h, that is left in an unspecified state on error.
+func readMACHeaderInto(h *macHeader, dec []byte) (int, error) {
+	if len(dec) < 1 {
+		return 0, ErrMACInvalid
+	}
+	read, ok := macHeaderReaders[dec[0]&^versionCompact]
+	if !ok {
+		return 0, ErrMACUnsupportedVersion
+	}
+	return read(h, dec)
+}
+
+// macHeaderReaders are the functions reading the headers, for each version of
+// the format that can be decoded.
+var macHeaderReaders = map[uint8]func(h *macHeader, dec []byte) (int, error){
+	1: readMACHeaderV1,
+}
+
+// SupportedVersions returns the versions of the format of the messages that
+// can be decoded, in increasing order. The messages are always encoded with
+// the latest one.
+func SupportedVersions() []uint8 {
+	versions := make([]uint8, 0, len(macHeaderReaders))
+	for version := range macHeaderReaders {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// readMACHeaderV1 reads a header in the version 1 of the format.
+func readMACHeaderV1(h *macHeader, dec []byte) (int, error) {
+	if len(dec) < 3 {
+		return 0, ErrMACInvalid
+	}
+	*h = macHeader{version: dec[0] &^ versionCompact, compact: dec[0]&versionCompact != 0, flags: dec[1]}
+	if h.flags&^knownFlags != 0 {
+		return 0, ErrMACInvalid
+	}
+	n := 2
+	if h.flags&flagExtended != 0 {
+		h.ext = dec[2]
+		if h.ext == 0 || h.ext&^knownExtFlags != 0 || len(dec) < 4 {
+			return 0, ErrMACInvalid
+		}
+		if h.compact && h.ext&extFlagCompactTime != 0 {
+			return 0, ErrMACInvalid
+		}
+		n++
+	}
+	start := n + 1
+	n = start + int(dec[n])
+	if len(dec) < n {
+		return 0, ErrMACInvalid
+	}
+	h.keyID = dec[start:n:n]
+	if len(dec) < h.size() {
+		return 0, ErrMACInvalid
+	}
+	if h.flags&flagPurpose != 0 {
+		h.purpose = dec[n]
+		if h.purpose == 0 {
+			return 0, ErrMACInvalid
+		}
+		n++
+	}
+	if h.flags&flagNoTime != 0 {
+		if h.flags&(flagTTL|flagNotAfter) != 0 || h.ext&extFlagCompactTime != 0 {
+			return 0, ErrMACInvalid
+		}
+	} else if h.varintTime() {
+		// The size of the header is only known once the time has been read,
+		// and a time that is not written with its shortest varint is
+		// rejected, so that a message has only one encoding
+		var m int
+		h.time, m = binary.Varint(dec[n:])
+		if m <= 0 || m != h.timeLen() || len(dec) < h.size() {
+			return 0, ErrMACInvalid
+		}
+		n += m
+	} else {
+		h.time = int64(binary.BigEndian.Uint64(dec[n:]))
+		n += 8
+	}
+	if h.flags&flagTTL != 0 {
+		h.ttl = int64(binary.BigEndian.Uint64(dec[n:]))
+		if h.ttl <= 0 {
+			return 0, ErrMACInvalid
+		}
+		n += 8
+	}
+	if h.flags&flagNotAfter != 0 {
+		h.notAfter = int64(binary.BigEndian.Uint64(dec[n:]))
+		if h.notAfter <= 0 {
+			return 0, ErrMACInvalid
+		}
+		n += 8
+	}
+	if h.ext&extFlagSalt != 0 {
+		h.salt = dec[n : n+saltLen : n+saltLen]
+	}
+	return h.size(), nil
+}
+
+// EncodeAuthMessageBinary is the same as EncodeAuthMessage, but the message is
+// returned as raw bytes, without the base64 encoding. The maximum length is
+// checked against the length of the raw message.
+func EncodeAuthMessageBinary(c *MACConfig, value []byte) ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	msg, err := signMessage(new(bytes.Buffer), c, value, c.now(), messageOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > c.maxLen() {
+		return nil, ErrMACTooLong
+	}
+	return msg, nil
+}
+
+// DecodeAuthMessageBinary verifies a raw message returned by
+// EncodeAuthMessageBinary and returns its value. The returned value shares
+// the memory of the given message.
+func DecodeAuthMessageBinary(c *MACConfig, msg []byte) ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if len(msg) > c.maxLen() {
+		return nil, c.notify(msg, ErrMACTooLong)
+	}
+	if len(msg) < c.minLen() {
+		return nil, c.notify(msg, ErrMACTruncated)
+	}
+	value, _, err := verifyMessage(c, msg, nil, messageOptions{})
+	return value, c.notify(msg, err)
+}
+
+// minLen returns the minimum length of the decoded messages: the header
+// without key id nor optional fields but the time, and the MAC. The shorter
+// messages are rejected with ErrMACTruncated, without the cost of a MAC.
+func (c *MACConfig) minLen() int {
+	n := 3 + c.macLen()
+	if !c.NoTimestamp {
+		// The extended flags and a time of 1 byte, with CompactTime
+		n += 2
+	}
+	return n
+}
+
+// maxLen returns the maximum length of the messages.
+func (c *MACConfig) maxLen() int {
+	if c.MaxLen == 0 {
+		return DefaultMaxLen
+	}
+	return c.MaxLen
+}
+
+// maxDecodedLen returns the maximum length of the decoded messages, and of
+// their values once decompressed.
+func (c *MACConfig) maxDecodedLen() int {
+	if c.MaxDecodedLen == 0 {
+		return maxCompressionRatio * c.maxLen()
+	}
+	return c.MaxDecodedLen
+}
+
+// encodedLen returns the maximal length of the encoded message, with its
+// prefix, for a raw message of n bytes. It is the length with padding for
+// the base64 encodings, so that a message fits in MaxLen in both forms.
+func (c *MACConfig) encodedLen(n int) int {
+	return len(c.Prefix) + c.Encoding.maxEncodedLen(n)
+}
+
+// minEncodedLen returns the minimum length of the encoded messages, with
+// their prefix and without padding. The shorter messages are rejected with
+// ErrMACTruncated before being decoded.
+func (c *MACConfig) minEncodedLen() int {
+	if c.Encoding == Base32 {
+		return len(c.Prefix) + c.Encoding.encodedLen(c.minLen())
+	}
+	return len(c.Prefix) + base64.RawURLEncoding.EncodedLen(c.minLen())
+}
+
+// appendEncode appends the prefix and the encoding of the raw message to dst.
+func (c *MACConfig) appendEncode(dst, msg []byte) []byte {
+	dst = append(dst, c.Prefix...)
+	return c.Encoding.appendEncode(dst, msg)
+}
+
+// decode removes the prefix of the encoded message, and decodes it.
+// ErrMACInvalid is returned if the prefix is missing.
+func (c *MACConfig) decode(enc []byte) ([]byte, error) {
+	text, ok := c.trimPrefix(enc)
+	if !ok {
+		return nil, ErrMACInvalid
+	}
+	return c.Encoding.decode(text)
+}
+
+// trimPrefix returns the encoded message without its prefix, or false if it
+// does not start with the prefix of the config.
+func (c *MACConfig) trimPrefix(enc []byte) ([]byte, bool) {
+	if len(enc) < len(c.Prefix) || string(enc[:len(c.Prefix)]) != c.Prefix {
+		return nil, false
+	}
+	return enc[len(c.Prefix):], true
+}
+
+// messageOptions are the options of a message that are not in the config.
+type messageOptions struct {
+	// domain is the kind of message, bound in its MAC, and defaults to
+	// macDomainMessage
+	domain byte
+	// detached is true when the value is not included in the message
+	detached bool
+	// aad is the additional data, bound in the MAC but not included in the
+	// message
+	aad []byte
+	// ttl is the maximum age of the message, in the time unit of the config,
+	// that overrides the MaxAge of the config
+	ttl int64
+	// notAfter is the absolute expiry time of the message, in the time unit
+	// of the config
+	notAfter int64
+	// allowExpired is true when the value of an authentic but expired message
+	// is returned with ErrMACExpired
+	allowExpired bool
+	// compressed is true when the value is compressed
+	compressed bool
+	// verifyOnly is true when the value is not returned
+	verifyOnly bool
+	// aead is the algorithm of an encrypted message
+	aead AEADAlgorithm
+	// keyID is the key id written in the message instead of the KeyID of
+	// the config
+	keyID []byte
+	// unbounded is true when the length of the message is not checked
+	// against MaxLen and MaxDecodedLen
+	unbounded bool
+	// compact is true for the messages of EncodeCompact
+	compact bool
+	// ctx, when set, is checked before the expensive steps of the decoding
+	ctx context.Context
+	// padded is true when the value is padded
+	padded bool
+	// diag, when set, records the stage reached by the decoding
+	diag *Diagnostics
+	// hdr, when set, is the header in which the message is read, instead of
+	// a new one
+	hdr *macHeader
+}
+
+func (o messageOptions) macDomain() byte {
+	if o.domain == 0 {
+		return macDomainMessage
+	}
+	return o.domain
+}
+
+// checkContext returns the error of the context of the options, if any.
+func (o messageOptions) checkContext() error {
+	if o.ctx == nil {
+		return nil
+	}
+	return o.ctx.Err()
+}
+
+// prefixLen returns the size of the part of the MAC input that is removed
+// from the message.
+func (o messageOptions) prefixLen(c *MACConfig) int {
+	return macPrefixLen(c) + 4 + len(o.aad)
+}
+
+// writePrefix writes the part of the MAC input that is removed from the
+// message: the domain, the name and the additional data.
+func (o messageOptions) writePrefix(buf *bytes.Buffer, c *MACConfig) {
+	var aadLen [4]byte
+	binary.BigEndian.PutUint32(aadLen[:], uint32(len(o.aad)))
+	writeMACPrefix(buf, c, o.macDomain())
+	buf.Write(aadLen[:])
+	buf.Write(o.aad)
+}
+
+// encodeAuthMessage encodes the message for the given issued time.
+func encodeAuthMessage(c *MACConfig, value []byte, time int64, opts messageOptions) ([]byte, error) {
+	return appendAuthMessage(nil, c, value, time, opts)
+}
+
+// appendAuthMessage appends the encoded message for the given issued time to
+// dst.
+func appendAuthMessage(dst []byte, c *MACConfig, value []byte, time int64, opts messageOptions) ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	msg, err := signMessage(buf, c, value, time, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check length
+	if c.encodedLen(len(msg)) > c.maxLen() {
+		return nil, ErrMACTooLong
+	}
+
+	// Encode to base64
+	return c.appendEncode(dst, msg), nil
+}
+
+// decodeAuthMessage decodes and verifies a message, and returns its value and
+// issued time. For a detached message, the message does not contain the
+// value, and the given value is verified instead.
+func decodeAuthMessage(c *MACConfig, enc, value []byte, opts messageOptions) ([]byte, int64, error) {
+	value, hdr, err := decodeMessage(c, enc, value, opts)
+	if hdr == nil {
+		return nil, 0, err
+	}
+	return value, c.issuedAt(hdr), err
+}
+
+// decodeMessage is the same as decodeAuthMessage, but returns the header of
+// the message instead of its issued time.
+func decodeMessage(c *MACConfig, enc, value []byte, opts messageOptions) ([]byte, *macHeader, error) {
+	opts.reach(DiagConfig)
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	// Check length
+	opts.reach(DiagLength)
+	if len(enc) > c.maxLen() && !opts.unbounded {
+		return nil, nil, c.notify(enc, ErrMACTooLong)
+	}
+	if err := opts.checkContext(); err != nil {
+		return nil, nil, err
+	}
+	if len(enc) < c.minEncodedLen() {
+		return nil, nil, c.notify(enc, ErrMACTruncated)
+	}
+
+	// Decode from base64
+	opts.reach(DiagBase64)
+	dec, err := c.decode(enc)
+	if err != nil {
+		return nil, nil, c.notify(enc, ErrMACInvalid)
+	}
+	opts.reach(DiagLength)
+	if len(dec) < c.minLen() {
+		return nil, nil, c.notify(enc, ErrMACTruncated)
+	}
+	if len(dec) > contextCheckLen {
+		if err := opts.checkContext(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	value, hdr, err := verifyMessage(c, dec, value, opts)
+	return value, hdr, c.notify(enc, err)
+}
+
+// signMessage creates the raw message, with its MAC, for the given value and
+// issued time. The message is written in the given empty buffer.
+func signMessage(buf *bytes.Buffer, c *MACConfig, value []byte, time int64, opts messageOptions) ([]byte, error) {
+	if c.PadTo != 0 && !opts.detached {
+		padded, err := padValue(value, c.PadTo)
+		if err != nil {
+			return nil, err
+		}
+		value = padded
+		opts.padded = true
+	} else if c.Compress && !opts.detached {
+		if len(value) > c.maxDecodedLen() {
+			return nil, ErrMACTooLong
+		}
+		if compressed := compressValue(value); compressed != nil {
+			value = compressed
+			opts.compressed = true
+		}
+	}
+	var hdr macHeader
+	if err := hdr.fill(c, time, opts); err != nil {
+		return nil, err
+	}
+
+	// Create message with MAC, computed after the message in the buffer
+	buf.Grow(opts.prefixLen(c) + hdr.size() + len(value) + c.maxTagLen())
+	opts.writePrefix(buf, c)
+	hdr.write(buf)
+	buf.Write(value)
+	mac, err := c.signTo(buf.AvailableBuffer(), buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip name
+	buf.Next(opts.prefixLen(c))
+
+	// Remove the value of a detached MAC, and append the MAC
+	if opts.detached {
+		buf.Truncate(hdr.size())
+	}
+	buf.Write(mac)
+	if buf.Len() > c.maxDecodedLen() {
+		return nil, ErrMACTooLong
+	}
+	return buf.Bytes(), nil
+}
+
+// verifyMessage verifies a raw message, and returns its value and header.
+func verifyMessage(c *MACConfig, dec, value []byte, opts messageOptions) ([]byte, *macHeader, error) {
+	opts.reach(DiagLength)
+	if len(dec) > c.maxDecodedLen() && !opts.unbounded {
+		return nil, nil, ErrMACTooLong
+	}
+
+	// Read the header and resolve the key
+	opts.reach(DiagHeader)
+	hdr := opts.hdr
+	if hdr == nil {
+		hdr = new(macHeader)
+	}
+	hdrLen, err := readMACHeaderInto(hdr, dec)
+	if err != nil {
+		return nil, nil, c.reject(dec, err)
+	}
+	if hdr.compact != opts.compact {
+		return nil, nil, c.reject(dec, ErrMACInvalid)
+	}
+	opts.reach(DiagKey)
+	var key []byte
+	if c.Signer == nil {
+		if key, err = c.key(hdr.keyID); err != nil {
+			return nil, nil, c.reject(dec, ErrMACInvalid)
+		}
+	}
+
+	// Split the value and the MAC
+	opts.reach(DiagLength)
+	macLen := c.macLen()
+	if len(dec) < hdrLen+macLen {
+		return nil, nil, c.reject(dec, ErrMACTruncated)
+	}
+	mac := dec[len(dec)-macLen:]
+	if opts.detached {
+		if len(dec) != hdrLen+macLen {
+			return nil, nil, c.reject(dec, ErrMACInvalid)
+		}
+	} else {
+		value = dec[hdrLen : len(dec)-macLen]
+	}
+
+	// Verify message with MAC, for the name and then the alternative names
+	opts.reach(DiagMAC)
+	ok, err := verifyInput(c, key, dec[:hdrLen], value, mac, opts)
+	hdr.name = c.name()
+	if !ok && err == nil && len(c.AltNames) > 0 {
+		for _, alt := range c.macCache().altConfigs(c) {
+			ok, err = verifyInput(alt, key, dec[:hdrLen], value, mac, opts)
+			hdr.name = alt.name()
+			if ok || err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, ErrMACInvalid
+	}
+
+	// Verify the purpose
+	opts.reach(DiagPurpose)
+	if hdr.purpose != c.Purpose {
+		return nil, nil, ErrMACWrongPurpose
+	}
+
+	// Decompress the value
+	opts.reach(DiagValue)
+	if hdr.flags&flagCompressed != 0 && !opts.verifyOnly {
+		if opts.detached {
+			return nil, nil, ErrMACInvalid
+		}
+		if value, err = decompressValue(value, c.maxDecodedLen()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Remove the padding
+	if hdr.ext&extFlagPadded != 0 && !opts.verifyOnly {
+		if opts.detached || hdr.flags&flagCompressed != 0 {
+			return nil, nil, ErrMACInvalid
+		}
+		if value, err = unpadValue(value); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Verify time ranges
+	opts.reach(DiagTime)
+	if err = c.checkTime(hdr); err != nil {
+		if err == ErrMACExpired && opts.allowExpired {
+			return value, hdr, err
+		}
+		return nil, nil, err
+	}
+
+	// Returns the value
+	return value, hdr, nil
+}
+
+// verifyInput verifies the MAC of a message, computed over the MAC input for
+// the name of the config.
+func verifyInput(c *MACConfig, key, header, value, mac []byte, opts messageOptions) (bool, error) {
+	input := getBuffer()
+	defer putBuffer(input)
+	input.Grow(opts.prefixLen(c) + len(header) + len(value) + c.maxTagLen())
+	opts.writePrefix(input, c)
+	input.Write(header)
+	input.Write(value)
+	return c.verifyTo(input.AvailableBuffer(), key, input.Bytes(), mac)
+}
+
+// unit returns the unit of the time and ttl of the header.
+func (h *macHeader) unit() TimeUnit {
+	if h.flags&flagMilliseconds != 0 {
+		return Milliseconds
+	}
+	return Seconds
+}
+
+// issuedAt returns the time of the header, in the unit of the config.
+func (c *MACConfig) issuedAt(hdr *macHeader) int64 {
+	return c.TimeUnit.convert(hdr.time, hdr.unit(), false)
+}
+
+// reject computes and compares a MAC over a malformed message before
+// returning err, so that it takes about the same time to reject it as a
+// message with a bad MAC. It is skipped with a Signer: the time of a remote
+// call would hide the difference anyway, and it would cost a call for each
+// malformed token.
+func (c *MACConfig) reject(dec []byte, err error) error {
+	if c.Signer != nil {
+		return err
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.Grow(2 * kmacMaxTagLen)
+	b := buf.Bytes()[:2*kmacMaxTagLen]
+	mac := b[:c.macLen()]
+	zeroBytes(mac)
+	c.verifyTo(b[kmacMaxTagLen:], c.Key, dec, mac)
+	return err
+}
+
+// notify calls the hook of the config for the error returned when decoding
+// the given message, if it has one, and returns the error.
+func (c *MACConfig) notify(enc []byte, err error) error {
+	var hook func(enc []byte)
+	switch err {
+	case ErrMACExpired:
+		hook = c.OnExpired
+	case ErrMACInvalid, ErrMACTruncated:
+		hook = c.OnInvalid
+	case ErrMACTooLong:
+		hook = c.OnTooLong
+	}
+	if hook != nil {
+		hook(enc)
+	}
+	return err
+}
+
+// expiresAt returns the time when the message with the given header expires,
+// in the unit of the config, or 0 if it never expires.
+func (c *MACConfig) expiresAt(hdr *macHeader) int64 {
+	if c.NoTimestamp {
+		return 0
+	}
+	var expiresAt int64
+	if maxAge := c.maxAge(hdr); maxAge != 0 {
+		expiresAt = c.issuedAt(hdr) + maxAge
+		if expiresAt < c.issuedAt(hdr) {
+			expiresAt = math.MaxInt64
+		}
+	}
+	if hdr.flags&flagNotAfter != 0 {
+		notAfter := c.notAfter(hdr)
+		if expiresAt == 0 || notAfter < expiresAt {
+			expiresAt = notAfter
+		}
+	}
+	return expiresAt
+}
+
+// notAfter returns the absolute expiry time of the header, in the unit of the
+// config.
+func (c *MACConfig) notAfter(hdr *macHeader) int64 {
+	return c.TimeUnit.convert(hdr.notAfter, hdr.unit(), false)
+}
+
+// maxAge returns the maximum age of the message with the given header, in the
+// unit of the config, rounded up to whole epochs with EpochSeconds.
+func (c *MACConfig) maxAge(hdr *macHeader) int64 {
+	if hdr.flags&flagTTL != 0 {
+		return c.epochMaxAge(c.TimeUnit.convert(hdr.ttl, hdr.unit(), true))
+	}
+	return c.epochMaxAge(c.purposeMaxAge(hdr.purpose))
+}
+
+// purposeMaxAge returns the maximum age of the messages of the given purpose,
+// from MaxAgeByPurpose or MaxAge.
+func (c *MACConfig) purposeMaxAge(purpose uint8) int64 {
+	if maxAge, ok := c.MaxAgeByPurpose[purpose]; ok {
+		return maxAge
+	}
+	return c.MaxAge
+}
+
+// checkTime verifies that the message with the given header is neither
+// expired nor issued in the future. A message without time is only valid for
+// a config with NoTimestamp, and the other way round.
+func (c *MACConfig) checkTime(hdr *macHeader) error {
+	if (hdr.flags&flagNoTime != 0) != c.NoTimestamp {
+		return ErrMACInvalid
+	}
+	if c.NoTimestamp {
+		return nil
+	}
+	now := c.now()
+	issuedAt := c.issuedAt(hdr)
+	if c.MaxSkew > 0 && after(issuedAt, now, uint64(c.MaxSkew)) {
+		return ErrMACFromFuture
+	}
+	grace := uint64(c.MaxSkew) + uint64(c.ExpiryGrace)
+	maxAge := c.maxAge(hdr)
+	if maxAge != 0 && c.EpochSeconds != 0 {
+		if c.epochExpired(now, issuedAt, maxAge, grace) {
+			return ErrMACExpired
+		}
+	} else if maxAge != 0 && after(now, issuedAt, uint64(maxAge)+grace) {
+		return ErrMACExpired
+	}
+	if hdr.flags&flagNotAfter != 0 && after(now, c.notAfter(hdr), grace) {
+		return ErrMACExpired
+	}
+	return nil
+}
+
+// after returns true if the time a is more than d after the time b. The
+// difference is computed on unsigned integers, so it can't overflow, whatever
+// the times and the duration.
+func after(a, b int64, d uint64) bool {
+	return a > b && uint64(a)-uint64(b) > d
+}
+
+// EncodeAuthMessageString is the same as EncodeAuthMessage, but for a string
+// value and a string message.
+func EncodeAuthMessageString(c *MACConfig, value string) (string, error) {
+	enc, err := EncodeAuthMessage(c, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return string(enc), nil
+}
+
+// DecodeAuthMessageString is the same as DecodeAuthMessage, but for a string
+// message and a string value.
+func DecodeAuthMessageString(c *MACConfig, enc string) (string, error) {
+	value, err := DecodeAuthMessage(c, []byte(enc))
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// macPrefixLen returns the size of the domain, the length-prefixed Prefix
+// and the length-prefixed name at the start of the MAC input.
+func macPrefixLen(c *MACConfig) int {
+	n := 1 + 4 + len(c.name())
+	if c.Prefix != "" {
+		n += 1 + len(c.Prefix)
+	}
+	return n
+}
+
+// writeMACPrefix writes the domain and the length-prefixed name of the config
+// at the start of the MAC input. With a Prefix, the high bit of the domain is
+// set, and the prefix is written with its length on 1 byte before the name, so
+// the MAC inputs with and without a Prefix can't be confused.
+func writeMACPrefix(buf *bytes.Buffer, c *MACConfig, domain byte) {
+	if c.Prefix != "" {
+		buf.WriteByte(domain | macDomainPrefixed)
+		buf.WriteByte(byte(len(c.Prefix)))
+		buf.WriteString(c.Prefix)
+	} else {
+		buf.WriteByte(domain)
+	}
+	var nameLen [4]byte
+	binary.BigEndian.PutUint32(nameLen[:], uint32(len(c.name())))
+	buf.Write(nameLen[:])
+	buf.Write(c.name())
+}
+
+// createMAC creates a MAC with HMAC and the given hash function
+func createMAC(h crypto.Hash, key, value []byte) []byte {
+	mac := hmac.New(h.New, key)
+	mac.Write(value)
+	return mac.Sum(nil)
+}
+
+// verifyMAC returns true is the MAC is valid. The MAC can be truncated, but
+// must be at least minTagLen bytes long.
+func verifyMAC(h crypto.Hash, key, value []byte, mac []byte) bool {
+	return equalMAC(mac, createMAC(h, key, value))
+}
+
+// equalMAC returns true if the MAC is equal to the expected one, or to its
+// truncation to at least minTagLen bytes.
+func equalMAC(mac, expectedMAC []byte) bool {
+	if len(mac) < minTagLen || len(mac) > len(expectedMAC) {
+		return false
+	}
+	return ConstantTimeEqual(mac, expectedMAC[:len(mac)])
 }
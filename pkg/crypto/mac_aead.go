@@ -0,0 +1,204 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const aeadKeyLen = 32
+
+// AEADAlgorithm is the authenticated encryption used by EncryptAuthMessage.
+type AEADAlgorithm int
+
+const (
+	// AESGCM is AES-256-GCM, with a 12 bytes nonce. This is the default.
+	AESGCM AEADAlgorithm = iota
+	// XChaCha20Poly1305 is XChaCha20-Poly1305, with a 24 bytes nonce. It is
+	// faster than AESGCM on the CPUs without AES instructions, and its
+	// random nonces can be used safely for any number of messages.
+	XChaCha20Poly1305
+)
+
+// EncryptAuthMessage is the same as EncodeAuthMessage, but the value is
+// encrypted with the AEAD of the config, AES-256-GCM by default, so that it
+// can't be read without the key. The encryption key is derived from the key
+// of the config with HKDF-SHA256.
+//
+// Message format (name prefix is authenticated but removed from message):
+//
+//  <------------------- additional data ------------------->
+//                                             <----------------- message ----------------->
+//  | domain | name len |  name | aad len |  aad | header |       nonce | ciphertext + tag |
+//  | 1 byte |  4 bytes |  ---- | 4 bytes | ---- |   ---- | 12/24 bytes |  blob + 16 bytes |
+//
+// The header has the same format as for EncodeAuthMessage, and the aad is
+// always empty. A flag of the header tells which AEAD has been used, so that
+// the messages can be decrypted whatever the AEAD of the config. The key is needed for the encryption, so a config with a
+// Signer can't be used.
+//
+func EncryptAuthMessage(c *MACConfig, value []byte) ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Signer != nil {
+		return nil, errSignerUnsupported
+	}
+
+	aead, err := newAEAD(c.Key, c.AEAD)
+	if err != nil {
+		return nil, err
+	}
+	opts := messageOptions{domain: macDomainEncrypted, aead: c.AEAD}
+	if c.PadTo != 0 {
+		if value, err = padValue(value, c.PadTo); err != nil {
+			return nil, err
+		}
+		opts.padded = true
+	}
+	hdr, err := newMACHeader(c, c.now(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the additional data
+	ad := new(bytes.Buffer)
+	opts.writePrefix(ad, c)
+	hdr.write(ad)
+
+	// Create the message
+	nonce, err := c.randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, hdr.size()+len(nonce)+len(value)+aead.Overhead()))
+	hdr.write(buf)
+	buf.Write(nonce)
+	msg := aead.Seal(buf.Bytes(), nonce, value, ad.Bytes())
+
+	// Check length
+	if c.encodedLen(len(msg)) > c.maxLen() || len(msg) > c.maxDecodedLen() {
+		return nil, ErrMACTooLong
+	}
+
+	// Encode to base64
+	return c.appendEncode(nil, msg), nil
+}
+
+// DecryptAuthMessage decrypts and verifies a message returned by
+// EncryptAuthMessage, and returns its value.
+func DecryptAuthMessage(c *MACConfig, enc []byte) ([]byte, error) {
+	value, err := decryptAuthMessage(c, enc)
+	return value, c.notify(enc, err)
+}
+
+// decryptAuthMessage is DecryptAuthMessage, without the hooks.
+func decryptAuthMessage(c *MACConfig, enc []byte) ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Signer != nil {
+		return nil, errSignerUnsupported
+	}
+
+	// Check length
+	if len(enc) > c.maxLen() {
+		return nil, ErrMACTooLong
+	}
+
+	// Decode from base64
+	dec, err := c.decode(enc)
+	if err != nil {
+		return nil, ErrMACInvalid
+	}
+	if len(dec) > c.maxDecodedLen() {
+		return nil, ErrMACTooLong
+	}
+
+	// Read the header and resolve the key
+	hdr, hdrLen, err := readMACHeader(dec)
+	if err != nil {
+		return nil, err
+	}
+	key, err := c.encKey(hdr.keyID)
+	if err != nil {
+		return nil, ErrMACInvalid
+	}
+	alg := AESGCM
+	if hdr.flags&flagXChaCha20 != 0 {
+		alg = XChaCha20Poly1305
+	}
+	aead, err := newAEAD(key, alg)
+	if err != nil {
+		return nil, err
+	}
+	if len(dec) < hdrLen+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrMACTruncated
+	}
+	nonce := dec[hdrLen : hdrLen+aead.NonceSize()]
+	ciphertext := dec[hdrLen+aead.NonceSize():]
+
+	// Decrypt and verify the message
+	opts := messageOptions{domain: macDomainEncrypted}
+	ad := new(bytes.Buffer)
+	opts.writePrefix(ad, c)
+	ad.Write(dec[:hdrLen])
+	value, err := aead.Open(nil, nonce, ciphertext, ad.Bytes())
+	if err != nil {
+		return nil, ErrMACInvalid
+	}
+
+	// Verify the purpose and time ranges
+	if hdr.purpose != c.Purpose {
+		return nil, ErrMACWrongPurpose
+	}
+	if err = c.checkTime(hdr); err != nil {
+		return nil, err
+	}
+	if hdr.ext&extFlagPadded != 0 {
+		if value, err = unpadValue(value); err != nil {
+			return nil, err
+		}
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// newAEAD returns the cipher of the given algorithm, with the encryption key
+// derived from the given key.
+func newAEAD(key []byte, alg AEADAlgorithm) (cipher.AEAD, error) {
+	info := "aes-256-gcm"
+	if alg == XChaCha20Poly1305 {
+		info = "xchacha20-poly1305"
+	}
+	encKey, err := deriveKey(key, info)
+	if err != nil {
+		return nil, err
+	}
+	if alg == XChaCha20Poly1305 {
+		return chacha20poly1305.NewX(encKey)
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey derives a key of aeadKeyLen bytes from the given key with
+// HKDF-SHA256, for the given usage.
+func deriveKey(key []byte, info string) ([]byte, error) {
+	derived := make([]byte, aeadKeyLen)
+	r := hkdf.New(sha256.New, key, nil, []byte(info))
+	if _, err := io.ReadFull(r, derived); err != nil {
+		return nil, err
+	}
+	return derived, nil
+}
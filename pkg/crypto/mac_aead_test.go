@@ -0,0 +1,190 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptAuthMessage(t *testing.T) {
+	value := []byte("me@example.org")
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "reset",
+	}
+
+	encrypted, err := EncryptAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecryptAuthMessage(o, encrypted)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	// The plaintext can't be read from the message
+	dec := mustBase64Decode(encrypted)
+	assert.False(t, bytes.Contains(dec, value))
+	encrypted2, err := EncryptAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, encrypted, encrypted2)
+
+	// Tampered messages are rejected
+	for _, i := range []int{1, 5, 12, len(dec) - 1} {
+		dec[i] ^= 1
+		_, err = DecryptAuthMessage(o, Base64Encode(dec))
+		assert.Equal(t, ErrMACInvalid, err)
+		dec[i] ^= 1
+	}
+
+	// The name and the key are bound to the message
+	_, err = DecryptAuthMessage(&MACConfig{Key: o.Key, Name: "other"}, encrypted)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecryptAuthMessage(&MACConfig{Key: []byte("9876543210987654"), Name: "reset"}, encrypted)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// Encrypted messages are not the same as the authenticated ones
+	_, err = DecodeAuthMessage(o, encrypted)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	v, err = DecryptAuthMessage(o, mustEncrypt(o, nil))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []byte{}, v)
+}
+
+func TestEncryptAuthMessageXChaCha20(t *testing.T) {
+	value := []byte("me@example.org")
+	gcm := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "reset",
+	}
+	xchacha := &MACConfig{
+		Key:  gcm.Key,
+		Name: "reset",
+		AEAD: XChaCha20Poly1305,
+	}
+
+	for _, o := range []*MACConfig{gcm, xchacha} {
+		encrypted, err := EncryptAuthMessage(o, value)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		// The AEAD is read from the message
+		for _, other := range []*MACConfig{gcm, xchacha} {
+			v, err := DecryptAuthMessage(other, encrypted)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, value, v)
+		}
+
+		// Tampered messages are rejected, including the AEAD flag
+		dec := mustBase64Decode(encrypted)
+		assert.False(t, bytes.Contains(dec, value))
+		dec[1] ^= flagXChaCha20
+		_, err = DecryptAuthMessage(o, Base64Encode(dec))
+		assert.Equal(t, ErrMACInvalid, err)
+		dec[1] ^= flagXChaCha20
+		for _, i := range []int{12, 20, len(dec) - 1} {
+			dec[i] ^= 1
+			_, err = DecryptAuthMessage(o, Base64Encode(dec))
+			assert.Equal(t, ErrMACInvalid, err)
+			dec[i] ^= 1
+		}
+	}
+
+	// The nonce of XChaCha20-Poly1305 is longer
+	encGCM := mustEncrypt(gcm, value)
+	encXChaCha := mustEncrypt(xchacha, value)
+	assert.Len(t, mustBase64Decode(encGCM), 11+12+len(value)+16)
+	assert.Len(t, mustBase64Decode(encXChaCha), 11+24+len(value)+16)
+
+	_, err := EncryptAuthMessage(&MACConfig{Key: gcm.Key, AEAD: AEADAlgorithm(2)}, value)
+	assert.Error(t, err)
+}
+
+func TestEncryptAuthMessageExpiry(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 60,
+		Clock:  func() int64 { return now },
+	}
+	encrypted := mustEncrypt(o, []byte("myvalue"))
+	now = 1061
+	_, err := DecryptAuthMessage(o, encrypted)
+	assert.Equal(t, ErrMACExpired, err)
+
+	o.MaxLen = 32
+	_, err = EncryptAuthMessage(o, []byte("myvalue"))
+	assert.Equal(t, ErrMACTooLong, err)
+}
+
+func TestEncryptAuthMessageEncKeyFunc(t *testing.T) {
+	value := []byte("me@example.org")
+	oldKey := []byte("0123456789012345")
+	newKey := []byte("5432109876543210")
+	resolvable := true
+	encKeys := func(keyID []byte) ([]byte, error) {
+		switch string(keyID) {
+		case "enc-1":
+			if !resolvable {
+				return nil, errors.New("forgotten key")
+			}
+			return oldKey, nil
+		case "enc-2":
+			return newKey, nil
+		}
+		return nil, errors.New("unknown key")
+	}
+
+	before := &MACConfig{Key: oldKey, KeyID: []byte("enc-1")}
+	encrypted := mustEncrypt(before, value)
+
+	// The encryption key has been rotated, and the retired key can still be
+	// resolved, without the KeyFunc of the MAC keys
+	after := &MACConfig{
+		Key:        newKey,
+		KeyID:      []byte("enc-2"),
+		KeyFunc:    func(keyID []byte) ([]byte, error) { return nil, errors.New("no mac key") },
+		EncKeyFunc: encKeys,
+	}
+	v, err := DecryptAuthMessage(after, encrypted)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+	v, err = DecryptAuthMessage(after, mustEncrypt(after, value))
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+
+	// Without EncKeyFunc, the key of the config is the fallback
+	_, err = DecryptAuthMessage(&MACConfig{Key: newKey}, encrypted)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecryptAuthMessage(&MACConfig{Key: oldKey}, encrypted)
+	assert.NoError(t, err)
+
+	// Once the key can't be resolved, the messages are rejected
+	resolvable = false
+	_, err = DecryptAuthMessage(after, encrypted)
+	assert.Equal(t, ErrMACInvalid, err)
+	after.EncKeyFunc = func(keyID []byte) ([]byte, error) { return []byte("short"), nil }
+	_, err = DecryptAuthMessage(after, encrypted)
+	assert.Equal(t, ErrMACInvalid, err)
+}
+
+func mustEncrypt(c *MACConfig, value []byte) []byte {
+	encrypted, err := EncryptAuthMessage(c, value)
+	if err != nil {
+		panic(err)
+	}
+	return encrypted
+}
@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"runtime"
+	"sync"
+)
+
+// BatchResult is the result of the verification of one of the messages given
+// to DecodeBatch.
+type BatchResult struct {
+	Value    []byte
+	IssuedAt int64
+	Err      error
+}
+
+// DecodeBatch verifies a slice of messages in parallel, like
+// DecodeAuthMessageWithTime would do for each of them, with one worker by CPU.
+// The results are in the same order as the messages. The returned error is
+// only for a bad config: the errors of the messages are in their results.
+func DecodeBatch(c *MACConfig, tokens [][]byte) ([]BatchResult, error) {
+	return DecodeBatchWithConcurrency(c, tokens, runtime.GOMAXPROCS(0))
+}
+
+// DecodeBatchWithConcurrency is the same as DecodeBatch, but with at most
+// the given number of workers. A concurrency lower than 1 is treated as 1.
+func DecodeBatchWithConcurrency(c *MACConfig, tokens [][]byte, concurrency int) ([]BatchResult, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	results := make([]BatchResult, len(tokens))
+	runBatch(len(tokens), concurrency, func(i int) {
+		r := &results[i]
+		r.Value, r.IssuedAt, r.Err = DecodeAuthMessageWithTime(c, tokens[i])
+	})
+	return results, nil
+}
+
+// ResignBatch migrates a slice of messages from the old config to the new
+// one in parallel, like MigrateToken would do for each of them, with one
+// worker by CPU. It is meant for the stored messages that must be moved to a
+// new key after a rotation: they keep their issued time and their expiry.
+//
+// The new messages and the errors are in the same order as the messages: for
+// a message that can't be verified or migrated, the new message is nil and
+// the error is set. If a config is not valid, its error is given for all the
+// messages.
+func ResignBatch(old, new *MACConfig, tokens [][]byte) ([][]byte, []error) {
+	resigned := make([][]byte, len(tokens))
+	errs := make([]error, len(tokens))
+	err := old.Validate()
+	if err == nil {
+		err = new.Validate()
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return resigned, errs
+	}
+	runBatch(len(tokens), runtime.GOMAXPROCS(0), func(i int) {
+		resigned[i], errs[i] = MigrateToken(old, new, tokens[i])
+	})
+	return resigned, errs
+}
+
+// runBatch calls fn for the indexes from 0 to n-1, with at most concurrency
+// workers, and waits for them to finish.
+func runBatch(n, concurrency int, fn func(i int)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > n {
+		concurrency = n
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
@@ -0,0 +1,130 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeBatch(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 60,
+		Clock:  func() int64 { return now },
+	}
+
+	var tokens [][]byte
+	var expected []BatchResult
+	for i := 0; i < 100; i++ {
+		value := []byte{byte(i)}
+		switch i % 3 {
+		case 0: // valid
+			now = 1000
+			encoded, err := EncodeAuthMessage(o, value)
+			if !assert.NoError(t, err) {
+				return
+			}
+			tokens = append(tokens, encoded)
+			expected = append(expected, BatchResult{Value: value, IssuedAt: 1000})
+		case 1: // expired
+			now = 900
+			encoded, err := EncodeAuthMessage(o, value)
+			if !assert.NoError(t, err) {
+				return
+			}
+			tokens = append(tokens, encoded)
+			expected = append(expected, BatchResult{Err: ErrMACExpired})
+		case 2: // tampered
+			now = 1000
+			encoded, err := EncodeAuthMessage(o, value)
+			if !assert.NoError(t, err) {
+				return
+			}
+			dec := mustBase64Decode(encoded)
+			dec[len(dec)-1] ^= 1
+			tokens = append(tokens, Base64Encode(dec))
+			expected = append(expected, BatchResult{Err: ErrMACInvalid})
+		}
+	}
+	now = 1000
+
+	for _, concurrency := range []int{0, 1, 4, 1000} {
+		results, err := DecodeBatchWithConcurrency(o, tokens, concurrency)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, expected, results)
+	}
+	results, err := DecodeBatch(o, tokens)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, expected, results)
+
+	results, err = DecodeBatch(o, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	_, err = DecodeBatch(&MACConfig{}, tokens)
+	assert.Equal(t, ErrMissingKey, err)
+}
+
+func TestResignBatch(t *testing.T) {
+	var now int64 = 1000
+	old := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		KeyID:  []byte("old"),
+		MaxAge: 600,
+		Clock:  func() int64 { return now },
+	}
+	new := &MACConfig{
+		Key:    []byte("5432109876543210"),
+		KeyID:  []byte("new"),
+		MaxAge: 600,
+		Clock:  old.Clock,
+	}
+
+	var tokens [][]byte
+	for i := 0; i < 100; i++ {
+		now = 1000 + int64(i)
+		encoded, err := EncodeAuthMessage(old, []byte{byte(i)})
+		if !assert.NoError(t, err) {
+			return
+		}
+		if i%3 == 2 { // tampered
+			dec := mustBase64Decode(encoded)
+			dec[len(dec)-1] ^= 1
+			encoded = Base64Encode(dec)
+		}
+		tokens = append(tokens, encoded)
+	}
+	now = 1200
+
+	resigned, errs := ResignBatch(old, new, tokens)
+	if !assert.Len(t, resigned, len(tokens)) || !assert.Len(t, errs, len(tokens)) {
+		return
+	}
+	for i := range tokens {
+		if i%3 == 2 {
+			assert.Nil(t, resigned[i], "token %d", i)
+			assert.Equal(t, ErrMACInvalid, errs[i], "token %d", i)
+			continue
+		}
+		assert.NoError(t, errs[i], "token %d", i)
+		value, issuedAt, err := DecodeAuthMessageWithTime(new, resigned[i])
+		if assert.NoError(t, err, "token %d", i) {
+			assert.Equal(t, []byte{byte(i)}, value)
+			assert.Equal(t, 1000+int64(i), issuedAt)
+		}
+		_, err = DecodeAuthMessage(old, resigned[i])
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+
+	resigned, errs = ResignBatch(old, new, nil)
+	assert.Empty(t, resigned)
+	assert.Empty(t, errs)
+
+	_, errs = ResignBatch(old, &MACConfig{}, tokens[:2])
+	assert.Equal(t, []error{ErrMissingKey, ErrMissingKey}, errs)
+}
@@ -0,0 +1,274 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"hash"
+	"sync"
+)
+
+// bufferPool keeps the buffers used to build the messages before encoding
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// headerPool keeps the headers read by VerifyAuthMessageInto, that are not
+// returned to the caller.
+var headerPool = sync.Pool{
+	New: func() interface{} { return new(macHeader) },
+}
+
+func getHeader() *macHeader {
+	return headerPool.Get().(*macHeader)
+}
+
+func putHeader(h *macHeader) {
+	*h = macHeader{}
+	headerPool.Put(h)
+}
+
+// macCache keeps the HMAC instances keyed with the key of a config, so that
+// they can be reused between messages instead of being allocated and keyed
+// for each of them. The fields of the config used to build the HMAC key are
+// copied, to detect when the cache is stale.
+//
+// The instances for the other keys, returned by the KeyFunc of the config,
+// are cached too, for the first maxKeyPools keys: a KeyFunc usually returns
+// a few keys being rotated, and skipping the keying of the HMAC, and the
+// derivation of the subkey with DeriveSubkey, matters for each of them.
+type macCache struct {
+	hash   crypto.Hash
+	alg    MACAlgorithm
+	size   int
+	key    []byte
+	name   []byte
+	derive bool
+	macKey []byte
+	pool   sync.Pool
+
+	// poly1305 is only set for the Poly1305 algorithm
+	poly1305 cipher.AEAD
+
+	// fingerprint is the KeyFingerprint of the key, computed on first use
+	fingerprintOnce sync.Once
+	fingerprint     []byte
+
+	// alts are the configs for the AltNames of the config, only used to
+	// compute the MACs, and built on first use
+	altNames []string
+	altsOnce sync.Once
+	alts     []*MACConfig
+
+	// others are the pools for the other keys
+	mu     sync.RWMutex
+	others []*keyPool
+}
+
+// maxKeyPools is the maximal number of other keys whose HMAC instances are
+// cached by a config.
+const maxKeyPools = 8
+
+// keyPool keeps the HMAC instances for a key returned by KeyFunc.
+type keyPool struct {
+	key    []byte
+	macKey []byte
+	pool   sync.Pool
+}
+
+func newMACCache(c *MACConfig) *macCache {
+	mc := &macCache{
+		hash:   c.hash(),
+		alg:    c.Algorithm,
+		size:   c.macLen(),
+		key:    append([]byte(nil), c.Key...),
+		name:   append([]byte(nil), c.name()...),
+		derive: c.DeriveSubkey,
+		macKey: append([]byte(nil), c.macKey(c.Key)...),
+	}
+	if mc.alg == Poly1305 {
+		mc.poly1305 = newPoly1305(mc.macKey)
+	}
+	mc.altNames = append([]string(nil), c.AltNames...)
+	mc.pool.New = func() interface{} {
+		return newMACHash(mc.alg, mc.hash, mc.macKey, mc.name, mc.size)
+	}
+	return mc
+}
+
+// keyFingerprint returns the KeyFingerprint of the key of the cache. It is
+// only computed for the configs that need it, as it costs an HMAC.
+func (mc *macCache) keyFingerprint() []byte {
+	mc.fingerprintOnce.Do(func() {
+		if mc.key != nil {
+			mc.fingerprint = KeyFingerprint(mc.key)
+		}
+	})
+	return mc.fingerprint
+}
+
+// altConfigs returns the configs for the AltNames of c, the config of the
+// cache.
+func (mc *macCache) altConfigs(c *MACConfig) []*MACConfig {
+	mc.altsOnce.Do(func() {
+		for _, name := range mc.altNames {
+			alt := c.WithName(name)
+			alt.AltNames = nil
+			mc.alts = append(mc.alts, alt)
+		}
+	})
+	return mc.alts
+}
+
+// zeroize overwrites the copies of the key kept by the cache.
+func (mc *macCache) zeroize() {
+	zeroBytes(mc.key)
+	zeroBytes(mc.macKey)
+	mc.altsOnce.Do(func() {})
+	for _, alt := range mc.alts {
+		alt.Zeroize()
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, kp := range mc.others {
+		zeroBytes(kp.key)
+		zeroBytes(kp.macKey)
+	}
+	mc.others = nil
+}
+
+// valid returns true if the cache can be used for the given config.
+func (mc *macCache) valid(c *MACConfig) bool {
+	return mc.hash == c.hash() && mc.alg == c.Algorithm &&
+		mc.size == c.macLen() && bytes.Equal(mc.name, c.name()) &&
+		mc.derive == c.DeriveSubkey && bytes.Equal(mc.key, c.Key) &&
+		equalStrings(mc.altNames, c.AltNames)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns an HMAC instance keyed with the key of the cache, in its
+// initial state.
+func (mc *macCache) get() hash.Hash {
+	mac := mc.pool.Get().(hash.Hash)
+	mac.Reset()
+	return mac
+}
+
+// put gives back an HMAC instance to the cache.
+func (mc *macCache) put(mac hash.Hash) {
+	mc.pool.Put(mac)
+}
+
+// lookup returns the pool of the HMAC instances for another key, or nil if
+// the key has no pool.
+func (mc *macCache) lookup(key []byte) *sync.Pool {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	for _, kp := range mc.others {
+		if bytes.Equal(kp.key, key) {
+			return &kp.pool
+		}
+	}
+	return nil
+}
+
+// keyPool returns the pool of the HMAC instances for another key, creating
+// it if there is still room for it, or nil.
+func (mc *macCache) keyPool(c *MACConfig, key []byte) *sync.Pool {
+	if pool := mc.lookup(key); pool != nil {
+		return pool
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	for _, kp := range mc.others {
+		if bytes.Equal(kp.key, key) {
+			return &kp.pool
+		}
+	}
+	if len(mc.others) >= maxKeyPools {
+		return nil
+	}
+	kp := &keyPool{
+		key:    append([]byte(nil), key...),
+		macKey: append([]byte(nil), c.macKey(key)...),
+	}
+	kp.pool.New = func() interface{} {
+		return newMACHash(mc.alg, mc.hash, kp.macKey, mc.name, mc.size)
+	}
+	mc.others = append(mc.others, kp)
+	return &kp.pool
+}
+
+// macCache returns the cache of the config, creating it on first use, or
+// if the key of the config has changed since then.
+func (c *MACConfig) macCache() *macCache {
+	mc := c.cache.Load()
+	if mc != nil && mc.valid(c) {
+		return mc
+	}
+	fresh := newMACCache(c)
+	if c.cache.CompareAndSwap(mc, fresh) {
+		return fresh
+	}
+	return c.cache.Load()
+}
+
+// newMAC returns an HMAC instance for the given key, in its initial state. The
+// instance should be given back with putMAC after use.
+func (c *MACConfig) newMAC(key []byte) hash.Hash {
+	mc := c.macCache()
+	if bytes.Equal(key, c.Key) {
+		return mc.get()
+	}
+	pool := mc.keyPool(c, key)
+	if pool == nil {
+		return c.newHash(c.macKey(key))
+	}
+	mac := pool.Get().(hash.Hash)
+	mac.Reset()
+	return mac
+}
+
+// putMAC gives back an HMAC instance returned by newMAC.
+func (c *MACConfig) putMAC(key []byte, mac hash.Hash) {
+	mc := c.macCache()
+	if bytes.Equal(key, c.Key) {
+		mc.put(mac)
+	} else if pool := mc.lookup(key); pool != nil {
+		pool.Put(mac)
+	}
+}
+
+// sum returns the HMAC of the input with the given key.
+func (c *MACConfig) sum(key, input []byte) []byte {
+	return c.appendSum(nil, key, input)
+}
+
+// appendSum appends the HMAC of the input with the given key to dst.
+func (c *MACConfig) appendSum(dst, key, input []byte) []byte {
+	mac := c.newMAC(key)
+	mac.Write(input)
+	sum := mac.Sum(dst)
+	c.putMAC(key, mac)
+	return sum
+}
@@ -0,0 +1,256 @@
+package crypto
+
+import (
+	"crypto"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMACCacheConcurrent(t *testing.T) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				value := []byte{byte(i), byte(j)}
+				encoded, err := EncodeAuthMessage(o, value)
+				if !assert.NoError(t, err) {
+					return
+				}
+				v, err := DecodeAuthMessage(o, encoded)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, value, v)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMACCacheKeyChange(t *testing.T) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	input := []byte("input")
+	assert.Equal(t, createMAC(crypto.SHA256, o.Key, input), o.sum(o.Key, input))
+
+	o.Key = []byte("9876543210987654")
+	assert.Equal(t, createMAC(crypto.SHA256, o.Key, input), o.sum(o.Key, input))
+
+	o.Hash = crypto.SHA512
+	assert.Equal(t, createMAC(crypto.SHA512, o.Key, input), o.sum(o.Key, input))
+}
+
+func TestMACCacheKeyFunc(t *testing.T) {
+	keys := map[string][]byte{}
+	for i := 0; i < maxKeyPools+4; i++ {
+		keys[string(rune('a'+i))] = GenerateRandomBytes(32)
+	}
+	o := &MACConfig{
+		Key:          keys["a"],
+		KeyID:        []byte("a"),
+		DeriveSubkey: true,
+		KeyFunc: func(keyID []byte) ([]byte, error) {
+			return keys[string(keyID)], nil
+		},
+	}
+
+	// The messages of all the keys are verified concurrently, including the
+	// keys past the cached ones
+	var tokens [][]byte
+	for id, key := range keys {
+		c := o.Clone()
+		c.Key, c.KeyID = key, []byte(id)
+		enc, err := EncodeAuthMessage(c, []byte(id))
+		if !assert.NoError(t, err) {
+			return
+		}
+		tokens = append(tokens, enc)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				for _, enc := range tokens {
+					_, err := DecodeAuthMessage(o, enc)
+					assert.NoError(t, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	mc := o.macCache()
+	assert.Len(t, mc.others, maxKeyPools)
+
+	// The cached instances are keyed with their own key
+	input := []byte("input")
+	for _, key := range keys {
+		mac := o.newHash(o.macKey(key))
+		mac.Write(input)
+		assert.Equal(t, mac.Sum(nil), o.sum(key, input))
+	}
+
+	// And they are dropped with the cache
+	o.Zeroize()
+	assert.Empty(t, mc.others)
+}
+
+func BenchmarkCreateMAC(b *testing.B) {
+	key := []byte("0123456789012345")
+	input := GenerateRandomBytes(64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		createMAC(crypto.SHA256, key, input)
+	}
+}
+
+func BenchmarkCachedMAC(b *testing.B) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	input := GenerateRandomBytes(64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		o.sum(o.Key, input)
+	}
+}
+
+// BenchmarkEncodeAuthMessageFreshConfig is BenchmarkEncodeAuthMessage with a
+// new config for each message, that can't use the cache of the previous ones.
+func BenchmarkEncodeAuthMessageFreshConfig(b *testing.B) {
+	key := []byte("0123456789012345")
+	value := GenerateRandomBytes(32)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EncodeAuthMessage(&MACConfig{Key: key}, value)
+	}
+}
+
+func BenchmarkEncodeAuthMessage(b *testing.B) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	value := GenerateRandomBytes(32)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EncodeAuthMessage(o, value)
+	}
+}
+
+func BenchmarkDecodeAuthMessage(b *testing.B) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	encoded, _ := EncodeAuthMessage(o, GenerateRandomBytes(32))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			DecodeAuthMessage(o, encoded)
+		}
+	})
+}
+
+// BenchmarkDecodeAuthMessageFreshConfig is BenchmarkDecodeAuthMessage with a
+// new config for each message, that can't use the cache of the previous ones.
+func BenchmarkDecodeAuthMessageFreshConfig(b *testing.B) {
+	key := []byte("0123456789012345")
+	encoded, _ := EncodeAuthMessage(&MACConfig{Key: key}, GenerateRandomBytes(32))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DecodeAuthMessage(&MACConfig{Key: key}, encoded)
+	}
+}
+
+func BenchmarkDecodeAuthMessageKeyFunc(b *testing.B) {
+	old := []byte("0123456789012345")
+	o := &MACConfig{
+		Key:          []byte("9876543210987654"),
+		KeyID:        []byte("new"),
+		DeriveSubkey: true,
+		KeyFunc: func(keyID []byte) ([]byte, error) {
+			return old, nil
+		},
+	}
+	encoded, _ := EncodeAuthMessage(&MACConfig{Key: old, KeyID: []byte("old"), DeriveSubkey: true}, GenerateRandomBytes(64))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DecodeAuthMessage(o, encoded)
+	}
+}
+
+func BenchmarkVerifyAuthMessage(b *testing.B) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	encoded, _ := EncodeAuthMessage(o, GenerateRandomBytes(32))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			VerifyAuthMessage(o, encoded)
+		}
+	})
+}
+
+func BenchmarkVerifyAuthMessageInto(b *testing.B) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	encoded, _ := EncodeAuthMessage(o, GenerateRandomBytes(32))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		scratch := make([]byte, 256)
+		for pb.Next() {
+			VerifyAuthMessageInto(o, scratch, encoded)
+		}
+	})
+}
+
+func BenchmarkEncodeAuthMessageTo(b *testing.B) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	value := GenerateRandomBytes(32)
+	buf := make([]byte, 0, 256)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EncodeAuthMessageTo(buf[:0], o, value)
+	}
+}
+
+func TestMACZeroize(t *testing.T) {
+	key := []byte("0123456789012345")
+	o := &MACConfig{
+		Key:          key,
+		DeriveSubkey: true,
+	}
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	mc := o.cache.Load()
+	if !assert.NotNil(t, mc) {
+		return
+	}
+
+	o.Zeroize()
+	assert.Nil(t, o.Key)
+	assert.Equal(t, make([]byte, 16), key)
+	assert.Equal(t, make([]byte, 16), mc.key)
+	assert.Equal(t, make([]byte, 32), mc.macKey)
+	assert.Nil(t, o.cache.Load())
+
+	// The config is unusable
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMissingKey, err)
+}
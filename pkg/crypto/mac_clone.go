@@ -0,0 +1,93 @@
+package crypto
+
+// Clone returns a copy of the config. The byte slices are copied, so the
+// clone can be changed, or its key zeroed, without affecting the original. The
+// cache of the HMAC instances is not shared: a config can be cloned even after
+// its first use.
+func (c *MACConfig) Clone() *MACConfig {
+	return &MACConfig{
+		Key:           cloneBytes(c.Key),
+		Name:          c.Name,
+		NameBytes:     cloneBytes(c.NameBytes),
+		MaxAge:        c.MaxAge,
+		MaxLen:        c.MaxLen,
+		Hash:          c.Hash,
+		KeyID:         cloneBytes(c.KeyID),
+		KeyFunc:       c.KeyFunc,
+		MaxSkew:       c.MaxSkew,
+		Clock:         c.Clock,
+		TagLen:        c.TagLen,
+		Encoding:      c.Encoding,
+		DeriveSubkey:  c.DeriveSubkey,
+		Signer:        c.Signer,
+		TimeUnit:      c.TimeUnit,
+		NoTimestamp:   c.NoTimestamp,
+		Compress:      c.Compress,
+		Purpose:       c.Purpose,
+		AEAD:          c.AEAD,
+		Algorithm:     c.Algorithm,
+		OnExpired:     c.OnExpired,
+		OnInvalid:     c.OnInvalid,
+		OnTooLong:     c.OnTooLong,
+		AltNames:      append([]string(nil), c.AltNames...),
+		Unpredictable: c.Unpredictable,
+		CompactTime:   c.CompactTime,
+		MaxDecodedLen: c.MaxDecodedLen,
+		Prefix:        c.Prefix,
+		EncKeyFunc:    c.EncKeyFunc,
+		CanonicalJSON: c.CanonicalJSON,
+		ExpiryGrace:   c.ExpiryGrace,
+		Rand:          c.Rand,
+		PadTo:         c.PadTo,
+		EpochSeconds:  c.EpochSeconds,
+
+		MaxAgeByPurpose: cloneMaxAges(c.MaxAgeByPurpose),
+	}
+}
+
+// WithName returns a clone of the config with the given name. It can be
+// chained with the other With methods to derive a config from a base one:
+//
+//  csrf := base.WithName("csrf").WithMaxAge(300)
+//
+func (c *MACConfig) WithName(name string) *MACConfig {
+	clone := c.Clone()
+	clone.Name = name
+	clone.NameBytes = nil
+	return clone
+}
+
+// WithMaxAge returns a clone of the config with the given maximum age.
+func (c *MACConfig) WithMaxAge(maxAge int64) *MACConfig {
+	clone := c.Clone()
+	clone.MaxAge = maxAge
+	return clone
+}
+
+// WithPurpose returns a clone of the config with the given purpose. Its
+// maximum age is taken from MaxAgeByPurpose, if the purpose has an entry.
+func (c *MACConfig) WithPurpose(purpose uint8) *MACConfig {
+	clone := c.Clone()
+	clone.Purpose = purpose
+	return clone
+}
+
+// cloneMaxAges returns a copy of m, or nil if m is nil.
+func cloneMaxAges(m map[uint8]int64) map[uint8]int64 {
+	if m == nil {
+		return nil
+	}
+	clone := make(map[uint8]int64, len(m))
+	for purpose, maxAge := range m {
+		clone[purpose] = maxAge
+	}
+	return clone
+}
+
+// cloneBytes returns a copy of b, or nil if b is nil.
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
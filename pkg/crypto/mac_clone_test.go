@@ -0,0 +1,101 @@
+package crypto
+
+import (
+	"crypto"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMACClone(t *testing.T) {
+	o := &MACConfig{
+		Key:           []byte("0123456789012345"),
+		Name:          "clone",
+		NameBytes:     []byte("clone"),
+		MaxAge:        60,
+		MaxLen:        1024,
+		Hash:          crypto.SHA512,
+		KeyID:         []byte("1"),
+		KeyFunc:       func(keyID []byte) ([]byte, error) { return nil, nil },
+		MaxSkew:       5,
+		Clock:         Timestamp,
+		TagLen:        24,
+		Encoding:      Base64URL,
+		DeriveSubkey:  true,
+		Signer:        &remoteSigner{},
+		TimeUnit:      Milliseconds,
+		NoTimestamp:   true,
+		Compress:      true,
+		Purpose:       2,
+		AEAD:          XChaCha20Poly1305,
+		Algorithm:     KMAC256,
+		OnExpired:     func(enc []byte) {},
+		OnInvalid:     func(enc []byte) {},
+		OnTooLong:     func(enc []byte) {},
+		AltNames:      []string{"old"},
+		Unpredictable: true,
+		CompactTime:   true,
+		MaxDecodedLen: 1024,
+		Prefix:        "sk_",
+		EncKeyFunc:    func(keyID []byte) ([]byte, error) { return nil, nil },
+		CanonicalJSON: true,
+		ExpiryGrace:   5,
+		Rand:          strings.NewReader("random"),
+		PadTo:         64,
+		EpochSeconds:  86400,
+
+		MaxAgeByPurpose: map[uint8]int64{1: 300},
+	}
+
+	// All the exported fields are copied
+	clone := o.Clone()
+	orig, copied := reflect.ValueOf(o).Elem(), reflect.ValueOf(clone).Elem()
+	for i := 0; i < orig.NumField(); i++ {
+		field := orig.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if !assert.False(t, orig.Field(i).IsZero(), "%s is not set in the test", field.Name) {
+			continue
+		}
+		if field.Type.Kind() == reflect.Func {
+			assert.Equal(t, orig.Field(i).Pointer(), copied.Field(i).Pointer(), field.Name)
+		} else {
+			assert.Equal(t, orig.Field(i).Interface(), copied.Field(i).Interface(), field.Name)
+		}
+	}
+
+	// The key is not shared
+	clone.Key[0] = 'x'
+	assert.Equal(t, []byte("0123456789012345"), o.Key)
+	clone.KeyID[0] = 'x'
+	assert.Equal(t, []byte("1"), o.KeyID)
+}
+
+func TestMACWith(t *testing.T) {
+	value := []byte("myvalue")
+	base := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		Name:   "base",
+		MaxAge: 3600,
+	}
+	csrf := base.WithName("csrf").WithMaxAge(300)
+	assert.Equal(t, "csrf", csrf.Name)
+	assert.EqualValues(t, 300, csrf.MaxAge)
+	assert.Equal(t, "base", base.Name)
+	assert.EqualValues(t, 3600, base.MaxAge)
+
+	csrf.Key[0] = 'x'
+	assert.Equal(t, []byte("0123456789012345"), base.Key)
+
+	encoded, err := EncodeAuthMessage(base, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(base.WithMaxAge(60), encoded)
+	assert.NoError(t, err)
+	_, err = DecodeAuthMessage(base.WithName("other"), encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+}
@@ -0,0 +1,70 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// ValueCodec serializes the values of the messages for EncodeValue and
+// DecodeValue.
+type ValueCodec interface {
+	// Marshal returns the serialization of v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal deserializes data into v, that must be a pointer.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is a ValueCodec serializing the values in JSON.
+var JSONCodec ValueCodec = jsonCodec{}
+
+// GobCodec is a ValueCodec serializing the values with encoding/gob. The
+// serialization includes the description of the types, so it is more
+// verbose than JSON for the small values.
+var GobCodec ValueCodec = gobCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// EncodeValue is the same as EncodeAuthMessage, but for a value serialized
+// with the given codec. The errors of the serialization are returned
+// unchanged.
+func EncodeValue(c *MACConfig, codec ValueCodec, v interface{}) ([]byte, error) {
+	value, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeAuthMessage(c, value)
+}
+
+// DecodeValue verifies a message returned by EncodeValue, and deserializes
+// its value into dst with the given codec. The value is only deserialized
+// once the MAC has been verified, so the codec never sees untrusted data.
+func DecodeValue(c *MACConfig, codec ValueCodec, enc []byte, dst interface{}) error {
+	value, err := DecodeAuthMessage(c, enc)
+	if err != nil {
+		return err
+	}
+	return codec.Unmarshal(value, dst)
+}
@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type codecValue struct {
+	UserID string
+	Roles  []string
+	Admin  bool
+	Quota  int64
+}
+
+func TestValueCodecs(t *testing.T) {
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "codec",
+	}
+	value := codecValue{
+		UserID: "user-42",
+		Roles:  []string{"reader", "writer"},
+		Admin:  true,
+		Quota:  1 << 40,
+	}
+
+	for _, codec := range []ValueCodec{JSONCodec, GobCodec} {
+		encoded, err := EncodeValue(o, codec, value)
+		if !assert.NoError(t, err) {
+			return
+		}
+		var decoded codecValue
+		if assert.NoError(t, DecodeValue(o, codec, encoded, &decoded)) {
+			assert.Equal(t, value, decoded)
+		}
+
+		// The MAC is verified before the value is deserialized
+		dec := mustBase64Decode(encoded)
+		dec[len(dec)-1] ^= 1
+		assert.Equal(t, ErrMACInvalid, DecodeValue(o, codec, Base64Encode(dec), &decoded))
+
+		// The errors of the codec are returned
+		var wrong []int
+		assert.Error(t, DecodeValue(o, codec, encoded, &wrong))
+	}
+
+	// The JSON codec gives the same messages as EncodeJSON
+	encoded, err := EncodeValue(o, JSONCodec, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	decoded, err := DecodeJSON[codecValue](o, encoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, decoded)
+	}
+
+	_, err = EncodeValue(o, JSONCodec, make(chan int))
+	assert.Error(t, err)
+	_, err = EncodeValue(o, GobCodec, make(chan int))
+	assert.Error(t, err)
+}
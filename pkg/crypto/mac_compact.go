@@ -0,0 +1,53 @@
+package crypto
+
+// compactTagLen is the size of the tags of the compact messages.
+const compactTagLen = 16
+
+// EncodeCompact is the same as EncodeAuthMessage, but the message is as short
+// as possible, for the tokens that are put in QR codes or short links: it is
+// encoded in base64url without padding, its time is written as a varint like
+// with CompactTime, and its tag is truncated to 16 bytes. A 16-byte tag still
+// gives a security of 128 bits against forgeries.
+//
+// The compact mode is recorded in the version byte and covered by the MAC: a
+// compact message can only be decoded by DecodeCompact, and the other
+// messages can't be decoded by DecodeCompact. The Encoding, TagLen and
+// CompactTime of the config are ignored, and a config with a Signer can't be
+// used, as the size of its tags is not known. With Poly1305, the tag and its
+// nonce keep their size.
+func EncodeCompact(c *MACConfig, value []byte) ([]byte, error) {
+	cc, err := c.compactConfig()
+	if err != nil {
+		return nil, err
+	}
+	return encodeAuthMessage(cc, value, cc.now(), messageOptions{compact: true})
+}
+
+// DecodeCompact verifies a message returned by EncodeCompact, and returns its
+// value.
+func DecodeCompact(c *MACConfig, enc []byte) ([]byte, error) {
+	cc, err := c.compactConfig()
+	if err != nil {
+		return nil, err
+	}
+	value, _, err := decodeAuthMessage(cc, enc, nil, messageOptions{compact: true})
+	return value, err
+}
+
+// compactConfig returns the config used for the compact messages.
+func (c *MACConfig) compactConfig() (*MACConfig, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Signer != nil {
+		return nil, errSignerUnsupported
+	}
+	cc := c.Clone()
+	cc.Encoding = Base64RawURL
+	cc.CompactTime = false
+	cc.TagLen = 0
+	if cc.Algorithm != Poly1305 {
+		cc.TagLen = compactTagLen
+	}
+	return cc, nil
+}
@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeCompact(t *testing.T) {
+	now := int64(1700000000)
+	o := &MACConfig{
+		Key:      []byte("0123456789012345"),
+		Name:     "share",
+		MaxAge:   3600,
+		Encoding: Base64URL,
+		Clock:    func() int64 { return now },
+	}
+	value := []byte("io.cozy.files/42")
+
+	compact, err := EncodeCompact(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeCompact(o, compact)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+	assert.NotContains(t, string(compact), "=")
+
+	// The compact message is shorter: 4 bytes of time and 16 of tag saved
+	def, err := EncodeAuthMessage(&MACConfig{Key: o.Key, Name: o.Name, Clock: o.Clock}, value)
+	if assert.NoError(t, err) {
+		assert.LessOrEqual(t, len(compact), len(def)-25)
+	}
+	dec := mustBase64Decode(compact)
+	assert.Equal(t, macVersion|versionCompact, dec[0])
+	assert.Equal(t, 1+1+1+5+len(value)+compactTagLen, len(dec))
+
+	// The shortened tag is verified
+	for i := range dec {
+		tampered := append([]byte(nil), dec...)
+		tampered[i] ^= 1
+		_, err = DecodeCompact(o, Base64Encode(tampered))
+		assert.Error(t, err, "tampered at %d", i)
+	}
+	_, err = DecodeCompact(o, Base64Encode(dec[:len(dec)-1]))
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The compact messages and the other ones can't be mixed
+	_, err = DecodeAuthMessage(o, compact)
+	assert.Equal(t, ErrMACInvalid, err)
+	short := o.Clone()
+	short.TagLen = compactTagLen
+	short.Encoding = Base64RawURL
+	_, err = DecodeAuthMessage(short, compact)
+	assert.Equal(t, ErrMACInvalid, err)
+	enc, err := EncodeAuthMessage(short, value)
+	if assert.NoError(t, err) {
+		_, err = DecodeCompact(o, enc)
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+	dec[0] = macVersion
+	_, err = DecodeCompact(o, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The time is verified
+	now += 3601
+	_, err = DecodeCompact(o, compact)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// With the other algorithms
+	for _, alg := range []MACAlgorithm{KMAC256, Poly1305} {
+		c := &MACConfig{Key: GenerateRandomBytes(32), Algorithm: alg}
+		compact, err := EncodeCompact(c, value)
+		if assert.NoError(t, err) {
+			v, err := DecodeCompact(c, compact)
+			assert.NoError(t, err)
+			assert.Equal(t, value, v)
+		}
+	}
+	_, err = EncodeCompact(&MACConfig{Signer: &remoteSigner{key: o.Key}}, value)
+	assert.Equal(t, errSignerUnsupported, err)
+}
@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+// maxCompressionRatio limits the size of a decompressed value to this number
+// of times the maximum length of the messages, when MaxDecodedLen is not set,
+// to protect against the compression bombs.
+const maxCompressionRatio = 16
+
+// compressValue returns the value compressed with flate, or nil if the
+// compression does not make it smaller.
+func compressValue(value []byte) []byte {
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.BestCompression)
+	if err != nil {
+		return nil
+	}
+	if _, err = w.Write(value); err != nil {
+		return nil
+	}
+	if err = w.Close(); err != nil {
+		return nil
+	}
+	if buf.Len() >= len(value) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// decompressValue decompresses a value compressed by compressValue. The
+// output is not read further than maxLen bytes, and ErrMACTooLong is then
+// returned.
+func decompressValue(value []byte, maxLen int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(value))
+	defer r.Close()
+	dec, err := io.ReadAll(io.LimitReader(r, int64(maxLen)+1))
+	if err != nil {
+		return nil, ErrMACInvalid
+	}
+	if len(dec) > maxLen {
+		return nil, ErrMACTooLong
+	}
+	return dec, nil
+}
@@ -0,0 +1,89 @@
+package crypto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMACCompress(t *testing.T) {
+	value := []byte(`{"items":[` + strings.Repeat(`{"id":"io.cozy.files","verbs":["GET"]},`, 50) + `{}]}`)
+	plain := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxLen: 8192,
+	}
+	o := &MACConfig{
+		Key:      plain.Key,
+		MaxLen:   plain.MaxLen,
+		Compress: true,
+	}
+
+	encPlain, err := EncodeAuthMessage(plain, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, len(encoded) < len(encPlain)/4)
+
+	// The compressed messages can be decoded with or without Compress
+	v, err := DecodeAuthMessage(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+	v, err = DecodeAuthMessage(plain, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	// A value that can't be compressed is left as is
+	random := GenerateRandomBytes(64)
+	encoded, err = EncodeAuthMessage(o, random)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, byte(0), mustBase64Decode(encoded)[1]&flagCompressed)
+	v, err = DecodeAuthMessage(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, random, v)
+
+	// The value must not be too long once decompressed
+	_, err = EncodeAuthMessage(o, make([]byte, 16*8192+1))
+	assert.Equal(t, ErrMACTooLong, err)
+}
+
+func TestMACCompressionBomb(t *testing.T) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	// The same key, but allowing much larger values
+	large := &MACConfig{
+		Key:      o.Key,
+		MaxLen:   1 << 30,
+		Compress: true,
+	}
+
+	bomb := make([]byte, 2<<20)
+	encoded, err := EncodeAuthMessage(large, bomb)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, len(encoded) < o.maxLen())
+
+	// The MAC is valid, but the value is not decompressed past the limit
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACTooLong, err)
+	v, err := DecodeAuthMessage(large, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, bytes.Equal(bomb, v))
+}
@@ -0,0 +1,56 @@
+package crypto
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// SecureCookie encodes and decodes the values of HTTP cookies, serialized in
+// JSON and authenticated with a MACConfig. The name of the cookie is used as
+// the Name of the MAC, so the value of a cookie can't be used for another one.
+// The API is close to the one of gorilla/securecookie.
+type SecureCookie struct {
+	config  *MACConfig
+	configs sync.Map // cookie name -> *MACConfig
+}
+
+// NewSecureCookie returns a SecureCookie for the given config. Its Name is
+// replaced by the name of the cookies, and its MaxAge is the maximum age of
+// the cookies. The config must not be changed afterwards.
+func NewSecureCookie(c *MACConfig) *SecureCookie {
+	return &SecureCookie{config: c}
+}
+
+// Encode serializes the value in JSON, and returns the authenticated value
+// for the cookie with the given name.
+func (s *SecureCookie) Encode(name string, value interface{}) (string, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	enc, err := EncodeAuthMessage(s.configFor(name), b)
+	if err != nil {
+		return "", err
+	}
+	return string(enc), nil
+}
+
+// Decode verifies the value of the cookie with the given name, and
+// deserializes it in dst. The MAC errors are returned for a value that has
+// been tampered with, has expired, or is for another cookie.
+func (s *SecureCookie) Decode(name, encoded string, dst interface{}) error {
+	b, err := DecodeAuthMessage(s.configFor(name), []byte(encoded))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// configFor returns the config for the cookie with the given name.
+func (s *SecureCookie) configFor(name string) *MACConfig {
+	if c, ok := s.configs.Load(name); ok {
+		return c.(*MACConfig)
+	}
+	c, _ := s.configs.LoadOrStore(name, s.config.WithName(name))
+	return c.(*MACConfig)
+}
@@ -0,0 +1,46 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type cookieSession struct {
+	ID     string `json:"id"`
+	UserID int    `json:"user_id"`
+}
+
+func TestSecureCookie(t *testing.T) {
+	var now int64 = 1000
+	s := NewSecureCookie(&MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 3600,
+		Clock:  func() int64 { return now },
+	})
+	session := cookieSession{ID: "abc", UserID: 42}
+
+	encoded, err := s.Encode("session", session)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var decoded cookieSession
+	if !assert.NoError(t, s.Decode("session", encoded, &decoded)) {
+		return
+	}
+	assert.Equal(t, session, decoded)
+
+	// The value of a cookie can't be used for another one
+	err = s.Decode("remember", encoded, &decoded)
+	assert.Equal(t, ErrMACInvalid, err)
+	err = s.Decode("session", encoded[:len(encoded)-2], &decoded)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The cookies expire after MaxAge
+	now = 1000 + 3601
+	err = s.Decode("session", encoded, &decoded)
+	assert.Equal(t, ErrMACExpired, err)
+
+	_, err = s.Encode("session", make(chan int))
+	assert.Error(t, err)
+}
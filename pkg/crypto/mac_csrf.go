@@ -0,0 +1,47 @@
+package crypto
+
+// defaultCSRFMaxAge is the maximum age, in seconds, of the CSRF tokens when
+// the config has no MaxAge.
+const defaultCSRFMaxAge = 3600
+
+// csrfNonceLen is the size of the random value of a CSRF token.
+const csrfNonceLen = 16
+
+// NewCSRFToken returns a new CSRF token bound to the given session: the
+// session identifier is used as additional data for the MAC, so a token can't
+// be used with another session. The token expires after the MaxAge of the
+// config, or after one hour if it is not set.
+func NewCSRFToken(c *MACConfig, sessionID []byte) (string, error) {
+	nonce, err := c.randomBytes(csrfNonceLen)
+	if err != nil {
+		return "", err
+	}
+	enc, err := EncodeAuthMessageWithAAD(csrfConfig(c), nonce, sessionID)
+	if err != nil {
+		return "", err
+	}
+	return string(enc), nil
+}
+
+// ValidateCSRFToken verifies that the token has been returned by NewCSRFToken
+// for the given session. ErrMACInvalid is returned for a token of another
+// session, and ErrMACExpired for an expired token.
+func ValidateCSRFToken(c *MACConfig, sessionID []byte, token string) error {
+	value, err := DecodeAuthMessageWithAAD(csrfConfig(c), []byte(token), sessionID)
+	if err != nil {
+		return err
+	}
+	if len(value) != csrfNonceLen {
+		return ErrMACInvalid
+	}
+	return nil
+}
+
+// csrfConfig returns the config with the default maximum age of the CSRF
+// tokens if it has none.
+func csrfConfig(c *MACConfig) *MACConfig {
+	if c.MaxAge != 0 || c.NoTimestamp {
+		return c
+	}
+	return c.WithMaxAge(c.TimeUnit.convert(defaultCSRFMaxAge, Seconds, true))
+}
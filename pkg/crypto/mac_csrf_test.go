@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSRFToken(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:   []byte("0123456789012345"),
+		Name:  "csrf",
+		Clock: func() int64 { return now },
+	}
+	alice, bob := []byte("session-alice"), []byte("session-bob")
+
+	token, err := NewCSRFToken(o, alice)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, ValidateCSRFToken(o, alice, token))
+	other, err := NewCSRFToken(o, alice)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, token, other)
+
+	// A token can't be used with another session
+	assert.Equal(t, ErrMACInvalid, ValidateCSRFToken(o, bob, token))
+	assert.Equal(t, ErrMACInvalid, ValidateCSRFToken(o, nil, token))
+	assert.Error(t, ValidateCSRFToken(o, alice, "invalid"))
+
+	// The tokens expire after one hour by default
+	now = 1000 + 3600
+	assert.NoError(t, ValidateCSRFToken(o, alice, token))
+	now++
+	assert.Equal(t, ErrMACExpired, ValidateCSRFToken(o, alice, token))
+
+	// Or after the MaxAge of the config
+	o.MaxAge = 60
+	token, err = NewCSRFToken(o, alice)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now += 61
+	assert.Equal(t, ErrMACExpired, ValidateCSRFToken(o, alice, token))
+
+	// Another authentic message can't be used as a token
+	msg, err := EncodeAuthMessageWithAAD(o, []byte("myvalue"), bob)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ErrMACInvalid, ValidateCSRFToken(o, bob, string(msg)))
+}
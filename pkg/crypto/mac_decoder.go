@@ -0,0 +1,192 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+)
+
+// Encoder writes length-framed messages to a stream, that can be read with a
+// Decoder. Each frame is the length of the encoded message, as a 4 bytes big
+// endian integer, followed by the encoded message.
+type Encoder struct {
+	c *MACConfig
+	w io.Writer
+}
+
+// NewEncoder returns an Encoder writing the messages to w.
+func NewEncoder(c *MACConfig, w io.Writer) *Encoder {
+	return &Encoder{c: c, w: w}
+}
+
+// Encode writes the message for the given value, as EncodeAuthMessage would
+// return it, in a frame.
+func (e *Encoder) Encode(value []byte) error {
+	enc, err := EncodeAuthMessage(e.c, value)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4, 4+len(enc))
+	binary.BigEndian.PutUint32(frame, uint32(len(enc)))
+	_, err = e.w.Write(append(frame, enc...))
+	return err
+}
+
+// Decoder reads and verifies the length-framed messages written by an
+// Encoder.
+type Decoder struct {
+	c *MACConfig
+	r io.Reader
+}
+
+// NewDecoder returns a Decoder reading the messages from r.
+func NewDecoder(c *MACConfig, r io.Reader) *Decoder {
+	return &Decoder{c: c, r: r}
+}
+
+// Decode reads the next message of the stream, verifies it, and returns its
+// value and issued time. io.EOF is returned when there is no more message.
+//
+// A frame longer than MaxLen is rejected with ErrMACTooLong before reading
+// it, and the message is decoded from base64 while it is read, so a malicious
+// stream can't exhaust the memory. The messages are checked like by
+// DecodeAuthMessage: they are accepted with or without padding, the messages
+// too short for a header and a MAC are rejected with ErrMACTruncated, and the
+// hooks of the config are called with the encoded message, or with nil for a
+// frame longer than MaxLen, as it is not read. The stream can't be read after
+// an error.
+func (d *Decoder) Decode() ([]byte, int64, error) {
+	if err := d.c.Validate(); err != nil {
+		return nil, 0, err
+	}
+
+	var frame [4]byte
+	if _, err := io.ReadFull(d.r, frame[:]); err != nil {
+		return nil, 0, err
+	}
+	n := int64(binary.BigEndian.Uint32(frame[:]))
+	if n > int64(d.c.maxLen()) {
+		return nil, 0, d.c.notify(nil, ErrMACTooLong)
+	}
+	lr := &io.LimitedReader{R: d.r, N: n}
+
+	// The message is only kept for the hooks
+	var r io.Reader = lr
+	var enc *bytes.Buffer
+	if d.c.OnInvalid != nil || d.c.OnExpired != nil || d.c.OnTooLong != nil {
+		enc = bytes.NewBuffer(make([]byte, 0, n))
+		r = io.TeeReader(lr, enc)
+	}
+	value, hdr, err := d.decode(r, lr)
+	if err == nil {
+		return value, d.c.issuedAt(hdr), nil
+	}
+	if err != io.ErrUnexpectedEOF && enc != nil {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, d.c.notify(enc.Bytes(), err)
+	}
+	return nil, 0, err
+}
+
+// decode reads the message of a frame from r, and verifies it. lr is the
+// reader of the frame, that tells how many bytes are left to read.
+func (d *Decoder) decode(r io.Reader, lr *io.LimitedReader) ([]byte, *macHeader, error) {
+	if lr.N < int64(d.c.minEncodedLen()) {
+		if _, err := io.ReadFull(r, make([]byte, lr.N)); err != nil {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		return nil, nil, ErrMACTruncated
+	}
+	if d.c.Prefix != "" {
+		prefix := make([]byte, len(d.c.Prefix))
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		if string(prefix) != d.c.Prefix {
+			return nil, nil, ErrMACInvalid
+		}
+	}
+	dec := make([]byte, d.c.Encoding.maxDecodedLen(int(lr.N)))
+	m, err := io.ReadFull(d.c.Encoding.newDecoder(r), dec)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		switch err.(type) {
+		case base64.CorruptInputError, base32.CorruptInputError:
+			return nil, nil, ErrMACInvalid
+		}
+		return nil, nil, err
+	}
+	if lr.N > 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if m < d.c.minLen() {
+		return nil, nil, ErrMACTruncated
+	}
+	return verifyMessage(d.c, dec[:m], nil, messageOptions{})
+}
+
+// maxDecodedLen returns the maximal length of the bytes represented by n
+// encoded bytes, with or without padding for the base64 encodings.
+func (e MessageEncoding) maxDecodedLen(n int) int {
+	if e == Base32 {
+		return e.encoding().DecodedLen(n)
+	}
+	return base64.RawURLEncoding.DecodedLen(n)
+}
+
+// newDecoder returns a reader decoding the data read from r. The base64
+// messages are decoded with or without padding.
+func (e MessageEncoding) newDecoder(r io.Reader) io.Reader {
+	if e == Base32 {
+		return base32.NewDecoder(base32Raw, upperReader{r})
+	}
+	return base64.NewDecoder(base64.RawURLEncoding, &unpadReader{r: r})
+}
+
+// unpadReader removes the padding at the end of the base64 data read from r,
+// after checking it like trimBase64Padding.
+type unpadReader struct {
+	r   io.Reader
+	n   int
+	pad int
+}
+
+func (u *unpadReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	w := 0
+	for _, b := range p[:n] {
+		u.n++
+		if b == '=' {
+			u.pad++
+		}
+		if u.pad > 2 || (u.pad > 0 && b != '=') {
+			return w, base64.CorruptInputError(u.n - 1)
+		}
+		if b != '=' {
+			p[w] = b
+			w++
+		}
+	}
+	if err == io.EOF && u.pad > 0 && (u.n%4 != 0 || u.pad != (4-(u.n-u.pad)%4)%4) {
+		return w, base64.CorruptInputError(u.n - u.pad)
+	}
+	return w, err
+}
+
+// upperReader converts the letters read from r to uppercase.
+type upperReader struct {
+	r io.Reader
+}
+
+func (u upperReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	for i, b := range p[:n] {
+		if 'a' <= b && b <= 'z' {
+			p[i] = b - 'a' + 'A'
+		}
+	}
+	return n, err
+}
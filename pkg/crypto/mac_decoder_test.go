@@ -0,0 +1,212 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecoder(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:   []byte("0123456789012345"),
+		Name:  "stream",
+		Clock: func() int64 { return now },
+	}
+	values := [][]byte{[]byte("first"), {}, []byte("third value")}
+
+	buf := new(bytes.Buffer)
+	e := NewEncoder(o, buf)
+	for _, value := range values {
+		if !assert.NoError(t, e.Encode(value)) {
+			return
+		}
+	}
+
+	d := NewDecoder(o, iotest.OneByteReader(bytes.NewReader(buf.Bytes())))
+	for _, value := range values {
+		v, issuedAt, err := d.Decode()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, value, v)
+		assert.EqualValues(t, 1000, issuedAt)
+	}
+	_, _, err := d.Decode()
+	assert.Equal(t, io.EOF, err)
+
+	// A truncated stream
+	d = NewDecoder(o, bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	d.Decode()
+	d.Decode()
+	_, _, err = d.Decode()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// A tampered message
+	tampered := append([]byte{}, buf.Bytes()...)
+	tampered[10] ^= 1
+	_, _, err = NewDecoder(o, bytes.NewReader(tampered)).Decode()
+	assert.Error(t, err)
+	tampered[10] = '!'
+	_, _, err = NewDecoder(o, bytes.NewReader(tampered)).Decode()
+	assert.Equal(t, ErrMACInvalid, err)
+}
+
+// endlessReader returns an infinite stream of 'A'.
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'A'
+	}
+	return len(p), nil
+}
+
+func TestDecoderOversizedFrame(t *testing.T) {
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxLen: 256,
+	}
+
+	var frame [4]byte
+	binary.BigEndian.PutUint32(frame[:], 1<<31)
+	r := io.MultiReader(bytes.NewReader(frame[:]), endlessReader{})
+	_, _, err := NewDecoder(o, r).Decode()
+	assert.Equal(t, ErrMACTooLong, err)
+
+	// The frame is not read past its length
+	binary.BigEndian.PutUint32(frame[:], 256)
+	r = io.MultiReader(bytes.NewReader(frame[:]), endlessReader{})
+	_, _, err = NewDecoder(o, r).Decode()
+	assert.Error(t, err)
+}
+
+func TestDecoderBase32(t *testing.T) {
+	o := &MACConfig{
+		Key:      []byte("0123456789012345"),
+		Encoding: Base32,
+	}
+	// The messages are written in lowercase
+	buf := new(bytes.Buffer)
+	for _, value := range []string{"first", "second"} {
+		encoded, err := EncodeAuthMessage(o, []byte(value))
+		if !assert.NoError(t, err) {
+			return
+		}
+		var frame [4]byte
+		binary.BigEndian.PutUint32(frame[:], uint32(len(encoded)))
+		buf.Write(frame[:])
+		buf.Write(bytes.ToLower(encoded))
+	}
+
+	dec := NewDecoder(o, buf)
+	for _, value := range []string{"first", "second"} {
+		v, _, err := dec.Decode()
+		if assert.NoError(t, err) {
+			assert.Equal(t, value, string(v))
+		}
+	}
+	_, _, err := dec.Decode()
+	assert.Equal(t, io.EOF, err)
+}
+
+// writeFrame writes the message in a frame, as an Encoder does.
+func writeFrame(buf *bytes.Buffer, enc []byte) {
+	var frame [4]byte
+	binary.BigEndian.PutUint32(frame[:], uint32(len(enc)))
+	buf.Write(frame[:])
+	buf.Write(enc)
+}
+
+func TestDecoderPadding(t *testing.T) {
+	raw := &MACConfig{Key: []byte("0123456789012345")}
+	padded := raw.Clone()
+	padded.Encoding = Base64URL
+	value := []byte("my val")
+	encPadded, err := EncodeAuthMessage(padded, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	encRaw := bytes.TrimRight(encPadded, "=")
+	assert.NotEqual(t, encPadded, encRaw)
+
+	// Both forms are accepted by both configs, like by DecodeAuthMessage
+	for _, c := range []*MACConfig{raw, padded} {
+		buf := new(bytes.Buffer)
+		writeFrame(buf, encRaw)
+		writeFrame(buf, encPadded)
+		d := NewDecoder(c, iotest.OneByteReader(buf))
+		for i := 0; i < 2; i++ {
+			v, _, err := d.Decode()
+			if assert.NoError(t, err) {
+				assert.Equal(t, value, v)
+			}
+		}
+		_, _, err := d.Decode()
+		assert.Equal(t, io.EOF, err)
+	}
+
+	// But a wrong padding is rejected
+	for _, enc := range [][]byte{
+		append(append([]byte{}, encPadded...), '='),
+		append(append([]byte{}, encRaw...), '=', '=', '='),
+		append(append([]byte{}, encPadded...), 'A'),
+	} {
+		buf := new(bytes.Buffer)
+		writeFrame(buf, enc)
+		_, _, err := NewDecoder(raw, buf).Decode()
+		assert.Equal(t, ErrMACInvalid, err, string(enc))
+		_, err = DecodeAuthMessage(raw, enc)
+		assert.Error(t, err, string(enc))
+	}
+}
+
+func TestDecoderHooks(t *testing.T) {
+	var now int64 = 1000
+	var invalid, expired, tooLong [][]byte
+	o := &MACConfig{
+		Key:       []byte("0123456789012345"),
+		MaxAge:    60,
+		MaxLen:    256,
+		Clock:     func() int64 { return now },
+		OnInvalid: func(enc []byte) { invalid = append(invalid, append([]byte{}, enc...)) },
+		OnExpired: func(enc []byte) { expired = append(expired, append([]byte{}, enc...)) },
+		OnTooLong: func(enc []byte) { tooLong = append(tooLong, enc) },
+	}
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	dec := mustBase64Decode(encoded)
+	dec[len(dec)-1] ^= 1
+	tampered := Base64Encode(dec)
+	short := Base64Encode(dec[:o.minLen()-1])
+
+	buf := new(bytes.Buffer)
+	writeFrame(buf, tampered)
+	writeFrame(buf, short)
+	writeFrame(buf, encoded)
+	d := NewDecoder(o, buf)
+	_, _, err = d.Decode()
+	assert.Equal(t, ErrMACInvalid, err)
+	_, _, err = d.Decode()
+	assert.Equal(t, ErrMACTruncated, err)
+	now = 2000
+	_, _, err = d.Decode()
+	assert.Equal(t, ErrMACExpired, err)
+
+	// The hooks are called with the encoded messages
+	assert.Equal(t, [][]byte{tampered, short}, invalid)
+	assert.Equal(t, [][]byte{encoded}, expired)
+
+	// Even for the frames too long to be read
+	var frame [4]byte
+	binary.BigEndian.PutUint32(frame[:], 1<<20)
+	_, _, err = NewDecoder(o, bytes.NewReader(frame[:])).Decode()
+	assert.Equal(t, ErrMACTooLong, err)
+	assert.Equal(t, [][]byte{nil}, tooLong)
+}
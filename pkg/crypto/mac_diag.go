@@ -0,0 +1,81 @@
+package crypto
+
+// DiagStage is a stage of the decoding of a message, where it can fail.
+type DiagStage uint8
+
+const (
+	// DiagNone is the stage of a message that has been decoded
+	DiagNone DiagStage = iota
+	// DiagConfig is the validation of the config
+	DiagConfig
+	// DiagLength is a check of the length of the message, against MaxLen,
+	// MaxDecodedLen or the minimal length of a message
+	DiagLength
+	// DiagBase64 is the decoding of the message from its encoding, including
+	// its prefix
+	DiagBase64
+	// DiagHeader is the parsing of the header: version, flags, time, etc.
+	DiagHeader
+	// DiagKey is the resolution of the key by KeyFunc
+	DiagKey
+	// DiagMAC is the verification of the MAC
+	DiagMAC
+	// DiagPurpose is the verification of the purpose
+	DiagPurpose
+	// DiagValue is the decompression and the unpadding of the value
+	DiagValue
+	// DiagTime is the verification of the time ranges: expiry, issued time
+	// in the future, etc.
+	DiagTime
+)
+
+var diagStageNames = [...]string{
+	DiagNone:    "none",
+	DiagConfig:  "config",
+	DiagLength:  "length",
+	DiagBase64:  "base64",
+	DiagHeader:  "header",
+	DiagKey:     "key",
+	DiagMAC:     "mac",
+	DiagPurpose: "purpose",
+	DiagValue:   "value",
+	DiagTime:    "time",
+}
+
+// String returns the name of the stage, for the logs.
+func (s DiagStage) String() string {
+	if int(s) < len(diagStageNames) {
+		return diagStageNames[s]
+	}
+	return "unknown"
+}
+
+// Diagnostics tells how the decoding of a message has failed, see
+// DecodeAuthMessageDiag.
+type Diagnostics struct {
+	// Stage is the stage where the decoding has failed, or DiagNone for a
+	// message that has been decoded
+	Stage DiagStage
+}
+
+// DecodeAuthMessageDiag is the same as DecodeAuthMessage, but also returns
+// the stage where the decoding has failed, to tell apart the causes of an
+// ErrMACInvalid: a bad encoding, a bad header, an unknown key id or a bad
+// MAC. It is meant for the tests and the observability: the other callers
+// should use DecodeAuthMessage, and must not tell a client why its message
+// has been rejected.
+func DecodeAuthMessageDiag(c *MACConfig, enc []byte) (value []byte, diag Diagnostics, err error) {
+	value, _, err = decodeMessage(c, enc, nil, messageOptions{diag: &diag})
+	if err == nil {
+		diag.Stage = DiagNone
+	}
+	return value, diag, err
+}
+
+// reach records the stage reached by the decoding, if the options have
+// diagnostics.
+func (o messageOptions) reach(stage DiagStage) {
+	if o.diag != nil {
+		o.diag.Stage = stage
+	}
+}
@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeAuthMessageDiag(t *testing.T) {
+	now := int64(1000)
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		Name:   "diag",
+		KeyID:  []byte("1"),
+		MaxAge: 60,
+		MaxLen: 200,
+		Clock:  func() int64 { return now },
+	}
+	value := []byte("myvalue")
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, diag, err := DecodeAuthMessageDiag(o, encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, value, v)
+	assert.Equal(t, DiagNone, diag.Stage)
+
+	tampered := func(fn func(dec []byte) []byte) []byte {
+		return Base64Encode(fn(mustBase64Decode(encoded)))
+	}
+	withPurpose := o.Clone()
+	withPurpose.Purpose = 2
+	withKeyFunc := o.Clone()
+	withKeyFunc.KeyFunc = func(keyID []byte) ([]byte, error) { return nil, errors.New("unknown key") }
+	compressed := o.Clone()
+	compressed.Compress = true
+	bomb, err := EncodeAuthMessage(compressed, []byte(strings.Repeat("a", 2000)))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, tc := range []struct {
+		name  string
+		c     *MACConfig
+		enc   []byte
+		err   error
+		stage DiagStage
+	}{
+		{"config", &MACConfig{}, encoded, ErrMissingKey, DiagConfig},
+		{"too long", o, []byte(strings.Repeat("A", 201)), ErrMACTooLong, DiagLength},
+		{"base64", o, []byte("!" + string(encoded[1:])), ErrMACInvalid, DiagBase64},
+		{"truncated", o, encoded[:8], ErrMACTruncated, DiagLength},
+		{"version", o, tampered(func(dec []byte) []byte { dec[0] = 42; return dec }), ErrMACUnsupportedVersion, DiagHeader},
+		{"flags", o, tampered(func(dec []byte) []byte { dec[1] = flagExtended; return dec }), ErrMACInvalid, DiagHeader},
+		{"key", withKeyFunc, encoded, ErrMACInvalid, DiagKey},
+		{"mac", o, tampered(func(dec []byte) []byte { dec[len(dec)-1] ^= 1; return dec }), ErrMACInvalid, DiagMAC},
+		{"value", o, tampered(func(dec []byte) []byte { dec[len(dec)-o.macLen()-1] ^= 1; return dec }), ErrMACInvalid, DiagMAC},
+		{"purpose", withPurpose, encoded, ErrMACWrongPurpose, DiagPurpose},
+		{"decompression", &MACConfig{Key: o.Key, Name: o.Name, KeyID: o.KeyID, MaxLen: 200, MaxDecodedLen: 100}, bomb, ErrMACTooLong, DiagValue},
+	} {
+		v, diag, err := DecodeAuthMessageDiag(tc.c, tc.enc)
+		assert.Equal(t, tc.err, err, tc.name)
+		assert.Nil(t, v, tc.name)
+		assert.Equal(t, tc.stage, diag.Stage, "%s: %s", tc.name, diag.Stage)
+	}
+
+	// The time ranges
+	now = 1061
+	_, diag, err = DecodeAuthMessageDiag(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+	assert.Equal(t, DiagTime, diag.Stage)
+	now = 900
+	o.MaxSkew = 10
+	_, diag, err = DecodeAuthMessageDiag(o, encoded)
+	assert.Equal(t, ErrMACFromFuture, err)
+	assert.Equal(t, DiagTime, diag.Stage)
+
+	assert.Equal(t, "mac", DiagMAC.String())
+	assert.Equal(t, "unknown", DiagStage(42).String())
+}
@@ -0,0 +1,38 @@
+package crypto
+
+// epochLen returns the length of the epochs, in the unit of the config, or 0
+// without EpochSeconds.
+func (c *MACConfig) epochLen() int64 {
+	return c.TimeUnit.convert(c.EpochSeconds, Seconds, true)
+}
+
+// epochStart returns the start of the epoch of the time t, in the unit of the
+// config. It is t itself without EpochSeconds.
+func (c *MACConfig) epochStart(t int64) int64 {
+	e := c.epochLen()
+	if e == 0 {
+		return t
+	}
+	mod := t % e
+	if mod < 0 {
+		mod += e
+	}
+	return t - mod
+}
+
+// epochMaxAge rounds the maximum age up to a whole number of epochs, so that
+// the messages expire at the start of an epoch. A maximum age of 0 stays 0.
+func (c *MACConfig) epochMaxAge(maxAge int64) int64 {
+	e := c.epochLen()
+	if e == 0 || maxAge%e == 0 {
+		return maxAge
+	}
+	return maxAge + e - maxAge%e
+}
+
+// epochExpired returns true if the message issued at the given time, with
+// the given maximum age in whole epochs, is expired: the current epoch, once
+// the grace is removed, is at least maxAge after the epoch of the message.
+func (c *MACConfig) epochExpired(now, issuedAt, maxAge int64, grace uint64) bool {
+	return after(now, c.epochStart(issuedAt), uint64(maxAge)+grace-1)
+}
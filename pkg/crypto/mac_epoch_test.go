@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMACEpochSeconds(t *testing.T) {
+	const day = 86400
+	var now int64 = 10*day + 3600
+	o := &MACConfig{
+		Key:          []byte("0123456789012345"),
+		MaxAge:       day,
+		EpochSeconds: day,
+		Clock:        func() int64 { return now },
+	}
+
+	// The messages of the same day have the same issued time
+	morning, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	now = 11*day - 1
+	evening, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, morning, evening)
+	_, issuedAt, expiresAt, err := DecodeAuthMessageFull(o, morning)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 10*day, issuedAt)
+	assert.EqualValues(t, 11*day, expiresAt)
+
+	// And they expire together, at the start of the next day
+	now = 11*day - 1
+	_, err = DecodeAuthMessage(o, morning)
+	assert.NoError(t, err)
+	now = 11 * day
+	_, err = DecodeAuthMessage(o, morning)
+	assert.Equal(t, ErrMACExpired, err)
+	_, err = DecodeAuthMessage(o, evening)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// A message issued at the start of the next day is valid for a day
+	next, err := EncodeAuthMessage(o, []byte("myvalue"))
+	assert.NoError(t, err)
+	now = 12*day - 1
+	_, err = DecodeAuthMessage(o, next)
+	assert.NoError(t, err)
+	now = 12 * day
+	_, err = DecodeAuthMessage(o, next)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// The maximum ages are rounded up to whole epochs
+	now = 10*day + 3600
+	o.MaxAge = 2 * day
+	_, err = DecodeAuthMessage(o, morning)
+	assert.NoError(t, err)
+	o.MaxAge = 3600
+	_, err = DecodeAuthMessage(o, morning)
+	assert.NoError(t, err)
+	ttl, err := EncodeAuthMessageWithExpiry(o, []byte("myvalue"), 60)
+	assert.NoError(t, err)
+	now = 11*day - 1
+	_, err = DecodeAuthMessage(o, morning)
+	assert.NoError(t, err)
+	_, err = DecodeAuthMessage(o, ttl)
+	assert.NoError(t, err)
+	now = 11 * day
+	_, err = DecodeAuthMessage(o, ttl)
+	assert.Equal(t, ErrMACExpired, err)
+	o.MaxAge = day
+
+	// ExpiryGrace and MaxSkew are added after the end of the epoch
+	o.ExpiryGrace = 5
+	now = 11*day + 4
+	_, err = DecodeAuthMessage(o, morning)
+	assert.NoError(t, err)
+	now = 11*day + 5
+	_, err = DecodeAuthMessage(o, morning)
+	assert.Equal(t, ErrMACExpired, err)
+	o.ExpiryGrace = 0
+
+	// With milliseconds, the epochs are still given in seconds
+	o.TimeUnit = Milliseconds
+	now = (10*day + 3600) * 1000
+	ms, err := EncodeAuthMessage(o, []byte("myvalue"))
+	assert.NoError(t, err)
+	issuedAt, err = VerifyAuthMessage(o, ms)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 10*day*1000, issuedAt)
+	o.MaxAge = day * 1000
+	now = 11*day*1000 - 1
+	_, err = DecodeAuthMessage(o, ms)
+	assert.NoError(t, err)
+	now = 11 * day * 1000
+	_, err = DecodeAuthMessage(o, ms)
+	assert.Equal(t, ErrMACExpired, err)
+	o.TimeUnit = Seconds
+	o.MaxAge = day
+
+	// The configs without EpochSeconds decode the messages with their time
+	now = 10*day + 3600
+	plain := &MACConfig{Key: o.Key, MaxAge: 3600, Clock: o.Clock}
+	_, err = DecodeAuthMessage(plain, morning)
+	assert.NoError(t, err)
+	now++
+	_, err = DecodeAuthMessage(plain, morning)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// The invalid epochs are rejected
+	assert.Error(t, (&MACConfig{Key: o.Key, EpochSeconds: -1}).Validate())
+	assert.Error(t, (&MACConfig{Key: o.Key, EpochSeconds: maxDuration + 1}).Validate())
+	assert.Error(t, (&MACConfig{Key: o.Key, EpochSeconds: day, NoTimestamp: true}).Validate())
+}
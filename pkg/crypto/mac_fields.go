@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"encoding/binary"
+)
+
+// EncodeFields is the same as EncodeAuthMessage, for a message with several
+// fields. Each field is prefixed by its length on 4 bytes, so the fields can
+// contain any byte and are decoded without ambiguity.
+//
+// The messages with fields are bound to their kind in the MAC: they can't be
+// decoded with DecodeAuthMessage, and the other messages can't be decoded
+// with DecodeFields.
+func EncodeFields(c *MACConfig, fields ...[]byte) ([]byte, error) {
+	size := 0
+	for _, field := range fields {
+		size += 4 + len(field)
+	}
+	blob := make([]byte, 0, size)
+	for _, field := range fields {
+		blob = binary.BigEndian.AppendUint32(blob, uint32(len(field)))
+		blob = append(blob, field...)
+	}
+	return encodeAuthMessage(c, blob, c.now(), messageOptions{domain: macDomainFields})
+}
+
+// DecodeFields verifies a message returned by EncodeFields, and returns its
+// fields and its issued time.
+func DecodeFields(c *MACConfig, enc []byte) ([][]byte, int64, error) {
+	blob, time, err := decodeAuthMessage(c, enc, nil, messageOptions{domain: macDomainFields})
+	if err != nil {
+		return nil, 0, err
+	}
+	fields := [][]byte{}
+	for len(blob) > 0 {
+		if len(blob) < 4 {
+			return nil, 0, ErrMACInvalid
+		}
+		n := binary.BigEndian.Uint32(blob)
+		blob = blob[4:]
+		if uint64(n) > uint64(len(blob)) {
+			return nil, 0, ErrMACInvalid
+		}
+		fields = append(fields, blob[:n:n])
+		blob = blob[n:]
+	}
+	return fields, time, nil
+}
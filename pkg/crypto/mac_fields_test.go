@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMACFields(t *testing.T) {
+	var now int64 = 1000000
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		Name:   "fields",
+		MaxAge: 60,
+		Clock:  func() int64 { return now },
+	}
+
+	cases := [][][]byte{
+		{[]byte("user-42"), []byte("admin")},
+		{[]byte("single")},
+		{{}, []byte("b"), {}},
+		{{0, 0, 0, 1, 0xff}, []byte("a|b:c"), {0, 0, 0, 0}},
+		{},
+	}
+	for _, fields := range cases {
+		encoded, err := EncodeFields(o, fields...)
+		if !assert.NoError(t, err) {
+			return
+		}
+		decoded, issuedAt, err := DecodeFields(o, encoded)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, now, issuedAt)
+		if assert.Len(t, decoded, len(fields)) {
+			for i := range fields {
+				assert.Equal(t, string(fields[i]), string(decoded[i]))
+			}
+		}
+	}
+
+	// The separators in the fields are not ambiguous
+	enc1, _ := EncodeFields(o, []byte("ab"), []byte("c"))
+	enc2, _ := EncodeFields(o, []byte("a"), []byte("bc"))
+	assert.NotEqual(t, enc1, enc2)
+	fields, _, err := DecodeFields(o, enc2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, [][]byte{[]byte("a"), []byte("bc")}, fields)
+	}
+
+	// The messages with fields can't be mixed with the other messages
+	_, err = DecodeAuthMessage(o, enc1)
+	assert.Equal(t, ErrMACInvalid, err)
+	plain, _ := EncodeAuthMessage(o, []byte{0, 0, 0, 1, 'a'})
+	_, _, err = DecodeFields(o, plain)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	now += 61
+	_, _, err = DecodeFields(o, enc1)
+	assert.Equal(t, ErrMACExpired, err)
+}
+
+func TestMACFieldsMalformed(t *testing.T) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	for _, blob := range [][]byte{
+		{0, 0, 1},
+		{0, 0, 0, 2, 'a'},
+		{0, 0, 0, 1, 'a', 0},
+		{0xff, 0xff, 0xff, 0xff},
+	} {
+		encoded, err := encodeAuthMessage(o, blob, o.now(), messageOptions{domain: macDomainFields})
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, _, err = DecodeFields(o, encoded)
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+}
@@ -0,0 +1,78 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strconv"
+)
+
+// DecodeGorillaSecureCookie verifies a cookie encoded by the Encode method of
+// gorilla/securecookie, with the default gob serializer and without
+// encryption, and deserializes its value into dst. It can be used to accept
+// the legacy cookies of a service migrating to EncodeAuthMessage, until they
+// have all been replaced.
+//
+// The hash key of gorilla is the Key of the config, and its hash function is
+// the Hash of the config, SHA-256 by default like for gorilla. MaxLen, MaxAge,
+// MaxSkew and Clock are applied as for the other messages, and the time of the
+// cookies is in seconds. The errors are the same as for DecodeAuthMessage:
+// ErrMACInvalid for a cookie with a bad MAC or a bad format, ErrMACExpired
+// for an expired one, etc. The errors of the deserialization are returned
+// unchanged.
+func DecodeGorillaSecureCookie(c *MACConfig, name, encoded string, dst interface{}) error {
+	value, err := decodeGorillaSecureCookie(c, name, encoded)
+	if err = c.notify([]byte(encoded), err); err != nil {
+		return err
+	}
+	return GobCodec.Unmarshal(value, dst)
+}
+
+// decodeGorillaSecureCookie verifies a cookie of gorilla/securecookie, and
+// returns its serialized value.
+func decodeGorillaSecureCookie(c *MACConfig, name, encoded string) ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Signer != nil {
+		return nil, errSignerUnsupported
+	}
+
+	// Check length
+	if len(encoded) > c.maxLen() {
+		return nil, ErrMACTooLong
+	}
+
+	// Decode from base64, the value is "date|value|mac"
+	dec, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrMACInvalid
+	}
+	parts := bytes.SplitN(dec, []byte("|"), 3)
+	if len(parts) != 3 {
+		return nil, ErrMACInvalid
+	}
+
+	// Verify the MAC of "name|date|value"
+	input := make([]byte, 0, len(name)+len(dec))
+	input = append(input, name...)
+	input = append(input, '|')
+	input = append(input, dec[:len(dec)-len(parts[2])-1]...)
+	if !ConstantTimeEqual(parts[2], createMAC(c.hash(), c.Key, input)) {
+		return nil, ErrMACInvalid
+	}
+
+	// Verify the time ranges
+	time, err := strconv.ParseInt(string(parts[0]), 10, 64)
+	if err != nil {
+		return nil, ErrMACInvalid
+	}
+	if err = c.checkTime(&macHeader{time: time}); err != nil {
+		return nil, err
+	}
+
+	value, err := base64.URLEncoding.DecodeString(string(parts[1]))
+	if err != nil {
+		return nil, ErrMACInvalid
+	}
+	return value, nil
+}
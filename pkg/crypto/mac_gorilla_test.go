@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gorillaCookie has been encoded by gorilla/securecookie v1.1.2, with:
+//
+//  s := securecookie.New([]byte("0123456789012345"), nil)
+//  s.Encode("session", map[string]string{"user": "alice"})
+//
+const gorillaCookie = "MTc5MTk1NjY0MXxEWDhFQVFMX2dBQUJEQUVNQUFBUF80QUFBUVIxYzJWeUJXRnNhV05sfLbmwS46e_xWWsxcYnNtCBxmCflim3txrfaljHcJoxuk"
+
+// gorillaTime is the issued time of gorillaCookie.
+const gorillaTime = 1791956641
+
+func TestDecodeGorillaSecureCookie(t *testing.T) {
+	now := int64(gorillaTime + 60)
+	invalid := 0
+	o := &MACConfig{
+		Key:       []byte("0123456789012345"),
+		MaxAge:    3600,
+		Clock:     func() int64 { return now },
+		OnInvalid: func(enc []byte) { invalid++ },
+	}
+
+	var dst map[string]string
+	if assert.NoError(t, DecodeGorillaSecureCookie(o, "session", gorillaCookie, &dst)) {
+		assert.Equal(t, map[string]string{"user": "alice"}, dst)
+	}
+
+	// The name and the MAC are verified
+	assert.Equal(t, ErrMACInvalid, DecodeGorillaSecureCookie(o, "other", gorillaCookie, &dst))
+	dec, _ := base64.URLEncoding.DecodeString(gorillaCookie)
+	for i := range dec {
+		tampered := append([]byte(nil), dec...)
+		tampered[i] ^= 1
+		err := DecodeGorillaSecureCookie(o, "session", base64.URLEncoding.EncodeToString(tampered), &dst)
+		assert.Equal(t, ErrMACInvalid, err, "tampered at %d", i)
+	}
+	other := &MACConfig{Key: []byte("5432109876543210"), Clock: o.Clock}
+	assert.Equal(t, ErrMACInvalid, DecodeGorillaSecureCookie(other, "session", gorillaCookie, &dst))
+
+	// The malformed cookies
+	for _, encoded := range []string{"", "!!!", base64.URLEncoding.EncodeToString([]byte("1|2")), gorillaCookie[1:]} {
+		assert.Equal(t, ErrMACInvalid, DecodeGorillaSecureCookie(o, "session", encoded, &dst))
+	}
+	assert.Equal(t, len(dec)+5, invalid)
+
+	// The time ranges
+	now = gorillaTime + 3601
+	err := DecodeGorillaSecureCookie(o, "session", gorillaCookie, &dst)
+	assert.Equal(t, ErrMACExpired, err)
+	assert.True(t, IsExpired(err))
+	o.MaxAge = 0
+	assert.NoError(t, DecodeGorillaSecureCookie(o, "session", gorillaCookie, &dst))
+	now = gorillaTime - 120
+	o.MaxSkew = 60
+	assert.Equal(t, ErrMACFromFuture, DecodeGorillaSecureCookie(o, "session", gorillaCookie, &dst))
+	now = gorillaTime
+
+	// The length, and the errors of the deserialization
+	o.MaxLen = len(gorillaCookie) - 1
+	assert.Equal(t, ErrMACTooLong, DecodeGorillaSecureCookie(o, "session", gorillaCookie, &dst))
+	o.MaxLen = 0
+	var wrong []int
+	err = DecodeGorillaSecureCookie(o, "session", gorillaCookie, &wrong)
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "gob"))
+	}
+
+	// And a native message can't be decoded as a gorilla cookie
+	enc, err := EncodeValue(o, GobCodec, map[string]string{"user": "alice"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, ErrMACInvalid, DecodeGorillaSecureCookie(o, "session", string(enc), &dst))
+	}
+}
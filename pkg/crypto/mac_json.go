@@ -0,0 +1,158 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+var (
+	errJSONDuplicateKey = errors.New("mac: duplicate key in the JSON document")
+	errJSONInvalidUTF8  = errors.New("mac: invalid UTF-8 in the JSON document")
+)
+
+// EncodeJSON is the same as EncodeAuthMessage, but for a value serialized in
+// JSON. The errors of the serialization are returned unchanged. With
+// CanonicalJSON, the value is written in its canonical form.
+func EncodeJSON[T any](c *MACConfig, v T) ([]byte, error) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if c.CanonicalJSON {
+		if value, err = CanonicalizeJSON(value); err != nil {
+			return nil, err
+		}
+	}
+	return EncodeAuthMessage(c, value)
+}
+
+// DecodeJSON verifies a message returned by EncodeJSON, and deserializes its
+// value. The MAC errors (ErrMACInvalid, ErrMACExpired, etc.) are returned when
+// the message is not valid, and the JSON errors when its value can't be
+// deserialized into a T.
+func DecodeJSON[T any](c *MACConfig, enc []byte) (T, error) {
+	var v T
+	value, err := DecodeAuthMessage(c, enc)
+	if err != nil {
+		return v, err
+	}
+	if err = json.Unmarshal(value, &v); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+// SignJSON is the same as SignDetached, for a JSON document that is
+// transmitted separately from its MAC. With CanonicalJSON, the MAC is
+// computed on the canonical form of the document, and the document can be
+// re-serialized, for example by a service that reorders the keys of its
+// objects, and still be verified by VerifyJSON. An error is returned if the
+// document is not valid JSON.
+func SignJSON(c *MACConfig, data []byte) ([]byte, error) {
+	data, err := c.jsonForMAC(data)
+	if err != nil {
+		return nil, err
+	}
+	return SignDetached(c, data)
+}
+
+// VerifyJSON verifies a JSON document against a MAC returned by SignJSON, and
+// returns the issued time of the MAC. A document that is not valid JSON gives
+// ErrMACInvalid with CanonicalJSON.
+func VerifyJSON(c *MACConfig, data, mac []byte) (int64, error) {
+	data, err := c.jsonForMAC(data)
+	if err != nil {
+		return 0, ErrMACInvalid
+	}
+	return VerifyDetached(c, data, mac)
+}
+
+// jsonForMAC returns the bytes of the JSON document that are authenticated:
+// its canonical form with CanonicalJSON, or the document itself.
+func (c *MACConfig) jsonForMAC(data []byte) ([]byte, error) {
+	if !c.CanonicalJSON {
+		return data, nil
+	}
+	return CanonicalizeJSON(data)
+}
+
+// CanonicalizeJSON returns the canonical form of a JSON document: the keys of
+// the objects are sorted, the insignificant whitespace is removed, and the
+// strings are escaped in the same way. The numbers are kept as they are
+// written, so 1 and 1.0 are still different.
+//
+// A document with a key repeated in an object, or with invalid UTF-8, is
+// rejected: they would be normalized, and two different documents, read
+// differently by their consumers, would have the same canonical form.
+func CanonicalizeJSON(data []byte) ([]byte, error) {
+	if !utf8.Valid(data) {
+		return nil, errJSONInvalidUTF8
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := readJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("mac: invalid data after the JSON document")
+	}
+
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// readJSONValue reads the next JSON value of the decoder, token by token, to
+// reject the objects with a repeated key.
+func readJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := make(map[string]interface{})
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := tok.(string)
+			if _, ok := obj[key]; ok {
+				return nil, errJSONDuplicateKey
+			}
+			if obj[key], err = readJSONValue(dec); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case json.Delim('['):
+		arr := make([]interface{}, 0)
+		for dec.More() {
+			v, err := readJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return arr, nil
+	}
+	return tok, nil
+}
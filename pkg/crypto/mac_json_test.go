@@ -0,0 +1,118 @@
+package crypto
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type jsonClaims struct {
+	Email  string   `json:"email"`
+	Scopes []string `json:"scopes"`
+}
+
+func TestMACJSON(t *testing.T) {
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "json",
+	}
+	claims := jsonClaims{Email: "alice@example.org", Scopes: []string{"io.cozy.files"}}
+
+	encoded, err := EncodeJSON(o, claims)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeJSON[jsonClaims](o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, claims, v)
+
+	// A value of the wrong type gives a JSON error
+	_, err = DecodeJSON[[]int](o, encoded)
+	assert.IsType(t, &json.UnmarshalTypeError{}, err)
+
+	// A tampered message gives a MAC error
+	dec := mustBase64Decode(encoded)
+	dec[len(dec)-1] ^= 1
+	v, err = DecodeJSON[jsonClaims](o, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+	assert.Equal(t, jsonClaims{}, v)
+
+	_, err = EncodeJSON(o, func() {})
+	assert.IsType(t, &json.UnsupportedTypeError{}, err)
+}
+
+func TestMACCanonicalJSON(t *testing.T) {
+	raw := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "json",
+	}
+	canonical := raw.Clone()
+	canonical.CanonicalJSON = true
+
+	doc := []byte(`{"scopes":["io.cozy.files"],"email":"alice@example.org","n":1.50}`)
+	reordered := []byte("{\n  \"email\": \"alice@example.org\",\n  \"n\": 1.50,\n  \"scopes\": [ \"io.cozy.files\" ]\n}")
+
+	// A re-serialized document is still verified in canonical mode
+	mac, err := SignJSON(canonical, doc)
+	if assert.NoError(t, err) {
+		_, err = VerifyJSON(canonical, doc, mac)
+		assert.NoError(t, err)
+		_, err = VerifyJSON(canonical, reordered, mac)
+		assert.NoError(t, err)
+		_, err = VerifyJSON(canonical, []byte(`{"email":"bob@example.org","n":1.50,"scopes":["io.cozy.files"]}`), mac)
+		assert.Equal(t, ErrMACInvalid, err)
+		_, err = VerifyJSON(canonical, []byte(`{"email":"alice@example.org","n":1.5,"scopes":["io.cozy.files"]}`), mac)
+		assert.Equal(t, ErrMACInvalid, err)
+		_, err = VerifyJSON(canonical, []byte(`{"email":`), mac)
+		assert.Equal(t, ErrMACInvalid, err)
+		_, err = VerifyJSON(raw, doc, mac)
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+
+	// But not in raw mode
+	mac, err = SignJSON(raw, doc)
+	if assert.NoError(t, err) {
+		_, err = VerifyJSON(raw, doc, mac)
+		assert.NoError(t, err)
+		_, err = VerifyJSON(raw, reordered, mac)
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+	_, err = SignJSON(canonical, []byte(`{"email": 1} trailing`))
+	assert.Error(t, err)
+
+	// EncodeJSON writes the canonical form
+	encoded, err := EncodeJSON(canonical, map[string]interface{}{"b": "<&>", "a": []int{1, 2}})
+	if assert.NoError(t, err) {
+		value, err := DecodeAuthMessage(canonical, encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"a":[1,2],"b":"<&>"}`, string(value))
+	}
+
+	canon, err := CanonicalizeJSON([]byte(` {"z": {"y": null, "x": "é"}, "a": true} `))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":true,"z":{"x":"é","y":null}}`, string(canon))
+	canon, err = CanonicalizeJSON([]byte(`[{"a":[]},[1,{"b":{}}]]`))
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"a":[]},[1,{"b":{}}]]`, string(canon))
+
+	// The duplicate keys and invalid UTF-8 are not normalized away
+	_, err = CanonicalizeJSON([]byte(`{"a":1,"a":2}`))
+	assert.Equal(t, errJSONDuplicateKey, err)
+	_, err = CanonicalizeJSON([]byte(`{"b":{"a":1,"a":2}}`))
+	assert.Equal(t, errJSONDuplicateKey, err)
+	_, err = CanonicalizeJSON([]byte("{\"a\":\"\xff\"}"))
+	assert.Equal(t, errJSONInvalidUTF8, err)
+	mac, err = SignJSON(canonical, []byte(`{"a":2}`))
+	if assert.NoError(t, err) {
+		_, err = VerifyJSON(canonical, []byte(`{"a":1,"a":2}`), mac)
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+	mac, err = SignJSON(canonical, []byte(`{"a":"\ufffd"}`))
+	if assert.NoError(t, err) {
+		_, err = VerifyJSON(canonical, []byte("{\"a\":\"\xff\"}"), mac)
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+}
@@ -0,0 +1,186 @@
+package crypto
+
+import (
+	"errors"
+	"sync"
+)
+
+// DefaultKeyRingRetention is the number of keys kept by a KeyRing when its
+// retention is not set.
+const DefaultKeyRingRetention = 3
+
+// maxKeyRingConfigs is the maximal number of configs given to Encode and
+// Decode whose clones for the keys of the ring are cached.
+const maxKeyRingConfigs = 8
+
+// KeyRing manages the rotation of the keys of a MACConfig. The messages are
+// always signed with the newest key, and verified with any of the keys of the
+// ring, so the messages signed before a rotation stay valid until their key
+// is dropped from the ring.
+//
+// A KeyRing can be used concurrently. The clones of the configs given to
+// Encode and Decode, with the keys of the ring, are cached until the next
+// rotation, so these configs must not be modified once used with the ring.
+type KeyRing struct {
+	mu        sync.RWMutex
+	keys      [][]byte
+	retention int
+
+	// configs are the clones of the configs given to Encode and Decode, for
+	// each key of the ring, from the newest to the oldest
+	cmu     sync.Mutex
+	configs map[*MACConfig][]*MACConfig
+}
+
+// NewKeyRing returns a KeyRing with the given keys, from the newest to the
+// oldest. At least one key must be given, and the keys are checked like by
+// Rotate.
+func NewKeyRing(keys ...[]byte) (*KeyRing, error) {
+	if len(keys) == 0 {
+		return nil, ErrMissingKey
+	}
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+	}
+	kr := &KeyRing{retention: DefaultKeyRingRetention}
+	for _, key := range keys {
+		kr.keys = append(kr.keys, cloneBytes(key))
+	}
+	kr.drop()
+	return kr, nil
+}
+
+// SetRetention sets the number of keys kept by the ring, including the newest
+// one, and drops the oldest keys if needed.
+func (kr *KeyRing) SetRetention(n int) error {
+	if n < 1 {
+		return errors.New("mac: the retention must be at least 1")
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.retention = n
+	kr.drop()
+	kr.reset()
+	return nil
+}
+
+// Rotate adds a new key to the ring, that will be used to sign the messages,
+// and drops the oldest keys past the retention.
+func (kr *KeyRing) Rotate(newKey []byte) error {
+	if err := checkKey(newKey); err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys = append([][]byte{cloneBytes(newKey)}, kr.keys...)
+	kr.drop()
+	kr.reset()
+	return nil
+}
+
+// Len returns the number of keys in the ring.
+func (kr *KeyRing) Len() int {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return len(kr.keys)
+}
+
+// Encode is the same as EncodeAuthMessage, with the newest key of the ring
+// instead of the key of the config. The Key, KeyFunc and Signer of the config
+// are ignored.
+func (kr *KeyRing) Encode(c *MACConfig, value []byte) ([]byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	configs, cached := kr.keyConfigs(c)
+	if !cached {
+		defer zeroConfigs(configs)
+	}
+	return EncodeAuthMessage(configs[0], value)
+}
+
+// Decode is the same as DecodeAuthMessage, but tries the keys of the ring,
+// from the newest to the oldest, until one of them verifies the message.
+func (kr *KeyRing) Decode(c *MACConfig, enc []byte) ([]byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	configs, cached := kr.keyConfigs(c)
+	if !cached {
+		defer zeroConfigs(configs)
+	}
+	for _, kc := range configs {
+		value, err := DecodeAuthMessage(kc, enc)
+		switch err {
+		case ErrMACInvalid:
+			continue
+		case ErrMACTruncated:
+			return nil, c.notify(enc, err)
+		}
+		return value, err
+	}
+	return nil, c.notify(enc, ErrMACInvalid)
+}
+
+// config returns a clone of the config, without the fields that would
+// override the keys of the ring. OnInvalid is only called once all the keys
+// have been tried.
+func (kr *KeyRing) config(c *MACConfig) *MACConfig {
+	kc := c.Clone()
+	kc.KeyFunc = nil
+	kc.Signer = nil
+	kc.OnInvalid = nil
+	return kc
+}
+
+// keyConfigs returns the clones of the config for the keys of the ring, from
+// the newest to the oldest, and if they are cached. The clones that are not
+// cached, when there are already too many configs cached, must be zeroized by
+// the caller after use. The read lock must be held, so that the cached clones
+// are not zeroized by a rotation while they are used.
+func (kr *KeyRing) keyConfigs(c *MACConfig) ([]*MACConfig, bool) {
+	kr.cmu.Lock()
+	defer kr.cmu.Unlock()
+	if configs, ok := kr.configs[c]; ok {
+		return configs, true
+	}
+	configs := make([]*MACConfig, len(kr.keys))
+	for i, key := range kr.keys {
+		kc := kr.config(c)
+		kc.Key = cloneBytes(key)
+		configs[i] = kc
+	}
+	if len(kr.configs) >= maxKeyRingConfigs {
+		return configs, false
+	}
+	if kr.configs == nil {
+		kr.configs = make(map[*MACConfig][]*MACConfig)
+	}
+	kr.configs[c] = configs
+	return configs, true
+}
+
+// reset zeroizes and drops the cached configs, after a change of the keys.
+// The lock must be held.
+func (kr *KeyRing) reset() {
+	for _, configs := range kr.configs {
+		zeroConfigs(configs)
+	}
+	kr.configs = nil
+}
+
+// zeroConfigs overwrites the keys of the configs, and of their caches, with
+// zeros.
+func zeroConfigs(configs []*MACConfig) {
+	for _, kc := range configs {
+		kc.Zeroize()
+	}
+}
+
+// drop removes the keys past the retention. The lock must be held.
+func (kr *KeyRing) drop() {
+	for len(kr.keys) > kr.retention {
+		zeroBytes(kr.keys[len(kr.keys)-1])
+		kr.keys = kr.keys[:len(kr.keys)-1]
+	}
+}
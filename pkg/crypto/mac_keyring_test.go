@@ -0,0 +1,157 @@
+package crypto
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRing(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{Name: "ring"}
+	k1 := []byte("0123456789012345")
+	k2 := []byte("1234567890123456")
+	k3 := []byte("2345678901234567")
+
+	kr, err := NewKeyRing(k1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, kr.SetRetention(2)) {
+		return
+	}
+	before, err := kr.Encode(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// A message signed before the rotation is still valid after
+	if !assert.NoError(t, kr.Rotate(k2)) {
+		return
+	}
+	after, err := kr.Encode(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, enc := range [][]byte{before, after} {
+		v, err := kr.Decode(o, enc)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, value, v)
+	}
+	_, err = DecodeAuthMessage(&MACConfig{Key: k2, Name: "ring"}, after)
+	assert.NoError(t, err)
+	_, err = DecodeAuthMessage(&MACConfig{Key: k1, Name: "ring"}, after)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// Until its key is dropped
+	if !assert.NoError(t, kr.Rotate(k3)) {
+		return
+	}
+	assert.Equal(t, 2, kr.Len())
+	_, err = kr.Decode(o, before)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = kr.Decode(o, after)
+	assert.NoError(t, err)
+
+	// The other errors are returned as is
+	expired := o.Clone()
+	expired.MaxAge = 60
+	expired.Clock = func() int64 { return Timestamp() + 3600 }
+	_, err = kr.Decode(expired, after)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// The clones of the config for the keys are built once, and zeroized on
+	// rotation
+	configs := kr.configs[o]
+	if assert.Len(t, configs, 2) {
+		_, err = kr.Decode(o, after)
+		assert.NoError(t, err)
+		assert.Equal(t, configs, kr.configs[o])
+		assert.Equal(t, k3, configs[0].Key)
+		assert.NoError(t, kr.Rotate(k1))
+		assert.Nil(t, kr.configs)
+		assert.Nil(t, configs[0].Key)
+		assert.Nil(t, configs[0].cache.Load())
+	}
+
+	// The keys given to the ring are copied
+	assert.Equal(t, []byte("0123456789012345"), k1)
+
+	_, err = NewKeyRing()
+	assert.Equal(t, ErrMissingKey, err)
+	_, err = NewKeyRing(k1, []byte("short"))
+	assert.Equal(t, ErrKeyTooShort, err)
+	_, err = NewKeyRing([]byte("aaaaaaaaaaaaaaaa"))
+	assert.Equal(t, ErrWeakKey, err)
+	assert.Equal(t, ErrKeyTooShort, kr.Rotate([]byte("short")))
+	assert.Error(t, kr.SetRetention(0))
+}
+
+func TestKeyRingOnInvalid(t *testing.T) {
+	kr, err := NewKeyRing([]byte("0123456789012345"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, kr.Rotate([]byte("5432109876543210")))
+	calls := 0
+	c := &MACConfig{OnInvalid: func(enc []byte) { calls++ }}
+	encoded, err := kr.Encode(c, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = kr.Decode(c, encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, calls)
+
+	// Called once, after all the keys have been tried
+	dec := mustBase64Decode(encoded)
+	dec[len(dec)-1] ^= 1
+	_, err = kr.Decode(c, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+	assert.Equal(t, 1, calls)
+
+	// And once for a truncated message, without trying the other keys
+	_, err = kr.Decode(c, Base64Encode(dec[:10]))
+	assert.Equal(t, ErrMACTruncated, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestKeyRingConcurrentRotate(t *testing.T) {
+	kr, err := NewKeyRing(GenerateRandomBytes(32))
+	if !assert.NoError(t, err) {
+		return
+	}
+	o := &MACConfig{Name: "ring"}
+
+	// The keys dropped by a rotation are never seen wiped by the decoders:
+	// a message is either valid, or signed with a key that has been dropped
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			assert.NoError(t, kr.Rotate(GenerateRandomBytes(32)))
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				enc, err := kr.Encode(o, []byte("myvalue"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, err = kr.Decode(o, enc)
+				if err != ErrMACInvalid {
+					assert.NoError(t, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,87 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"hash"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// kmacMaxTagLen is the maximum size of a KMAC256 tag.
+const kmacMaxTagLen = 64
+
+// kmac is KMAC256, as defined in NIST SP 800-185, as a hash.Hash. The size of
+// the tag is part of the input, so a tag can't be truncated.
+type kmac struct {
+	sha3.ShakeHash
+	initBlock []byte
+	size      int
+}
+
+// newKMAC256 returns a KMAC256 with the given key, customization string and
+// tag size.
+func newKMAC256(key, customization []byte, size int) hash.Hash {
+	c := sha3.NewCShake256([]byte("KMAC"), customization)
+	k := &kmac{
+		ShakeHash: c,
+		initBlock: bytepad(encodeString(key), c.BlockSize()),
+		size:      size,
+	}
+	c.Write(k.initBlock)
+	return k
+}
+
+func (k *kmac) Size() int {
+	return k.size
+}
+
+func (k *kmac) Reset() {
+	k.ShakeHash.Reset()
+	k.ShakeHash.Write(k.initBlock)
+}
+
+func (k *kmac) Sum(b []byte) []byte {
+	dup := k.ShakeHash.Clone()
+	dup.Write(rightEncode(uint64(k.size) * 8))
+	tag := make([]byte, k.size)
+	dup.Read(tag)
+	return append(b, tag...)
+}
+
+// leftEncode is the left_encode function of NIST SP 800-185.
+func leftEncode(x uint64) []byte {
+	var buf [9]byte
+	binary.BigEndian.PutUint64(buf[1:], x)
+	i := 1
+	for i < 8 && buf[i] == 0 {
+		i++
+	}
+	buf[i-1] = byte(9 - i)
+	return buf[i-1:]
+}
+
+// rightEncode is the right_encode function of NIST SP 800-185.
+func rightEncode(x uint64) []byte {
+	var buf [9]byte
+	binary.BigEndian.PutUint64(buf[:8], x)
+	i := 0
+	for i < 7 && buf[i] == 0 {
+		i++
+	}
+	buf[8] = byte(8 - i)
+	return buf[i:]
+}
+
+// encodeString is the encode_string function of NIST SP 800-185.
+func encodeString(s []byte) []byte {
+	return append(leftEncode(uint64(len(s))*8), s...)
+}
+
+// bytepad is the bytepad function of NIST SP 800-185.
+func bytepad(x []byte, w int) []byte {
+	buf := append(leftEncode(uint64(w)), x...)
+	if pad := len(buf) % w; pad != 0 {
+		buf = append(buf, make([]byte, w-pad)...)
+	}
+	return buf
+}
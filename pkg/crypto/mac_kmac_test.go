@@ -0,0 +1,106 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKMAC256Vectors(t *testing.T) {
+	// Samples #4 and #6 of the NIST SP 800-185 examples
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(0x40 + i)
+	}
+	short := []byte{0x00, 0x01, 0x02, 0x03}
+	long := make([]byte, 200)
+	for i := range long {
+		long[i] = byte(i)
+	}
+
+	k := newKMAC256(key, []byte("My Tagged Application"), 64)
+	k.Write(short)
+	assert.Equal(t, "20c570c31346f703c9ac36c61c03cb64c3970d0cfc787e9b79599d273a68d2f7"+
+		"f69d4cc3de9d104a351689f27cf6f5951f0103f33f4f24871024d9c27773a8dd",
+		hex.EncodeToString(k.Sum(nil)))
+
+	k = newKMAC256(key, []byte("My Tagged Application"), 64)
+	k.Write(long)
+	assert.Equal(t, "b58618f71f92e1d56c1b8c55ddd7cd188b97b4ca4d99831eb2699a837da2e4d9"+
+		"70fbacfde50033aea585f1a2708510c32d07880801bd182898fe476876fc8965",
+		hex.EncodeToString(k.Sum(nil)))
+
+	// Reset goes back to the keyed state
+	k.Reset()
+	k.Write(short)
+	assert.Equal(t, "20c570c31346f703", hex.EncodeToString(k.Sum(nil))[:16])
+}
+
+func TestMACKMAC256(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{
+		Key:       []byte("0123456789012345"),
+		Name:      "kmac",
+		Algorithm: KMAC256,
+	}
+	hmacConfig := &MACConfig{Key: o.Key, Name: "kmac"}
+
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, mustBase64Decode(encoded), 11+len(value)+32)
+	v, err := DecodeAuthMessage(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+	_, err = DecodeAuthMessage(hmacConfig, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	dec := mustBase64Decode(encoded)
+	for i := range dec {
+		dec[i] ^= 1
+		_, err = DecodeAuthMessage(o, Base64Encode(dec))
+		assert.Error(t, err)
+		dec[i] ^= 1
+	}
+
+	// The name is the customization string
+	input := []byte("input")
+	tag1 := newKMAC256(o.Key, []byte("kmac"), 32)
+	tag1.Write(input)
+	tag2 := newKMAC256(o.Key, []byte("other"), 32)
+	tag2.Write(input)
+	assert.NotEqual(t, tag1.Sum(nil), tag2.Sum(nil))
+	_, err = DecodeAuthMessage(&MACConfig{Key: o.Key, Name: "other", Algorithm: KMAC256}, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The size of the tag is part of the input, so it can't be truncated
+	o.TagLen = 64
+	long, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, mustBase64Decode(long), 11+len(value)+64)
+	o.TagLen = 16
+	_, err = DecodeAuthMessage(o, long)
+	assert.Equal(t, ErrMACInvalid, err)
+	o.TagLen = 65
+	assert.Error(t, o.Validate())
+
+	// The streams use KMAC256 too
+	o.TagLen = 0
+	tag, err := SignReader(o, bytes.NewReader(value))
+	if !assert.NoError(t, err) {
+		return
+	}
+	hmacTag, err := SignReader(hmacConfig, bytes.NewReader(value))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, tag, 32)
+	assert.NotEqual(t, hmacTag, tag)
+}
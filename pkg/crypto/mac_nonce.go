@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"sync"
+)
+
+const nonceLen = 16
+
+// NonceStore keeps track of the nonces of the single-use messages that have
+// already been used.
+//
+// Remember is called after Seen has returned false. To prevent two concurrent
+// uses of the same message, Remember should return ErrMACReplayed if the
+// nonce has been remembered in the meantime.
+type NonceStore interface {
+	// Seen returns true if the nonce has already been remembered.
+	Seen(nonce []byte) (bool, error)
+	// Remember stores the nonce for ttl seconds, or forever if ttl is 0.
+	Remember(nonce []byte, ttl int64) error
+}
+
+// EncodeSingleUse is the same as EncodeAuthMessage, but for a message that
+// can be decoded only once with DecodeSingleUse. A random nonce is embedded
+// in the message, to recognize it when it is replayed.
+//
+// The single-use messages are bound to their kind in the MAC: they can't be
+// decoded with DecodeAuthMessage, and the other messages can't be decoded
+// with DecodeSingleUse.
+func EncodeSingleUse(c *MACConfig, value []byte) ([]byte, error) {
+	nonce, err := c.randomBytes(nonceLen)
+	if err != nil {
+		return nil, err
+	}
+	blob := make([]byte, nonceLen+len(value))
+	copy(blob, nonce)
+	copy(blob[nonceLen:], value)
+	return encodeAuthMessage(c, blob, c.now(), messageOptions{domain: macDomainSingleUse})
+}
+
+// DecodeSingleUse verifies a message returned by EncodeSingleUse, and checks
+// in the store that it has not already been used. The nonce of the message is
+// then remembered until the message expires, and ErrMACReplayed is returned
+// on the next uses.
+func DecodeSingleUse(c *MACConfig, store NonceStore, enc []byte) ([]byte, error) {
+	blob, issuedAt, err := decodeAuthMessage(c, enc, nil, messageOptions{domain: macDomainSingleUse})
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < nonceLen {
+		return nil, ErrMACInvalid
+	}
+	nonce, value := blob[:nonceLen], blob[nonceLen:]
+
+	seen, err := store.Seen(nonce)
+	if err != nil {
+		return nil, err
+	}
+	if seen {
+		return nil, ErrMACReplayed
+	}
+
+	// The nonce needs to be remembered only while the message can be decoded
+	var ttl int64
+	if maxAge := c.epochMaxAge(c.purposeMaxAge(c.Purpose)); maxAge != 0 {
+		ttl = issuedAt + maxAge + c.MaxSkew + c.ExpiryGrace - c.now() + 1
+		ttl = Seconds.convert(ttl, c.TimeUnit, true)
+	}
+	if err = store.Remember(nonce, ttl); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// MemoryNonceStore is an in-memory implementation of NonceStore. The nonces
+// are evicted once their ttl has expired.
+type MemoryNonceStore struct {
+	// Clock returns the current timestamp, in seconds. It defaults to
+	// Timestamp.
+	Clock func() int64
+
+	mu     sync.Mutex
+	nonces map[string]int64
+	sweep  int64
+}
+
+// NewMemoryNonceStore returns a new empty MemoryNonceStore.
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{nonces: make(map[string]int64)}
+}
+
+func (s *MemoryNonceStore) now() int64 {
+	if s.Clock == nil {
+		return Timestamp()
+	}
+	return s.Clock()
+}
+
+// Seen implements NonceStore.
+func (s *MemoryNonceStore) Seen(nonce []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seen(nonce), nil
+}
+
+// Remember implements NonceStore.
+func (s *MemoryNonceStore) Remember(nonce []byte, ttl int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen(nonce) {
+		return ErrMACReplayed
+	}
+	now := s.now()
+	if now >= s.sweep {
+		s.evict(now)
+	}
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = now + ttl
+	}
+	s.nonces[string(nonce)] = expiresAt
+	return nil
+}
+
+// Len returns the number of nonces in the store.
+func (s *MemoryNonceStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.nonces)
+}
+
+func (s *MemoryNonceStore) seen(nonce []byte) bool {
+	expiresAt, ok := s.nonces[string(nonce)]
+	return ok && (expiresAt == 0 || expiresAt > s.now())
+}
+
+// evict removes the expired nonces. It is called at most once per minute.
+func (s *MemoryNonceStore) evict(now int64) {
+	for nonce, expiresAt := range s.nonces {
+		if expiresAt != 0 && expiresAt <= now {
+			delete(s.nonces, nonce)
+		}
+	}
+	s.sweep = now + 60
+}
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSingleUse(t *testing.T) {
+	var now int64 = 1000
+	clock := func() int64 { return now }
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		Name:   "reset",
+		MaxAge: 300,
+		Clock:  clock,
+	}
+	store := NewMemoryNonceStore()
+	store.Clock = clock
+
+	encoded, err := EncodeSingleUse(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	encoded2, err := EncodeSingleUse(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, encoded, encoded2)
+
+	v, err := DecodeSingleUse(o, store, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []byte("myvalue"), v)
+
+	// The second use is rejected
+	_, err = DecodeSingleUse(o, store, encoded)
+	assert.Equal(t, ErrMACReplayed, err)
+
+	// But another message for the same value can still be used
+	_, err = DecodeSingleUse(o, store, encoded2)
+	assert.NoError(t, err)
+
+	// Single-use messages are not regular messages
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+	regular, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeSingleUse(o, store, regular)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// Once the messages have expired, their nonces are evicted
+	now = 2000
+	_, err = DecodeSingleUse(o, store, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+	encoded3, err := EncodeSingleUse(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeSingleUse(o, store, encoded3)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	var now int64 = 1000
+	store := NewMemoryNonceStore()
+	store.Clock = func() int64 { return now }
+	nonce := []byte("nonce")
+
+	seen, err := store.Seen(nonce)
+	assert.NoError(t, err)
+	assert.False(t, seen)
+
+	assert.NoError(t, store.Remember(nonce, 10))
+	assert.Equal(t, ErrMACReplayed, store.Remember(nonce, 10))
+	seen, err = store.Seen(nonce)
+	assert.NoError(t, err)
+	assert.True(t, seen)
+
+	now = 1010
+	seen, err = store.Seen(nonce)
+	assert.NoError(t, err)
+	assert.False(t, seen)
+
+	assert.NoError(t, store.Remember([]byte("forever"), 0))
+	now = 1000000
+	seen, err = store.Seen([]byte("forever"))
+	assert.NoError(t, err)
+	assert.True(t, seen)
+}
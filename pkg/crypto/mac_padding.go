@@ -0,0 +1,63 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"math"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// padLenSize is the size of the length written before a padded value.
+const padLenSize = 4
+
+// padValue returns the value padded to padTo bytes with zeros, after its
+// length on 4 bytes. ErrMACTooLong is returned for a value longer than padTo.
+func padValue(value []byte, padTo int) ([]byte, error) {
+	if len(value) > padTo {
+		return nil, ErrMACTooLong
+	}
+	padded := make([]byte, padLenSize+padTo)
+	binary.BigEndian.PutUint32(padded, uint32(len(value)))
+	copy(padded[padLenSize:], value)
+	return padded, nil
+}
+
+// unpadValue returns the value of a padded value. The padding must only be
+// zeros, so that a value has only one padded form for a given size.
+func unpadValue(padded []byte) ([]byte, error) {
+	if len(padded) < padLenSize {
+		return nil, ErrMACInvalid
+	}
+	n := binary.BigEndian.Uint32(padded)
+	if uint64(n) > uint64(len(padded)-padLenSize) {
+		return nil, ErrMACInvalid
+	}
+	value := padded[padLenSize : padLenSize+int(n)]
+	for _, b := range padded[padLenSize+int(n):] {
+		if b != 0 {
+			return nil, ErrMACInvalid
+		}
+	}
+	return value, nil
+}
+
+// paddedLen returns the maximal length of the raw messages with a padded
+// value: the header with all its optional fields, like the ttl, the expiry
+// time and the salt, the padded value, and the MAC or, for EncryptAuthMessage,
+// the nonce and the tag of the AEAD.
+func (c *MACConfig) paddedLen() int {
+	opts := messageOptions{padded: true, ttl: 1, notAfter: 1}
+	var hdr macHeader
+	hdr.init(c, math.MaxInt64, opts)
+	overhead := c.macLen()
+	if c.Signer == nil {
+		nonceLen := 12
+		if c.AEAD == XChaCha20Poly1305 {
+			nonceLen = chacha20poly1305.NonceSizeX
+		}
+		if n := nonceLen + chacha20poly1305.Overhead; n > overhead {
+			overhead = n
+		}
+	}
+	return hdr.size() + padLenSize + c.PadTo + overhead
+}
@@ -0,0 +1,119 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMACPadTo(t *testing.T) {
+	o := &MACConfig{
+		Key:   []byte("0123456789012345"),
+		Name:  "padded",
+		PadTo: 32,
+	}
+	short, long := []byte("yes"), []byte("a much longer value, not a yes")
+
+	// The messages have the same length, and are decoded to their value
+	for _, encode := range []struct {
+		name   string
+		encode func(*MACConfig, []byte) ([]byte, error)
+		decode func(*MACConfig, []byte) ([]byte, error)
+	}{
+		{"message", EncodeAuthMessage, DecodeAuthMessage},
+		{"encrypted", EncryptAuthMessage, DecryptAuthMessage},
+	} {
+		a, err := encode.encode(o, short)
+		assert.NoError(t, err, encode.name)
+		b, err := encode.encode(o, long)
+		assert.NoError(t, err, encode.name)
+		empty, err := encode.encode(o, nil)
+		assert.NoError(t, err, encode.name)
+		assert.Equal(t, len(a), len(b), encode.name)
+		assert.Equal(t, len(a), len(empty), encode.name)
+
+		v, err := encode.decode(o, a)
+		assert.NoError(t, err, encode.name)
+		assert.Equal(t, short, v, encode.name)
+		v, err = encode.decode(o, b)
+		assert.NoError(t, err, encode.name)
+		assert.Equal(t, long, v, encode.name)
+		v, err = encode.decode(o, empty)
+		assert.NoError(t, err, encode.name)
+		assert.Equal(t, []byte{}, v, encode.name)
+
+		// The padded messages are decoded by the configs without PadTo
+		v, err = encode.decode(&MACConfig{Key: o.Key, Name: o.Name}, a)
+		assert.NoError(t, err, encode.name)
+		assert.Equal(t, short, v, encode.name)
+
+		// The values longer than PadTo are rejected
+		_, err = encode.encode(o, make([]byte, 33))
+		assert.Equal(t, ErrMACTooLong, err, encode.name)
+	}
+
+	// The padding is covered by the MAC, and must be canonical
+	enc, err := EncodeAuthMessage(o, short)
+	if assert.NoError(t, err) {
+		dec := mustBase64Decode(enc)
+		dec[len(dec)-o.macLen()-1] = 1
+		_, err = DecodeAuthMessage(o, Base64Encode(dec))
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+	for _, padded := range [][]byte{{0, 0, 0}, {0, 0, 0, 2, 'a'}, {0, 0, 0, 1, 'a', 1}, {0xff, 0xff, 0xff, 0xff}} {
+		_, err = unpadValue(padded)
+		assert.Equal(t, ErrMACInvalid, err, padded)
+	}
+	v, err := unpadValue([]byte{0, 0, 0, 1, 'a', 0, 0})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), v)
+
+	// Without compression, and with the time and MaxLen
+	c := o.Clone()
+	c.Compress = true
+	enc, err = EncodeAuthMessage(c, make([]byte, 32))
+	if assert.NoError(t, err) {
+		assert.Equal(t, byte(0), mustBase64Decode(enc)[1]&flagCompressed)
+	}
+	c.MaxLen = 50
+	assert.Error(t, c.Validate())
+	c.MaxLen = 128
+	assert.NoError(t, c.Validate())
+	c.MaxLen = 127
+	assert.Error(t, c.Validate())
+
+	// A config accepted by Validate can encode all the padded messages
+	b := &MACConfig{
+		Key:           o.Key,
+		PadTo:         100,
+		Purpose:       1,
+		Unpredictable: true,
+		AEAD:          XChaCha20Poly1305,
+	}
+	b.MaxLen = 188
+	assert.Error(t, b.Validate())
+	b.MaxLen = b.encodedLen(b.paddedLen())
+	if assert.NoError(t, b.Validate()) {
+		value := make([]byte, b.PadTo)
+		_, err = EncodeAuthMessage(b, value)
+		assert.NoError(t, err)
+		_, err = EncodeAuthMessageWithExpiry(b, value, 60)
+		assert.NoError(t, err)
+		_, err = EncodeAuthMessageUntil(b, value, b.now()+60)
+		assert.NoError(t, err)
+		_, err = EncryptAuthMessage(b, value)
+		assert.NoError(t, err)
+	}
+	b.MaxLen--
+	assert.Error(t, b.Validate())
+	c.PadTo = -1
+	assert.Error(t, c.Validate())
+
+	// The detached MACs are not padded
+	mac, err := SignDetached(o, short)
+	if assert.NoError(t, err) {
+		_, err = VerifyDetached(o, short, mac)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(0), mustBase64Decode(mac)[1]&flagExtended)
+	}
+}
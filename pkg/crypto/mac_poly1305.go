@@ -0,0 +1,65 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	poly1305NonceLen = chacha20poly1305.NonceSizeX
+	poly1305TagLen   = chacha20poly1305.Overhead
+)
+
+// newPoly1305 returns the XChaCha20-Poly1305 instance used to compute the
+// Poly1305 MACs, with a key derived from the given MAC key.
+//
+// The MAC is the tag of XChaCha20-Poly1305 for an empty plaintext, with the
+// MAC input as additional data: the one-time key of Poly1305 is derived from
+// the key and a random nonce of 24 bytes, that is safe to pick randomly.
+func newPoly1305(macKey []byte) cipher.AEAD {
+	key := make([]byte, chacha20poly1305.KeySize)
+	r := hkdf.New(sha256.New, macKey, nil, []byte("poly1305"))
+	if _, err := io.ReadFull(r, key); err != nil {
+		panic(err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// poly1305 returns the Poly1305 instance for the given key. It is cached for
+// the key of the config.
+func (c *MACConfig) poly1305(key []byte) cipher.AEAD {
+	if !bytes.Equal(key, c.Key) {
+		return newPoly1305(c.macKey(key))
+	}
+	return c.macCache().poly1305
+}
+
+// signPoly1305 returns a random nonce followed by the Poly1305 tag of the
+// input.
+func (c *MACConfig) signPoly1305(input []byte) ([]byte, error) {
+	nonce, err := c.randomBytes(poly1305NonceLen)
+	if err != nil {
+		return nil, err
+	}
+	return c.poly1305(c.Key).Seal(nonce, nonce, nil, input), nil
+}
+
+// verifyPoly1305 returns true if mac is a nonce followed by the Poly1305 tag
+// of the input.
+func (c *MACConfig) verifyPoly1305(key, input, mac []byte) bool {
+	if len(mac) != poly1305NonceLen+poly1305TagLen {
+		return false
+	}
+	nonce, tag := mac[:poly1305NonceLen], mac[poly1305NonceLen:]
+	_, err := c.poly1305(key).Open(nil, nonce, tag, input)
+	return err == nil
+}
@@ -0,0 +1,105 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMACPoly1305(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{
+		Key:       []byte("0123456789012345"),
+		Name:      "poly",
+		Algorithm: Poly1305,
+	}
+
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, mustBase64Decode(encoded), 11+len(value)+24+16)
+	v, err := DecodeAuthMessage(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	// Each message has its own random nonce
+	other, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, encoded, other)
+
+	dec := mustBase64Decode(encoded)
+	for i := range dec {
+		dec[i] ^= 1
+		_, err = DecodeAuthMessage(o, Base64Encode(dec))
+		assert.Error(t, err)
+		dec[i] ^= 1
+	}
+
+	_, err = DecodeAuthMessage(&MACConfig{Key: o.Key, Name: "poly"}, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecodeAuthMessage(&MACConfig{Key: o.Key, Name: "other", Algorithm: Poly1305}, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecodeAuthMessage(&MACConfig{Key: []byte("5432109876543210"), Name: "poly", Algorithm: Poly1305}, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// Key rotation with a KeyFunc
+	rotated := &MACConfig{
+		Key:       []byte("5432109876543210"),
+		Name:      "poly",
+		Algorithm: Poly1305,
+		KeyID:     []byte("new"),
+		KeyFunc: func(keyID []byte) ([]byte, error) {
+			if len(keyID) == 0 {
+				return o.Key, nil
+			}
+			return nil, ErrMissingKey
+		},
+	}
+	v, err = DecodeAuthMessage(rotated, encoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+
+	o.TagLen = 16
+	assert.Error(t, o.Validate())
+	o.TagLen = 0
+	_, err = SignReader(o, bytes.NewReader(value))
+	assert.Error(t, err)
+}
+
+// BenchmarkPoly1305 compares Poly1305 with HMAC-SHA256. With the derivation
+// of the one-time key, they are about as fast.
+func BenchmarkPoly1305(b *testing.B) {
+	value := GenerateRandomBytes(256)
+	for _, alg := range []struct {
+		name string
+		alg  MACAlgorithm
+	}{
+		{"hmac", HMAC},
+		{"poly1305", Poly1305},
+	} {
+		o := &MACConfig{
+			Key:       []byte("0123456789012345"),
+			Algorithm: alg.alg,
+		}
+		encoded, _ := EncodeAuthMessage(o, value)
+		b.Run(alg.name+"/encode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				EncodeAuthMessage(o, value)
+			}
+		})
+		b.Run(alg.name+"/decode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				DecodeAuthMessage(o, encoded)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package crypto
+
+import (
+	"sync"
+)
+
+// tokenIDLen is the size of the id of the revocable messages.
+const tokenIDLen = 16
+
+// RevocationChecker tells if the revocable messages have been revoked, from
+// their id.
+type RevocationChecker interface {
+	// Revoked returns true if the message with the given id has been revoked.
+	Revoked(id []byte) (bool, error)
+}
+
+// EncodeRevocable is the same as EncodeAuthMessage, but for a message that
+// can be revoked. A random id is embedded in the message and returned, so
+// that the caller can revoke the message later, for example on logout.
+//
+// The revocable messages are bound to their kind in the MAC: they can't be
+// decoded with DecodeAuthMessage, and the other messages can't be decoded
+// with DecodeRevocable.
+func EncodeRevocable(c *MACConfig, value []byte) (enc, id []byte, err error) {
+	if id, err = c.randomBytes(tokenIDLen); err != nil {
+		return nil, nil, err
+	}
+	blob := make([]byte, tokenIDLen+len(value))
+	copy(blob, id)
+	copy(blob[tokenIDLen:], value)
+	enc, err = encodeAuthMessage(c, blob, c.now(), messageOptions{domain: macDomainRevocable})
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, id, nil
+}
+
+// DecodeRevocable verifies a message returned by EncodeRevocable, and checks
+// with the checker that it has not been revoked. It returns the value and the
+// id of the message, or ErrMACRevoked if the message has been revoked.
+func DecodeRevocable(c *MACConfig, checker RevocationChecker, enc []byte) (value, id []byte, err error) {
+	blob, _, err := decodeAuthMessage(c, enc, nil, messageOptions{domain: macDomainRevocable})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(blob) < tokenIDLen {
+		return nil, nil, ErrMACInvalid
+	}
+	id, value = blob[:tokenIDLen], blob[tokenIDLen:]
+
+	revoked, err := checker.Revoked(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if revoked {
+		return nil, nil, ErrMACRevoked
+	}
+	return value, id, nil
+}
+
+// MemoryRevocationList is an in-memory implementation of RevocationChecker.
+// The ids are kept forever: it is meant for the tests, or for short-lived
+// processes.
+type MemoryRevocationList struct {
+	mu  sync.RWMutex
+	ids map[string]struct{}
+}
+
+// NewMemoryRevocationList returns a new empty MemoryRevocationList.
+func NewMemoryRevocationList() *MemoryRevocationList {
+	return &MemoryRevocationList{ids: make(map[string]struct{})}
+}
+
+// Revoke adds the id of a message to the list.
+func (l *MemoryRevocationList) Revoke(id []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ids[string(id)] = struct{}{}
+}
+
+// Revoked implements RevocationChecker.
+func (l *MemoryRevocationList) Revoked(id []byte) (bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.ids[string(id)]
+	return ok, nil
+}
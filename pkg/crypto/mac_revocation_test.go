@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingChecker struct{}
+
+func (failingChecker) Revoked(id []byte) (bool, error) {
+	return false, errors.New("unreachable")
+}
+
+func TestRevocable(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "session",
+	}
+	list := NewMemoryRevocationList()
+
+	enc, id, err := EncodeRevocable(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, id, 16)
+	other, otherID, err := EncodeRevocable(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, id, otherID)
+
+	v, decodedID, err := DecodeRevocable(o, list, enc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+	assert.Equal(t, id, decodedID)
+
+	// Revoke then reject
+	list.Revoke(decodedID)
+	_, _, err = DecodeRevocable(o, list, enc)
+	assert.Equal(t, ErrMACRevoked, err)
+	_, _, err = DecodeRevocable(o, list, other)
+	assert.NoError(t, err)
+
+	// The revocable messages are not the same as the other messages
+	_, err = DecodeAuthMessage(o, other)
+	assert.Equal(t, ErrMACInvalid, err)
+	plain, err := EncodeAuthMessage(o, append(make([]byte, 16), value...))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, err = DecodeRevocable(o, list, plain)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	_, _, err = DecodeRevocable(o, failingChecker{}, other)
+	assert.EqualError(t, err, "unreachable")
+}
@@ -0,0 +1,125 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+)
+
+// The usages of the keys derived for the secure values.
+const (
+	secureEncryptionInfo = "secure value encryption"
+	secureMACInfo        = "secure value mac"
+)
+
+// newSecureStream returns the cipher used to encrypt the secure values, which
+// is AES-256 in CTR mode. It is a variable so that the tests can check when
+// the values are decrypted.
+var newSecureStream = func(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+// EncodeSecureValue is the same as EncodeAuthMessage, but the value is
+// encrypted and then MACed, with two independent keys derived from the key of
+// the config with HKDF-SHA256: one for AES-256-CTR, and one for the HMAC.
+//
+// The MAC covers the random IV, the ciphertext, the name and the header of
+// the message, and DecodeSecureValue only decrypts a value after its MAC has
+// been verified. Unlike EncryptAuthMessage, the key used to check the
+// integrity is never used for the encryption.
+//
+// The value is not compressed, even with Compress, as the compression would
+// leak information about the value through the size of the message. The key
+// is needed for the encryption, so a config with a Signer can't be used.
+//
+// The secure values are bound to their kind in the MAC: they can't be decoded
+// with DecodeAuthMessage, and the other messages can't be decoded with
+// DecodeSecureValue.
+func EncodeSecureValue(c *MACConfig, value []byte) ([]byte, error) {
+	sc, err := c.secureConfig()
+	if err != nil {
+		return nil, err
+	}
+	encKey, err := deriveKey(c.Key, secureEncryptionInfo)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := c.randomBytes(aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := newSecureStream(encKey, iv)
+	if err != nil {
+		return nil, err
+	}
+	blob := make([]byte, aes.BlockSize+len(value))
+	copy(blob, iv)
+	stream.XORKeyStream(blob[aes.BlockSize:], value)
+	return encodeAuthMessage(sc, blob, c.now(), messageOptions{domain: macDomainSecure})
+}
+
+// DecodeSecureValue verifies a message returned by EncodeSecureValue, and
+// returns its decrypted value. A message with a bad MAC is rejected with
+// ErrMACInvalid before any decryption.
+func DecodeSecureValue(c *MACConfig, enc []byte) ([]byte, error) {
+	sc, err := c.secureConfig()
+	if err != nil {
+		return nil, err
+	}
+	blob, hdr, err := decodeMessage(sc, enc, nil, messageOptions{domain: macDomainSecure})
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < aes.BlockSize {
+		return nil, ErrMACInvalid
+	}
+
+	key, err := c.key(hdr.keyID)
+	if err != nil {
+		return nil, ErrMACInvalid
+	}
+	encKey, err := deriveKey(key, secureEncryptionInfo)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := newSecureStream(encKey, blob[:aes.BlockSize])
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, len(blob)-aes.BlockSize)
+	stream.XORKeyStream(value, blob[aes.BlockSize:])
+	return value, nil
+}
+
+// secureConfig returns a copy of the config used for the MAC of the secure
+// values, with the keys replaced by the keys derived for the MAC.
+func (c *MACConfig) secureConfig() (*MACConfig, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Signer != nil {
+		return nil, errSignerUnsupported
+	}
+
+	sc := c.Clone()
+	sc.Compress = false
+	sc.PadTo = 0
+	key, err := deriveKey(c.Key, secureMACInfo)
+	if err != nil {
+		return nil, err
+	}
+	sc.Key = key
+	if c.KeyFunc != nil {
+		sc.KeyFunc = func(keyID []byte) ([]byte, error) {
+			key, err := c.key(keyID)
+			if err != nil {
+				return nil, err
+			}
+			return deriveKey(key, secureMACInfo)
+		}
+	}
+	return sc, nil
+}
@@ -0,0 +1,141 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecureValue(t *testing.T) {
+	value := []byte("me@example.org")
+	now := int64(1000000000)
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		Name:   "session",
+		MaxAge: 3600,
+		Clock:  func() int64 { return now },
+	}
+
+	// Count the decryptions
+	decryptions := 0
+	newStream := newSecureStream
+	defer func() { newSecureStream = newStream }()
+	newSecureStream = func(key, iv []byte) (cipher.Stream, error) {
+		decryptions++
+		return newStream(key, iv)
+	}
+
+	enc, err := EncodeSecureValue(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	decryptions = 0
+	v, err := DecodeSecureValue(o, enc)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+	assert.Equal(t, 1, decryptions)
+
+	// The plaintext can't be read from the message, and the IV is random
+	dec := mustBase64Decode(enc)
+	assert.False(t, bytes.Contains(dec, value))
+	enc2, err := EncodeSecureValue(o, value)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, enc, enc2)
+	}
+
+	// The tampered messages are rejected before any decryption
+	decryptions = 0
+	for i := range dec {
+		tampered := append([]byte(nil), dec...)
+		tampered[i] ^= 1
+		_, err = DecodeSecureValue(o, Base64Encode(tampered))
+		assert.Error(t, err)
+	}
+	_, err = DecodeSecureValue(o, Base64Encode(dec[:len(dec)-1]))
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecodeSecureValue(o.WithName("other"), enc)
+	assert.Equal(t, ErrMACInvalid, err)
+	assert.Equal(t, 0, decryptions)
+
+	// The time is covered by the MAC
+	now += 3601
+	_, err = DecodeSecureValue(o, enc)
+	assert.Equal(t, ErrMACExpired, err)
+	now -= 3601
+	assert.Equal(t, 0, decryptions)
+
+	// The empty values
+	enc, err = EncodeSecureValue(o, nil)
+	if assert.NoError(t, err) {
+		v, err = DecodeSecureValue(o, enc)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{}, v)
+	}
+}
+
+func TestSecureValueKeys(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "session",
+	}
+
+	// The outer MAC is not computed with the master key
+	iv := make([]byte, 16)
+	forged, err := encodeAuthMessage(o, append(iv, value...), o.now(), messageOptions{domain: macDomainSecure})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeSecureValue(o, forged)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The secure values and the other messages can't be mixed
+	enc, err := EncodeSecureValue(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(o, enc)
+	assert.Equal(t, ErrMACInvalid, err)
+	msg, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeSecureValue(o, msg)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The keys are derived from the keys returned by KeyFunc
+	oldKey := []byte("0123456789012345")
+	newKey := []byte("5432109876543210")
+	keyFunc := func(keyID []byte) ([]byte, error) {
+		switch string(keyID) {
+		case "1":
+			return oldKey, nil
+		case "2":
+			return newKey, nil
+		}
+		return nil, errors.New("unknown key")
+	}
+	before := &MACConfig{Key: oldKey, KeyID: []byte("1"), KeyFunc: keyFunc}
+	after := &MACConfig{Key: newKey, KeyID: []byte("2"), KeyFunc: keyFunc}
+	enc, err = EncodeSecureValue(before, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeSecureValue(after, enc)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+	_, err = DecodeSecureValue(&MACConfig{Key: newKey}, enc)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The key is needed for the encryption
+	signer := &MACConfig{Signer: &remoteSigner{key: oldKey}}
+	_, err = EncodeSecureValue(signer, value)
+	assert.Equal(t, errSignerUnsupported, err)
+	_, err = DecodeSecureValue(signer, enc)
+	assert.Equal(t, errSignerUnsupported, err)
+}
@@ -0,0 +1,106 @@
+package crypto
+
+import (
+	"crypto"
+	"errors"
+)
+
+// errSignerUnsupported is used by the functions that need the key itself, and
+// can't be used with a config that has a signer.
+var errSignerUnsupported = errors.New("mac: not supported with a signer")
+
+// MACSigner computes the MACs of the messages for a MACConfig. It allows to
+// keep the key out of the process memory, in a HSM or a KMS. A signer must be
+// safe for concurrent use.
+type MACSigner interface {
+	// Sign returns the tag of the input, that must be TagLen bytes long.
+	Sign(input []byte) ([]byte, error)
+	// TagLen returns the size of the tags, that must be at least 16 bytes.
+	TagLen() int
+}
+
+// MACVerifier can be implemented by a MACSigner that verifies a tag by
+// itself. When a signer does not implement it, the tag is verified by
+// comparing it, in constant time, with the one returned by Sign.
+type MACVerifier interface {
+	// Verify returns true if the tag is the tag of the input.
+	Verify(input, tag []byte) (bool, error)
+}
+
+// HMACSigner is the in-process HMAC implementation of MACSigner and
+// MACVerifier. A config with a HMACSigner gives the same messages as a config
+// with the same Key and Hash.
+type HMACSigner struct {
+	Key  []byte
+	Hash crypto.Hash
+}
+
+// NewHMACSigner returns a HMACSigner for the given hash function and key.
+func NewHMACSigner(h crypto.Hash, key []byte) *HMACSigner {
+	return &HMACSigner{Key: key, Hash: h}
+}
+
+// Sign is part of the MACSigner interface.
+func (s *HMACSigner) Sign(input []byte) ([]byte, error) {
+	return createMAC(s.Hash, s.Key, input), nil
+}
+
+// TagLen is part of the MACSigner interface.
+func (s *HMACSigner) TagLen() int {
+	return s.Hash.Size()
+}
+
+// Verify is part of the MACVerifier interface.
+func (s *HMACSigner) Verify(input, tag []byte) (bool, error) {
+	return verifyMAC(s.Hash, s.Key, input, tag), nil
+}
+
+// sign returns the tag of the input, with the signer of the config if any,
+// or with Key.
+func (c *MACConfig) sign(input []byte) ([]byte, error) {
+	return c.signTo(nil, input)
+}
+
+// signTo is the same as sign, but the HMAC is computed in the capacity of
+// dst, to avoid an allocation when it is large enough.
+func (c *MACConfig) signTo(dst, input []byte) ([]byte, error) {
+	if c.Signer == nil {
+		if c.Algorithm == Poly1305 {
+			return c.signPoly1305(input)
+		}
+		return c.appendSum(dst[:0], c.Key, input)[:c.macLen()], nil
+	}
+	tag, err := c.Signer.Sign(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(tag) != c.Signer.TagLen() {
+		return nil, errors.New("mac: the signer returned a tag of a wrong size")
+	}
+	return tag, nil
+}
+
+// verify returns true if mac is the tag of the input, with the signer of the
+// config if any, or with the given key.
+func (c *MACConfig) verify(key, input, mac []byte) (bool, error) {
+	return c.verifyTo(nil, key, input, mac)
+}
+
+// verifyTo is the same as verify, but the HMAC is computed in the capacity of
+// dst, to avoid an allocation when it is large enough.
+func (c *MACConfig) verifyTo(dst, key, input, mac []byte) (bool, error) {
+	if c.Signer == nil {
+		if c.Algorithm == Poly1305 {
+			return c.verifyPoly1305(key, input, mac), nil
+		}
+		return equalMAC(mac, c.appendSum(dst[:0], key, input)), nil
+	}
+	if v, ok := c.Signer.(MACVerifier); ok {
+		return v.Verify(input, mac)
+	}
+	tag, err := c.Signer.Sign(input)
+	if err != nil {
+		return false, err
+	}
+	return equalMAC(mac, tag), nil
+}
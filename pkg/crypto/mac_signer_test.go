@@ -0,0 +1,153 @@
+package crypto
+
+import (
+	"crypto"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// remoteSigner simulates a signer with a key kept in a KMS.
+type remoteSigner struct {
+	key    []byte
+	calls  int32
+	err    error
+	tagLen int
+}
+
+func (s *remoteSigner) Sign(input []byte) ([]byte, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return createMAC(crypto.SHA512, s.key, input)[:24], nil
+}
+
+func (s *remoteSigner) TagLen() int {
+	if s.tagLen != 0 {
+		return s.tagLen
+	}
+	return 24
+}
+
+func TestMACSigner(t *testing.T) {
+	value := []byte("myvalue")
+	signer := &remoteSigner{key: []byte("kept in the kms!")}
+	o := &MACConfig{
+		Name:   "signer",
+		Signer: signer,
+	}
+	assert.NoError(t, o.Validate())
+
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 1, signer.calls)
+	assert.Len(t, mustBase64Decode(encoded), 11+len(value)+24)
+	v, err := DecodeAuthMessage(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+	assert.EqualValues(t, 2, signer.calls)
+
+	dec := mustBase64Decode(encoded)
+	dec[len(dec)-1] ^= 1
+	_, err = DecodeAuthMessage(o, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The errors of the signer are returned
+	signer.err = errors.New("kms is unreachable")
+	_, err = EncodeAuthMessage(o, value)
+	assert.Equal(t, signer.err, err)
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, signer.err, err)
+	signer.err = nil
+
+	// The tags of the signer must be long enough, and of the announced size
+	signer.tagLen = 8
+	assert.Error(t, o.Validate())
+	signer.tagLen = 32
+	_, err = EncodeAuthMessage(o, value)
+	assert.Error(t, err)
+
+	// The key is needed for the encryption and the streams
+	_, err = EncryptAuthMessage(o, value)
+	assert.Error(t, err)
+	_, err = SignReader(o, strings.NewReader("myvalue"))
+	assert.Error(t, err)
+}
+
+func TestHMACSigner(t *testing.T) {
+	value := []byte("myvalue")
+	now := Timestamp()
+	withKey := &MACConfig{
+		Key:   []byte("0123456789012345"),
+		Name:  "signer",
+		Clock: func() int64 { return now },
+	}
+	withSigner := &MACConfig{
+		Name:   "signer",
+		Clock:  withKey.Clock,
+		Signer: NewHMACSigner(crypto.SHA256, withKey.Key),
+	}
+
+	// The default signer gives the same messages as the key
+	enc1, err := EncodeAuthMessage(withKey, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	enc2, err := EncodeAuthMessage(withSigner, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, enc1, enc2)
+	v, err := DecodeAuthMessage(withSigner, enc1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	dec := mustBase64Decode(enc1)
+	dec[len(dec)-1] ^= 1
+	_, err = DecodeAuthMessage(withSigner, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+}
+
+func TestMACConstantTimeReject(t *testing.T) {
+	signer := &remoteSigner{key: []byte("kept in the kms!")}
+	o := &MACConfig{Signer: signer}
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	dec := mustBase64Decode(encoded)
+
+	// Whatever the position of the tampering, or the truncation, the message
+	// is rejected after at most one call to the signer: the malformed
+	// messages are not sent to it for a dummy verification. Only the
+	// messages too short to contain a header and a MAC are rejected before,
+	// from their length.
+	for i := 0; i < len(dec); i++ {
+		dec[i] ^= 0xff
+		signer.calls = 0
+		_, err = DecodeAuthMessage(o, Base64Encode(dec))
+		assert.Error(t, err)
+		assert.True(t, signer.calls <= 1, "tampered at %d", i)
+		dec[i] ^= 0xff
+
+		signer.calls = 0
+		_, err = DecodeAuthMessage(o, Base64Encode(dec[:i]))
+		if i < o.minLen() {
+			assert.Equal(t, ErrMACTruncated, err)
+			assert.EqualValues(t, 0, signer.calls, "truncated at %d", i)
+		} else {
+			assert.Contains(t, []error{ErrMACInvalid, ErrMACTruncated}, err)
+			assert.True(t, signer.calls <= 1, "truncated at %d", i)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+)
+
+// sivLen is the size of the synthetic IV of AES-SIV, that is also its tag.
+const sivLen = aes.BlockSize
+
+// EncryptDeterministic is the same as EncryptAuthMessage, but the encryption
+// is deterministic: the same value, with the same config, always gives the
+// same message. It uses AES-SIV (RFC 5297), with two AES-256 keys derived from
+// the key of the config with HKDF-SHA256, and without any random nonce.
+//
+// It is meant for the values that must be looked up while encrypted, like an
+// email used as an index: the message can be computed from the value and
+// compared with the stored ones. The price is that the equality of the values
+// leaks, as anyone seeing two messages can tell if they have the same value.
+// It should only be used when this is acceptable, and EncryptAuthMessage
+// otherwise.
+//
+// Message format (name prefix is authenticated but removed from message):
+//
+//  <------------------- additional data ------------------->
+//                                             <---------- message ---------->
+//  | domain | name len |  name | aad len |  aad | header |      siv | ciphertext |
+//  | 1 byte |  4 bytes |  ---- | 4 bytes | ---- |   ---- | 16 bytes |       blob |
+//
+// The header is the same as for EncodeAuthMessage, but it never has a time
+// nor a salt, as they would make the messages different: MaxAge, CompactTime
+// and Unpredictable are ignored. The name, the purpose and the key id are
+// still authenticated. The key is needed for the encryption, so a config with
+// a Signer can't be used.
+func EncryptDeterministic(c *MACConfig, value []byte) ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Signer != nil {
+		return nil, errSignerUnsupported
+	}
+
+	s, err := newSIVFromKey(c.Key)
+	if err != nil {
+		return nil, err
+	}
+	opts := messageOptions{domain: macDomainSIV}
+	hdr, err := newMACHeader(c, 0, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the additional data
+	ad := new(bytes.Buffer)
+	opts.writePrefix(ad, c)
+	hdr.write(ad)
+
+	// Create the message
+	buf := bytes.NewBuffer(make([]byte, 0, hdr.size()+sivLen+len(value)))
+	hdr.write(buf)
+	msg := s.seal(buf.Bytes(), value, ad.Bytes())
+
+	// Check length
+	if c.encodedLen(len(msg)) > c.maxLen() || len(msg) > c.maxDecodedLen() {
+		return nil, ErrMACTooLong
+	}
+
+	// Encode to base64
+	return c.appendEncode(nil, msg), nil
+}
+
+// DecryptDeterministic decrypts and verifies a message returned by
+// EncryptDeterministic, and returns its value.
+func DecryptDeterministic(c *MACConfig, enc []byte) ([]byte, error) {
+	value, err := decryptDeterministic(c, enc)
+	return value, c.notify(enc, err)
+}
+
+// decryptDeterministic is DecryptDeterministic, without the hooks.
+func decryptDeterministic(c *MACConfig, enc []byte) ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Signer != nil {
+		return nil, errSignerUnsupported
+	}
+
+	// Check length
+	if len(enc) > c.maxLen() {
+		return nil, ErrMACTooLong
+	}
+
+	// Decode from base64
+	dec, err := c.decode(enc)
+	if err != nil {
+		return nil, ErrMACInvalid
+	}
+	if len(dec) > c.maxDecodedLen() {
+		return nil, ErrMACTooLong
+	}
+
+	// Read the header and resolve the key
+	hdr, hdrLen, err := readMACHeader(dec)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.flags&flagNoTime == 0 {
+		return nil, ErrMACInvalid
+	}
+	if len(dec) < hdrLen+sivLen {
+		return nil, ErrMACTruncated
+	}
+	key, err := c.key(hdr.keyID)
+	if err != nil {
+		return nil, ErrMACInvalid
+	}
+	s, err := newSIVFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decrypt and verify the message
+	opts := messageOptions{domain: macDomainSIV}
+	ad := new(bytes.Buffer)
+	opts.writePrefix(ad, c)
+	ad.Write(dec[:hdrLen])
+	value, err := s.open(nil, dec[hdrLen:], ad.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the purpose
+	if hdr.purpose != c.Purpose {
+		return nil, ErrMACWrongPurpose
+	}
+	return value, nil
+}
+
+// siv is AES-SIV, as defined by RFC 5297.
+type siv struct {
+	mac cipher.Block
+	ctr cipher.Block
+}
+
+// newSIV returns AES-SIV for the given key, whose first half is the key of
+// S2V, and the second half the key of CTR.
+func newSIV(key []byte) (*siv, error) {
+	mac, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+	return &siv{mac: mac, ctr: ctr}, nil
+}
+
+// newSIVFromKey returns AES-SIV with the keys derived from the given key.
+func newSIVFromKey(key []byte) (*siv, error) {
+	macKey, err := deriveKey(key, "aes-siv s2v")
+	if err != nil {
+		return nil, err
+	}
+	ctrKey, err := deriveKey(key, "aes-siv ctr")
+	if err != nil {
+		return nil, err
+	}
+	return newSIV(append(macKey, ctrKey...))
+}
+
+// seal appends the synthetic IV and the encrypted plaintext to dst.
+func (s *siv) seal(dst, plaintext []byte, ad ...[]byte) []byte {
+	v := s.s2v(plaintext, ad)
+	dst = append(dst, v...)
+	ret := append(dst, plaintext...)
+	s.xorKeyStream(ret[len(dst):], ret[len(dst):], v)
+	return ret
+}
+
+// open decrypts and verifies a ciphertext returned by seal, and appends the
+// plaintext to dst.
+func (s *siv) open(dst, ciphertext []byte, ad ...[]byte) ([]byte, error) {
+	if len(ciphertext) < sivLen {
+		return nil, ErrMACInvalid
+	}
+	v := ciphertext[:sivLen]
+	ret := append(dst, ciphertext[sivLen:]...)
+	plaintext := ret[len(dst):]
+	s.xorKeyStream(plaintext, plaintext, v)
+	if !ConstantTimeEqual(v, s.s2v(plaintext, ad)) {
+		zeroBytes(plaintext)
+		return nil, ErrMACInvalid
+	}
+	if ret == nil {
+		ret = []byte{}
+	}
+	return ret, nil
+}
+
+// xorKeyStream encrypts src in dst with AES-CTR, from the synthetic IV whose
+// 31st and 63rd bits are cleared.
+func (s *siv) xorKeyStream(dst, src, v []byte) {
+	var iv [sivLen]byte
+	copy(iv[:], v)
+	iv[8] &= 0x7f
+	iv[12] &= 0x7f
+	cipher.NewCTR(s.ctr, iv[:]).XORKeyStream(dst, src)
+}
+
+// s2v is the S2V function of RFC 5297, for the additional data and the
+// plaintext.
+func (s *siv) s2v(plaintext []byte, ad [][]byte) []byte {
+	var zero [sivLen]byte
+	d := s.cmac(zero[:])
+	for _, a := range ad {
+		dbl(d)
+		subtle.XORBytes(d, d, s.cmac(a))
+	}
+	var t []byte
+	if len(plaintext) >= sivLen {
+		t = append([]byte(nil), plaintext...)
+		subtle.XORBytes(t[len(t)-sivLen:], t[len(t)-sivLen:], d)
+	} else {
+		dbl(d)
+		t = make([]byte, sivLen)
+		copy(t, plaintext)
+		t[len(plaintext)] = 0x80
+		subtle.XORBytes(t, t, d)
+	}
+	return s.cmac(t)
+}
+
+// cmac returns the AES-CMAC (RFC 4493) of the message, with the S2V key.
+func (s *siv) cmac(msg []byte) []byte {
+	var k [sivLen]byte
+	s.mac.Encrypt(k[:], k[:])
+	dbl(k[:])
+
+	// The last block is padded when it is not complete, and is xored with
+	// the first subkey if it is complete, or with the second one if not
+	var last [sivLen]byte
+	n := (len(msg) + sivLen - 1) / sivLen * sivLen
+	if n == 0 || n != len(msg) {
+		if n == 0 {
+			n = sivLen
+		}
+		dbl(k[:])
+		copy(last[:], msg[n-sivLen:])
+		last[len(msg)-(n-sivLen)] = 0x80
+	} else {
+		copy(last[:], msg[n-sivLen:])
+	}
+	subtle.XORBytes(last[:], last[:], k[:])
+
+	var mac [sivLen]byte
+	for i := 0; i+sivLen < n; i += sivLen {
+		subtle.XORBytes(mac[:], mac[:], msg[i:i+sivLen])
+		s.mac.Encrypt(mac[:], mac[:])
+	}
+	subtle.XORBytes(mac[:], mac[:], last[:])
+	s.mac.Encrypt(mac[:], mac[:])
+	return mac[:]
+}
+
+// dbl multiplies the block by x in GF(2^128), in place.
+func dbl(b []byte) {
+	carry := b[0] >> 7
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[len(b)-1] = b[len(b)-1]<<1 ^ 0x87*carry
+}
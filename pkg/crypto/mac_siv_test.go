@@ -0,0 +1,147 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustHexDecode(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestSIVVectors(t *testing.T) {
+	// The test vectors of the appendix A of RFC 5297
+	vectors := []struct {
+		key        string
+		ad         []string
+		plaintext  string
+		ciphertext string
+	}{
+		{
+			key: "fffefdfc fbfaf9f8 f7f6f5f4 f3f2f1f0 f0f1f2f3 f4f5f6f7 f8f9fafb fcfdfeff",
+			ad: []string{
+				"10111213 14151617 18191a1b 1c1d1e1f 20212223 24252627",
+			},
+			plaintext:  "11223344 55667788 99aabbcc ddee",
+			ciphertext: "85632d07 c6e8f37f 950acd32 0a2ecc93 40c02b96 90c4dc04 daef7f6a fe5c",
+		},
+		{
+			key: "7f7e7d7c 7b7a7978 77767574 73727170 40414243 44454647 48494a4b 4c4d4e4f",
+			ad: []string{
+				"00112233 44556677 8899aabb ccddeeff deaddada deaddada ffeeddcc bbaa9988 77665544 33221100",
+				"10203040 50607080 90a0",
+				"09f91102 9d74e35b d84156c5 635688c0",
+			},
+			plaintext: "74686973 20697320 736f6d65 20706c61 696e7465 78742074 6f20656e 63727970" +
+				"74207573 696e6720 5349562d 414553",
+			ciphertext: "7bdb6e3b 432667eb 06f4d14b ff2fbd0f cb900f2f ddbe4043 26601965 c889bf17" +
+				"dba77ceb 094fa663 b7a3f748 ba8af829 ea64ad54 4a272e9c 485b62a3 fd5c0d",
+		},
+	}
+
+	for _, v := range vectors {
+		s, err := newSIV(mustHexDecode(v.key))
+		if !assert.NoError(t, err) {
+			return
+		}
+		ad := make([][]byte, len(v.ad))
+		for i := range v.ad {
+			ad[i] = mustHexDecode(v.ad[i])
+		}
+		plaintext := mustHexDecode(v.plaintext)
+		ciphertext := s.seal(nil, plaintext, ad...)
+		assert.Equal(t, mustHexDecode(v.ciphertext), ciphertext)
+		p, err := s.open(nil, ciphertext, ad...)
+		if assert.NoError(t, err) {
+			assert.Equal(t, plaintext, p)
+		}
+		ciphertext[len(ciphertext)-1] ^= 1
+		_, err = s.open(nil, ciphertext, ad...)
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+}
+
+func TestEncryptDeterministic(t *testing.T) {
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		Name:   "email",
+		MaxAge: 60,
+	}
+
+	// The equal values give equal messages, and the other values don't
+	enc1, err := EncryptDeterministic(o, []byte("me@example.org"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	enc2, err := EncryptDeterministic(o.Clone(), []byte("me@example.org"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, enc1, enc2)
+	values := []string{"", "me@example.org ", "me@example.orh", "you@example.org", strings.Repeat("a", 100)}
+	seen := map[string]bool{string(enc1): true}
+	for _, value := range values {
+		enc, err := EncryptDeterministic(o, []byte(value))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.False(t, seen[string(enc)], "same message for %q", value)
+		seen[string(enc)] = true
+		v, err := DecryptDeterministic(o, enc)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []byte(value), v)
+		}
+	}
+
+	// The plaintext can't be read, and the name and the key are bound
+	dec := mustBase64Decode(enc1)
+	assert.False(t, bytes.Contains(dec, []byte("example")))
+	other, err := EncryptDeterministic(o.WithName("other"), []byte("me@example.org"))
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, enc1, other)
+	}
+	_, err = DecryptDeterministic(o.WithName("other"), enc1)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecryptDeterministic(&MACConfig{Key: []byte("5432109876543210"), Name: "email"}, enc1)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// Tampered messages are rejected
+	for i := range dec {
+		tampered := append([]byte(nil), dec...)
+		tampered[i] ^= 1
+		_, err = DecryptDeterministic(o, Base64Encode(tampered))
+		assert.Error(t, err)
+	}
+
+	// There is no time, or salt
+	o.Unpredictable = true
+	o.CompactTime = true
+	enc3, err := EncryptDeterministic(o, []byte("me@example.org"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, enc1, enc3)
+	}
+	assert.Len(t, dec, 3+sivLen+len("me@example.org"))
+
+	// The other messages can't be decrypted
+	encrypted, err := EncryptAuthMessage(o, []byte("me@example.org"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecryptDeterministic(o, encrypted)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The purpose is checked
+	o.Purpose = 1
+	_, err = DecryptDeterministic(o, enc1)
+	assert.Equal(t, ErrMACWrongPurpose, err)
+	_, err = EncryptDeterministic(&MACConfig{Signer: &remoteSigner{key: o.Key}}, nil)
+	assert.Equal(t, errSignerUnsupported, err)
+}
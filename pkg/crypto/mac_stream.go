@@ -0,0 +1,177 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash"
+	"io"
+)
+
+// SignReader computes the MAC of all the data read from r, up to EOF, and
+// returns the detached tag.
+//
+// The data is streamed through the HMAC, so the memory used does not depend
+// on the size of the data: only a fixed size buffer is allocated for the
+// copy. The tag is bound to the name of the config, but contrary to the
+// messages, it does not contain an issued time and never expires. A config
+// with a Signer or the Poly1305 algorithm can't be used, as the data would
+// have to be buffered.
+func SignReader(c *MACConfig, r io.Reader) ([]byte, error) {
+	mac, err := c.newStreamMAC()
+	if err != nil {
+		return nil, err
+	}
+	defer c.putMAC(c.Key, mac)
+	if _, err := io.Copy(mac, r); err != nil {
+		return nil, err
+	}
+	return c.streamTag(mac), nil
+}
+
+// signChunkLen is the size of the chunks read by SignReaderContext, between
+// two checks of the context.
+const signChunkLen = 32 * 1024
+
+// SignReaderContext is the same as SignReader, but the context is checked
+// between each chunk of 32KB read from r: when it is cancelled, the signature
+// is abandoned, and the error of the context is returned.
+func SignReaderContext(ctx context.Context, c *MACConfig, r io.Reader) ([]byte, error) {
+	mac, err := c.newStreamMAC()
+	if err != nil {
+		return nil, err
+	}
+	defer c.putMAC(c.Key, mac)
+	buf := make([]byte, signChunkLen)
+	for {
+		if err := ctx.Err(); err != nil {
+			mac.Reset()
+			return nil, err
+		}
+		n, err := r.Read(buf)
+		mac.Write(buf[:n])
+		if err == io.EOF {
+			return c.streamTag(mac), nil
+		}
+		if err != nil {
+			mac.Reset()
+			return nil, err
+		}
+	}
+}
+
+// NewVerifyingReader returns a reader of the data of r, that verifies it
+// against a tag returned by SignReader. The data is streamed through the
+// HMAC, and the tag is only compared once r has returned EOF: the last Read
+// returns ErrMACInvalid instead of EOF if the data has been tampered with.
+// The tag must have the length of the tags of the config: a truncated tag is
+// rejected.
+//
+// The data returned by the reads before EOF is NOT verified yet: it can be
+// processed, for example written to a temporary file, but must not be trusted
+// nor acted upon until the reader has returned EOF.
+func NewVerifyingReader(c *MACConfig, r io.Reader, tag []byte) io.Reader {
+	vr := &verifyingReader{c: c, r: r, tag: tag}
+	vr.mac, vr.err = c.newStreamMAC()
+	return vr
+}
+
+type verifyingReader struct {
+	c   *MACConfig
+	r   io.Reader
+	tag []byte
+	mac hash.Hash
+	err error
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	if vr.err != nil {
+		return 0, vr.err
+	}
+	n, err := vr.r.Read(p)
+	vr.mac.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+	ok := ConstantTimeEqual(vr.tag, vr.c.streamTag(vr.mac))
+	vr.c.putMAC(vr.c.Key, vr.mac)
+	vr.mac = nil
+	if !ok {
+		vr.err = ErrMACInvalid
+	} else {
+		vr.err = io.EOF
+	}
+	return n, vr.err
+}
+
+// errMACWriterSummed is returned by a MACWriter used after its Sum.
+var errMACWriterSummed = errors.New("mac: the writer has already been summed")
+
+// MACWriter is a writer that copies the data to another writer while
+// computing its MAC, for example to write an upload to the disk and sign it
+// in a single pass. See NewMACWriter.
+type MACWriter struct {
+	c   *MACConfig
+	dst io.Writer
+	mac hash.Hash
+	err error
+}
+
+// NewMACWriter returns a writer that forwards the data to dst, and computes
+// its MAC on the way. The tag returned by Sum is the same as the one returned
+// by SignReader for the same data, and can be verified with
+// NewVerifyingReader. Only the data accepted by dst is MACed. The errors of
+// the config are returned by Write and Sum.
+func NewMACWriter(c *MACConfig, dst io.Writer) *MACWriter {
+	w := &MACWriter{c: c, dst: dst}
+	w.mac, w.err = c.newStreamMAC()
+	return w
+}
+
+// Write writes p to the destination, and adds the written bytes to the MAC.
+func (w *MACWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.dst.Write(p)
+	w.mac.Write(p[:n])
+	return n, err
+}
+
+// Sum returns the detached tag of all the data written. The writer can't be
+// used after that.
+func (w *MACWriter) Sum() ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+	tag := w.c.streamTag(w.mac)
+	w.c.putMAC(w.c.Key, w.mac)
+	w.mac = nil
+	w.err = errMACWriterSummed
+	return tag, nil
+}
+
+// streamTag returns the tag of a stream, truncated to the TagLen of the
+// config.
+func (c *MACConfig) streamTag(mac hash.Hash) []byte {
+	return mac.Sum(nil)[:c.macLen()]
+}
+
+// newStreamMAC returns the HMAC instance for a stream, with the prefix of the
+// streams already written. It should be given back with putMAC after use.
+func (c *MACConfig) newStreamMAC() (hash.Hash, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if c.Signer != nil {
+		return nil, errSignerUnsupported
+	}
+	if c.Algorithm == Poly1305 {
+		return nil, errors.New("mac: streams can't be signed with Poly1305")
+	}
+	mac := c.newMAC(c.Key)
+	prefix := new(bytes.Buffer)
+	writeMACPrefix(prefix, c, macDomainStream)
+	mac.Write(prefix.Bytes())
+	return mac, nil
+}
@@ -0,0 +1,234 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignReader(t *testing.T) {
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "file",
+	}
+	data := GenerateRandomBytes(4 << 20)
+
+	// The same data read in small chunks or all at once gives the same tag
+	tag1, err := SignReader(o, iotest.HalfReader(bytes.NewReader(data)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	tag2, err := SignReader(o, bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, tag1, tag2)
+
+	input := new(bytes.Buffer)
+	writeMACPrefix(input, o, macDomainStream)
+	input.Write(data)
+	assert.Equal(t, createMAC(o.hash(), o.Key, input.Bytes()), tag1)
+
+	data[42] ^= 1
+	tag3, err := SignReader(o, bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, tag1, tag3)
+
+	fail := errors.New("read failure")
+	_, err = SignReader(o, iotest.ErrReader(fail))
+	assert.Equal(t, fail, err)
+}
+
+func TestVerifyingReader(t *testing.T) {
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "file",
+	}
+	data := GenerateRandomBytes(1 << 20)
+	tag, err := SignReader(o, bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	read, err := io.ReadAll(NewVerifyingReader(o, bytes.NewReader(data), tag))
+	assert.NoError(t, err)
+	assert.Equal(t, data, read)
+
+	// The small reads and the data returned with EOF are verified too
+	r := NewVerifyingReader(o, iotest.DataErrReader(iotest.OneByteReader(bytes.NewReader(data[:100]))), nil)
+	_, err = io.ReadAll(r)
+	assert.Equal(t, ErrMACInvalid, err)
+	short, _ := SignReader(o, bytes.NewReader(data[:100]))
+	r = NewVerifyingReader(o, iotest.DataErrReader(iotest.OneByteReader(bytes.NewReader(data[:100]))), short)
+	read, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data[:100], read)
+
+	// The tampered data is only rejected at the end
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)/2] ^= 1
+	r = NewVerifyingReader(o, bytes.NewReader(tampered), tag)
+	buf := make([]byte, 1024)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 1024, n)
+	_, err = io.ReadAll(r)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = r.Read(buf)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// Truncated data, or another name
+	_, err = io.ReadAll(NewVerifyingReader(o, bytes.NewReader(data[:len(data)-1]), tag))
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = io.ReadAll(NewVerifyingReader(o.WithName("other"), bytes.NewReader(data), tag))
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The tags have the TagLen of the config, and are not truncated further
+	_, err = io.ReadAll(NewVerifyingReader(o, bytes.NewReader(data), tag[:16]))
+	assert.Equal(t, ErrMACInvalid, err)
+	truncated := o.Clone()
+	truncated.TagLen = 16
+	tag16, err := SignReader(truncated, bytes.NewReader(data))
+	if assert.NoError(t, err) {
+		assert.Len(t, tag16, 16)
+		_, err = io.ReadAll(NewVerifyingReader(truncated, bytes.NewReader(data), tag16))
+		assert.NoError(t, err)
+		_, err = io.ReadAll(NewVerifyingReader(o, bytes.NewReader(data), tag16))
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+
+	// The errors are returned unchanged
+	fail := errors.New("read failure")
+	_, err = io.ReadAll(NewVerifyingReader(o, iotest.ErrReader(fail), tag))
+	assert.Equal(t, fail, err)
+	_, err = io.ReadAll(NewVerifyingReader(&MACConfig{}, bytes.NewReader(data), tag))
+	assert.Equal(t, ErrMissingKey, err)
+}
+
+// cancelReader cancels a context after n bytes have been read.
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if cr.n -= n; cr.n <= 0 {
+		cr.cancel()
+	}
+	return n, err
+}
+
+func TestSignReaderContext(t *testing.T) {
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "file",
+	}
+	data := GenerateRandomBytes(1 << 20)
+
+	tag, err := SignReaderContext(context.Background(), o, iotest.HalfReader(bytes.NewReader(data)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected, err := SignReader(o, bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, expected, tag)
+
+	// Cancelled in the middle of the stream
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &cancelReader{r: bytes.NewReader(data), n: len(data) / 2, cancel: cancel}
+	_, err = SignReaderContext(ctx, o, r)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, r.n > -signChunkLen, "the reads have continued after the cancellation")
+
+	// The HMAC instance is given back in its initial state
+	tag, err = SignReaderContext(context.Background(), o, bytes.NewReader(data))
+	if assert.NoError(t, err) {
+		assert.Equal(t, expected, tag)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err = SignReaderContext(ctx, o, bytes.NewReader(data))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	fail := errors.New("read failure")
+	_, err = SignReaderContext(context.Background(), o, iotest.ErrReader(fail))
+	assert.Equal(t, fail, err)
+}
+
+// shortWriter accepts n bytes, and then fails.
+type shortWriter struct {
+	buf bytes.Buffer
+	n   int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		w.buf.Write(p[:w.n])
+		n := w.n
+		w.n = 0
+		return n, errors.New("disk full")
+	}
+	w.n -= len(p)
+	return w.buf.Write(p)
+}
+
+func TestMACWriter(t *testing.T) {
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "upload",
+	}
+	data := GenerateRandomBytes(1 << 20)
+
+	// The data is copied, and the tag is the same as SignReader
+	buf := new(bytes.Buffer)
+	w := NewMACWriter(o, buf)
+	n, err := io.Copy(w, iotest.HalfReader(bytes.NewReader(data)))
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(data), n)
+	tag, err := w.Sum()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, data, buf.Bytes())
+	expected, err := SignReader(o, bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, tag)
+	_, err = io.ReadAll(NewVerifyingReader(o, bytes.NewReader(buf.Bytes()), tag))
+	assert.NoError(t, err)
+
+	// The writer can't be used after Sum
+	_, err = w.Write([]byte("more"))
+	assert.Error(t, err)
+	_, err = w.Sum()
+	assert.Error(t, err)
+
+	// Only the data accepted by the destination is MACed
+	short := &shortWriter{n: 1000}
+	w = NewMACWriter(o, short)
+	n2, err := w.Write(data)
+	assert.Error(t, err)
+	assert.Equal(t, 1000, n2)
+	tag, err = w.Sum()
+	assert.NoError(t, err)
+	expected, _ = SignReader(o, bytes.NewReader(data[:1000]))
+	assert.Equal(t, expected, tag)
+
+	// The errors of the config
+	w = NewMACWriter(&MACConfig{}, buf)
+	_, err = w.Write(data)
+	assert.Equal(t, ErrMissingKey, err)
+	_, err = w.Sum()
+	assert.Equal(t, ErrMissingKey, err)
+}
@@ -2,8 +2,16 @@ package crypto
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -92,19 +100,19 @@ func TestMACWrongMessage(t *testing.T) {
 
 	buf1 := new(bytes.Buffer)
 	_, err1 := DecodeAuthMessage(o, buf1.Bytes())
-	if !assert.Equal(t, errMACInvalid, err1) {
+	if !assert.Equal(t, ErrMACTruncated, err1) {
 		return
 	}
 
-	buf2 := Base64Encode(GenerateRandomBytes(32))
+	buf2 := Base64Encode(append([]byte{1}, GenerateRandomBytes(31)...))
 	_, err2 := DecodeAuthMessage(o, buf2)
-	if !assert.Equal(t, errMACInvalid, err2) {
+	if !assert.Equal(t, ErrMACTruncated, err2) {
 		return
 	}
 
-	buf3 := Base64Encode(createMAC(key, []byte("")))
+	buf3 := Base64Encode(append([]byte{1}, createMAC(crypto.SHA256, key, []byte(""))...))
 	_, err3 := DecodeAuthMessage(o, buf3)
-	if !assert.Equal(t, errMACInvalid, err3) {
+	if !assert.Equal(t, ErrMACTruncated, err3) {
 		return
 	}
 }
@@ -112,17 +120,2929 @@ func TestMACWrongMessage(t *testing.T) {
 func TestAuthentication(t *testing.T) {
 	hashKey := []byte("secret-key")
 	for _, value := range testStrings {
-		mac := createMAC(hashKey, []byte(value))
-		if !assert.Len(t, mac, macLen) {
+		mac := createMAC(crypto.SHA256, hashKey, []byte(value))
+		if !assert.Len(t, mac, sha256.Size) {
 			return
 		}
-		ok1 := verifyMAC(hashKey, []byte(value), mac)
+		ok1 := verifyMAC(crypto.SHA256, hashKey, []byte(value), mac)
 		if !assert.True(t, ok1) {
 			return
 		}
-		ok2 := verifyMAC(hashKey, GenerateRandomBytes(32), mac)
+		ok2 := verifyMAC(crypto.SHA256, hashKey, GenerateRandomBytes(32), mac)
 		if !assert.False(t, ok2) {
 			return
 		}
 	}
 }
+
+func TestMACTooLong(t *testing.T) {
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxLen: 64,
+	}
+
+	_, err := EncodeAuthMessage(o, GenerateRandomBytes(64))
+	assert.Equal(t, ErrMACTooLong, err)
+
+	encoded, err := EncodeAuthMessage(o, []byte("short"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, len(encoded) <= o.MaxLen)
+}
+
+func TestMACDefaultMaxLen(t *testing.T) {
+	defer func(n int) { DefaultMaxLen = n }(DefaultMaxLen)
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	value := GenerateRandomBytes(4096)
+
+	_, err := EncodeAuthMessage(o, value)
+	assert.Equal(t, ErrMACTooLong, err)
+
+	DefaultMaxLen = 8192
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeAuthMessage(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	DefaultMaxLen = 4096
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACTooLong, err)
+
+	// An explicit MaxLen takes precedence
+	o.MaxLen = 8192
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+}
+
+func TestDecodeAuthMessageUnbounded(t *testing.T) {
+	var now int64 = 1000
+	internal := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		Name:   "internal",
+		MaxAge: 60,
+		MaxLen: 16384,
+		Clock:  func() int64 { return now },
+	}
+	public := internal.Clone()
+	public.MaxLen = 0
+	value := GenerateRandomBytes(8192)
+
+	encoded, err := EncodeAuthMessage(internal, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, len(encoded) > DefaultMaxLen)
+	_, err = DecodeAuthMessage(public, encoded)
+	assert.Equal(t, ErrMACTooLong, err)
+	v, err := DecodeAuthMessageUnbounded(public, encoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+
+	// The MAC and the expiry are still verified
+	dec := mustBase64Decode(encoded)
+	dec[len(dec)/2] ^= 1
+	_, err = DecodeAuthMessageUnbounded(public, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecodeAuthMessageUnbounded(public.WithName("other"), encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+	now += 61
+	_, err = DecodeAuthMessageUnbounded(public, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+}
+
+func TestMACMaxDecodedLen(t *testing.T) {
+	tooLong := 0
+	o := &MACConfig{
+		Key:           []byte("0123456789012345"),
+		MaxDecodedLen: 100,
+		OnTooLong:     func(enc []byte) { tooLong++ },
+	}
+	big := o.Clone()
+	big.MaxDecodedLen = 0
+	big.Compress = true
+	value := GenerateRandomBytes(200)
+
+	// The messages within MaxLen, but longer than MaxDecodedLen once decoded
+	_, err := EncodeAuthMessage(o, value)
+	assert.Equal(t, ErrMACTooLong, err)
+	_, err = EncodeAuthMessageBinary(o, value)
+	assert.Equal(t, ErrMACTooLong, err)
+	_, err = EncryptAuthMessage(o, value)
+	assert.Equal(t, ErrMACTooLong, err)
+	encoded, err := EncodeAuthMessage(big, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, len(encoded) < o.maxLen())
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACTooLong, err)
+	_, err = VerifyAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACTooLong, err)
+	_, err = VerifyAuthMessageInto(o, nil, encoded)
+	assert.Equal(t, ErrMACTooLong, err)
+	_, err = DecodeAuthMessageBinary(o, mustBase64Decode(encoded))
+	assert.Equal(t, ErrMACTooLong, err)
+	encrypted, err := EncryptAuthMessage(big, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecryptAuthMessage(o, encrypted)
+	assert.Equal(t, ErrMACTooLong, err)
+	assert.Equal(t, 5, tooLong)
+
+	// A compressed value that is only too long once decompressed
+	compressible := bytes.Repeat([]byte("a"), 200)
+	encoded, err = EncodeAuthMessage(big, compressible)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, len(mustBase64Decode(encoded)) < 100)
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACTooLong, err)
+	_, err = VerifyAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	o.Compress = true
+	_, err = EncodeAuthMessage(o, compressible)
+	assert.Equal(t, ErrMACTooLong, err)
+
+	// The default is 16 times MaxLen
+	o.MaxDecodedLen = 0
+	o.MaxLen = 100
+	assert.Equal(t, 1600, o.maxDecodedLen())
+	o.MaxDecodedLen = -1
+	assert.Error(t, o.Validate())
+}
+
+func TestMACNameBoundary(t *testing.T) {
+	o1 := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "ab",
+	}
+	o2 := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "abc",
+	}
+
+	encoded, err := EncodeAuthMessage(o1, []byte("cX"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeAuthMessage(o1, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []byte("cX"), v)
+
+	// "ab" + "cX" and "abc" + "X" share the same concatenation, but the
+	// length prefix of the name must keep them apart.
+	_, err = DecodeAuthMessage(o2, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	encoded, err = EncodeAuthMessage(o2, []byte("X"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(o1, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+}
+
+func TestMACHash(t *testing.T) {
+	value := []byte("myvalue")
+	o256 := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	o512 := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Hash: crypto.SHA512,
+	}
+
+	enc256, err := EncodeAuthMessage(o256, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	enc512, err := EncodeAuthMessage(o512, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dec256, _ := Base64Decode(enc256)
+	dec512, _ := Base64Decode(enc512)
+	assert.Equal(t, len(dec256)+32, len(dec512))
+
+	v, err := DecodeAuthMessage(o512, enc512)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+	_, err = DecodeAuthMessage(o256, enc512)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecodeAuthMessage(o512, enc256)
+	assert.Equal(t, ErrMACTruncated, err)
+
+	_, err = EncodeAuthMessage(&MACConfig{
+		Key:  []byte("0123456789012345"),
+		Hash: crypto.MD4,
+	}, value)
+	assert.Error(t, err)
+}
+
+func TestMACKeyRotation(t *testing.T) {
+	value := []byte("myvalue")
+	oldKey := []byte("0123456789012345")
+	newKey := []byte("9876543210987654")
+	keys := map[string][]byte{"1": oldKey}
+	keyFunc := func(keyID []byte) ([]byte, error) {
+		if key, ok := keys[string(keyID)]; ok {
+			return key, nil
+		}
+		return nil, errors.New("unknown key")
+	}
+
+	before := &MACConfig{
+		Key:     oldKey,
+		KeyID:   []byte("1"),
+		KeyFunc: keyFunc,
+	}
+	encoded, err := EncodeAuthMessage(before, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Rotate the key
+	keys["2"] = newKey
+	after := &MACConfig{
+		Key:     newKey,
+		KeyID:   []byte("2"),
+		KeyFunc: keyFunc,
+	}
+	v, err := DecodeAuthMessage(after, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	encoded2, err := EncodeAuthMessage(after, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err = DecodeAuthMessage(after, encoded2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	// Without the key func, only the current key is accepted
+	_, err = DecodeAuthMessage(&MACConfig{Key: newKey}, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// Once the old key is retired, its messages are rejected
+	delete(keys, "1")
+	_, err = DecodeAuthMessage(after, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+}
+
+func TestMACIssuedAt(t *testing.T) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+
+	before := Timestamp()
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	after := Timestamp()
+
+	v, issuedAt, err := DecodeAuthMessageWithTime(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []byte("myvalue"), v)
+	assert.True(t, issuedAt >= before && issuedAt <= after)
+}
+
+func TestMACClockSkew(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{
+		Key:     []byte("0123456789012345"),
+		MaxAge:  60,
+		MaxSkew: 10,
+	}
+
+	// A message from a host 5 seconds ahead is accepted
+	encoded, err := encodeAuthMessage(o, value, Timestamp()+5, messageOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeAuthMessage(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	// But not from a host 1 minute ahead
+	encoded, err = encodeAuthMessage(o, value, Timestamp()+60, messageOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACFromFuture, err)
+
+	// The skew is also tolerated on the expiry side
+	encoded, err = encodeAuthMessage(o, value, Timestamp()-65, messageOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	encoded, err = encodeAuthMessage(o, value, Timestamp()-75, messageOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// Without skew, messages from the future are still accepted
+	o.MaxSkew = 0
+	encoded, err = encodeAuthMessage(o, value, Timestamp()+60, messageOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+}
+
+func TestMACClock(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 60,
+		Clock:  func() int64 { return now },
+	}
+
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, issuedAt, err := DecodeAuthMessageWithTime(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 1000, issuedAt)
+
+	now = 1060
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+
+	now = 1061
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+}
+
+func TestMACErrors(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 60,
+		Clock:  func() int64 { return now },
+	}
+
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	now = 2000
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.True(t, errors.Is(err, ErrMACExpired))
+	assert.True(t, IsExpired(err))
+
+	_, err = DecodeAuthMessage(o, []byte(strings.Repeat("not base64! ", 8)))
+	assert.True(t, errors.Is(err, ErrMACInvalid))
+	assert.False(t, IsExpired(err))
+}
+
+func TestMACMessageString(t *testing.T) {
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "message1",
+	}
+
+	for _, value := range append(testStrings, "") {
+		encoded, err := EncodeAuthMessageString(o, value)
+		if !assert.NoError(t, err) {
+			return
+		}
+		v, err := DecodeAuthMessageString(o, encoded)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, value, v)
+	}
+
+	// "\x01invalid"
+	_, err := DecodeAuthMessageString(o, "AWludmFsaWQ")
+	assert.Equal(t, ErrMACTruncated, err)
+}
+
+func TestMACDetached(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "detached",
+	}
+
+	before := Timestamp()
+	mac, err := SignDetached(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotContains(t, string(mac), string(Base64Encode(value)))
+
+	issuedAt, err := VerifyDetached(o, value, mac)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, issuedAt >= before)
+
+	// Tampered value
+	_, err = VerifyDetached(o, []byte("myvaluf"), mac)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// Tampered MAC
+	dec, _ := Base64Decode(mac)
+	dec[len(dec)-1] ^= 1
+	_, err = VerifyDetached(o, value, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// A detached MAC is not a full message, and vice versa
+	_, err = DecodeAuthMessage(o, mac)
+	assert.Equal(t, ErrMACInvalid, err)
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = VerifyDetached(o, value, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+}
+
+func TestMACTruncatedTag(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		TagLen: 16,
+	}
+
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	full, err := EncodeAuthMessage(&MACConfig{Key: o.Key}, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dec, _ := Base64Decode(encoded)
+	decFull, _ := Base64Decode(full)
+	assert.Equal(t, len(decFull)-16, len(dec))
+
+	v, err := DecodeAuthMessage(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	for i := len(dec) - 16; i < len(dec); i++ {
+		dec[i] ^= 1
+		_, err = DecodeAuthMessage(o, Base64Encode(dec))
+		assert.Equal(t, ErrMACInvalid, err)
+		dec[i] ^= 1
+	}
+
+	_, err = EncodeAuthMessage(&MACConfig{Key: o.Key, TagLen: 8}, value)
+	assert.Error(t, err)
+	_, err = EncodeAuthMessage(&MACConfig{Key: o.Key, TagLen: 33}, value)
+	assert.Error(t, err)
+}
+
+func TestMACEncoding(t *testing.T) {
+	// 11 bytes of header + 6 bytes of value + 32 bytes of MAC needs padding
+	value := []byte("my val")
+	raw := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	padded := &MACConfig{
+		Key:      []byte("0123456789012345"),
+		Encoding: Base64URL,
+	}
+
+	now := Timestamp()
+	raw.Clock = func() int64 { return now }
+	padded.Clock = raw.Clock
+
+	encRaw, err := EncodeAuthMessage(raw, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	encPadded, err := EncodeAuthMessage(padded, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotContains(t, string(encRaw), "=")
+	assert.Contains(t, string(encPadded), "=")
+	assert.Equal(t, string(encRaw), strings.TrimRight(string(encPadded), "="))
+
+	v, err := DecodeAuthMessage(raw, encRaw)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+	v, err = DecodeAuthMessage(padded, encPadded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	// The maximum length is checked against the padded length
+	padded.MaxLen = len(encPadded)
+	_, err = EncodeAuthMessage(padded, value)
+	assert.NoError(t, err)
+	padded.MaxLen = len(encRaw)
+	_, err = EncodeAuthMessage(padded, value)
+	assert.Equal(t, ErrMACTooLong, err)
+	raw.MaxLen = len(encRaw)
+	_, err = EncodeAuthMessage(raw, value)
+	assert.Equal(t, ErrMACTooLong, err)
+	raw.MaxLen = len(encPadded)
+	_, err = EncodeAuthMessage(raw, value)
+	assert.NoError(t, err)
+}
+
+func TestMACEncodingPadding(t *testing.T) {
+	value := []byte("my val")
+	now := Timestamp()
+	raw := &MACConfig{
+		Key:   []byte("0123456789012345"),
+		Clock: func() int64 { return now },
+	}
+	padded := raw.Clone()
+	padded.Encoding = Base64URL
+
+	encPadded, err := EncodeAuthMessage(padded, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	encRaw := bytes.TrimRight(encPadded, "=")
+	assert.NotEqual(t, encPadded, encRaw)
+
+	// The same message is accepted in both forms by both configs
+	for _, c := range []*MACConfig{raw, padded} {
+		for _, enc := range [][]byte{encRaw, encPadded} {
+			v, err := DecodeAuthMessage(c, enc)
+			assert.NoError(t, err, string(enc))
+			assert.Equal(t, value, v)
+			issuedAt, err := VerifyAuthMessageInto(c, make([]byte, 64), enc)
+			assert.NoError(t, err, string(enc))
+			assert.Equal(t, now, issuedAt)
+		}
+	}
+
+	// The messages are still encoded with the padding of the config
+	enc, err := EncodeAuthMessage(raw, value)
+	assert.NoError(t, err)
+	assert.Equal(t, encRaw, enc)
+
+	// A wrong padding is rejected
+	for _, c := range []*MACConfig{raw, padded} {
+		_, err = DecodeAuthMessage(c, append(encPadded, '='))
+		assert.Error(t, err)
+		_, err = DecodeAuthMessage(c, append(encRaw, '=', '=', '='))
+		assert.Error(t, err)
+	}
+}
+
+func TestMACBinary(t *testing.T) {
+	value := []byte("myvalue")
+	now := Timestamp()
+	o := &MACConfig{
+		Key:   []byte("0123456789012345"),
+		Name:  "binary",
+		Clock: func() int64 { return now },
+	}
+
+	raw, err := EncodeAuthMessageBinary(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, encoded, Base64Encode(raw))
+
+	v, err := DecodeAuthMessageBinary(o, raw)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	raw[len(raw)-1] ^= 1
+	_, err = DecodeAuthMessageBinary(o, raw)
+	assert.Equal(t, ErrMACInvalid, err)
+	raw[len(raw)-1] ^= 1
+
+	// The max length is checked against the raw length
+	o.MaxLen = len(raw)
+	_, err = EncodeAuthMessageBinary(o, value)
+	assert.NoError(t, err)
+	_, err = DecodeAuthMessageBinary(o, raw)
+	assert.NoError(t, err)
+	_, err = EncodeAuthMessage(o, value)
+	assert.Equal(t, ErrMACTooLong, err)
+	o.MaxLen = len(raw) - 1
+	_, err = EncodeAuthMessageBinary(o, value)
+	assert.Equal(t, ErrMACTooLong, err)
+	_, err = DecodeAuthMessageBinary(o, raw)
+	assert.Equal(t, ErrMACTooLong, err)
+}
+
+func TestMACInspect(t *testing.T) {
+	o := &MACConfig{
+		Key:   []byte("0123456789012345"),
+		Clock: func() int64 { return 1234 },
+	}
+
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	issuedAt, valueLen, err := Inspect(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 1234, issuedAt)
+	assert.Equal(t, 7, valueLen)
+
+	// A tampered message can still be inspected
+	dec, _ := Base64Decode(encoded)
+	dec[len(dec)-1] ^= 1
+	tampered := Base64Encode(dec)
+	_, err = DecodeAuthMessage(o, tampered)
+	assert.Equal(t, ErrMACInvalid, err)
+	issuedAt, valueLen, err = Inspect(o, tampered)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 1234, issuedAt)
+	assert.Equal(t, 7, valueLen)
+
+	_, _, err = Inspect(o, []byte("###"))
+	assert.Equal(t, ErrMACInvalid, err)
+	_, _, err = Inspect(o, Base64Encode(dec[:20]))
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// An unknown version is malformed too
+	dec[0] = 0x2a
+	_, _, err = Inspect(o, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The length is the one of the decoded value
+	long := bytes.Repeat([]byte("a"), 500)
+	for _, c := range []*MACConfig{
+		{Key: o.Key, Compress: true},
+		{Key: o.Key, PadTo: 600, MaxLen: 1024},
+	} {
+		encoded, err = EncodeAuthMessage(c, long)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, valueLen, err = Inspect(c, encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, 500, valueLen)
+	}
+}
+
+func TestMACRefresh(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 60,
+		Clock:  func() int64 { return now },
+	}
+
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now = 1030
+	refreshed, err := RefreshAuthMessage(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, issuedAt, err := DecodeAuthMessageWithTime(o, refreshed)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []byte("myvalue"), v)
+	assert.EqualValues(t, 1030, issuedAt)
+
+	// The refreshed message outlives the original one
+	now = 1080
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+	_, err = DecodeAuthMessage(o, refreshed)
+	assert.NoError(t, err)
+
+	_, err = RefreshAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+	dec, _ := Base64Decode(refreshed)
+	dec[len(dec)-1] ^= 1
+	_, err = RefreshAuthMessage(o, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// A message with its own ttl keeps it once refreshed
+	now = 1000
+	short, err := EncodeAuthMessageWithExpiry(o, []byte("myvalue"), 10)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now = 1005
+	refreshed, err = RefreshAuthMessage(o, short)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now = 1015
+	_, err = DecodeAuthMessage(o, refreshed)
+	assert.NoError(t, err)
+	now = 1016
+	_, err = DecodeAuthMessage(o, refreshed)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// A message with an absolute expiry can't be refreshed past it
+	now = 1000
+	capped, err := EncodeAuthMessageUntil(o, []byte("myvalue"), 1050)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now = 1040
+	refreshed, err = RefreshAuthMessage(o, capped)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now = 1050
+	_, err = DecodeAuthMessage(o, refreshed)
+	assert.NoError(t, err)
+	now = 1051
+	_, err = DecodeAuthMessage(o, refreshed)
+	assert.Equal(t, ErrMACExpired, err)
+	_, err = RefreshAuthMessage(o, refreshed)
+	assert.Equal(t, ErrMACExpired, err)
+}
+
+func TestMACEncodeTo(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{
+		Key:   []byte("0123456789012345"),
+		Clock: func() int64 { return 1234 },
+	}
+
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dst := []byte("token=")
+	appended, err := EncodeAuthMessageTo(dst, o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "token="+string(encoded), string(appended))
+
+	buf := make([]byte, 0, 128)
+	appended, err = EncodeAuthMessageTo(buf, o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, encoded, appended)
+	assert.Equal(t, &buf[:1][0], &appended[0])
+
+	// Without any allocation
+	if raceEnabled {
+		return
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := EncodeAuthMessageTo(buf[:0], o, value); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestMACDeriveSubkey(t *testing.T) {
+	key := []byte("0123456789012345")
+	csrf := &MACConfig{Key: key, Name: "csrf", DeriveSubkey: true}
+	session := &MACConfig{Key: key, Name: "session", DeriveSubkey: true}
+
+	// Derivation is deterministic, and depends on the name
+	assert.Equal(t, csrf.macKey(key), csrf.macKey(key))
+	assert.Len(t, csrf.macKey(key), 32)
+	assert.NotEqual(t, csrf.macKey(key), session.macKey(key))
+	assert.NotEqual(t, key, csrf.macKey(key))
+
+	now := Timestamp()
+	csrf.Clock = func() int64 { return now }
+	encoded, err := EncodeAuthMessage(csrf, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeAuthMessage(csrf, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []byte("myvalue"), v)
+
+	// The tokens are not the same as with the master key
+	plain := &MACConfig{Key: key, Name: "csrf", Clock: csrf.Clock}
+	encodedPlain, err := EncodeAuthMessage(plain, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, encoded, encodedPlain)
+	_, err = DecodeAuthMessage(plain, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// Subkeys are also derived from the keys returned by KeyFunc
+	rotated := &MACConfig{
+		Key:          []byte("9876543210987654"),
+		Name:         "csrf",
+		DeriveSubkey: true,
+		KeyFunc:      func(keyID []byte) ([]byte, error) { return key, nil },
+	}
+	_, err = DecodeAuthMessage(rotated, encoded)
+	assert.NoError(t, err)
+}
+
+func TestGenerateKey(t *testing.T) {
+	k1, err := GenerateKey(16)
+	if !assert.NoError(t, err) {
+		return
+	}
+	k2, err := GenerateKey(16)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, k1, 16)
+	assert.Len(t, k2, 16)
+	assert.NotEqual(t, k1, k2)
+
+	k3, err := GenerateKey(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, k3, 32)
+
+	_, err = GenerateKey(8)
+	assert.Error(t, err)
+}
+
+func TestMACAdditionalData(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "csrf",
+	}
+
+	encoded, err := EncodeAuthMessageWithAAD(o, value, []byte("session1"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotContains(t, string(mustBase64Decode(encoded)), "session1")
+
+	v, err := DecodeAuthMessageWithAAD(o, encoded, []byte("session1"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	_, err = DecodeAuthMessageWithAAD(o, encoded, []byte("session2"))
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// No additional data is the same as an empty one
+	encoded, err = EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessageWithAAD(o, encoded, nil)
+	assert.NoError(t, err)
+	_, err = DecodeAuthMessageWithAAD(o, encoded, []byte("session1"))
+	assert.Equal(t, ErrMACInvalid, err)
+}
+
+func mustBase64Decode(enc []byte) []byte {
+	dec, err := Base64Decode(enc)
+	if err != nil {
+		panic(err)
+	}
+	return dec
+}
+
+func TestMACNameBytes(t *testing.T) {
+	value := []byte("\x00value")
+	key := []byte("0123456789012345")
+	o1 := &MACConfig{Key: key, NameBytes: []byte("name\x00")}
+	o2 := &MACConfig{Key: key, NameBytes: []byte("name")}
+	o3 := &MACConfig{Key: key, Name: "name\x00"}
+	o4 := &MACConfig{Key: key, Name: "other", NameBytes: []byte("name\x00")}
+
+	encoded, err := EncodeAuthMessage(o1, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeAuthMessage(o1, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	// The NUL byte can't be moved between the name and the value
+	encoded2, err := EncodeAuthMessage(o2, []byte("\x00\x00value"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(o1, encoded2)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecodeAuthMessage(o2, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// A string name with the same bytes is the same name, and NameBytes
+	// takes precedence over Name
+	_, err = DecodeAuthMessage(o3, encoded)
+	assert.NoError(t, err)
+	_, err = DecodeAuthMessage(o4, encoded)
+	assert.NoError(t, err)
+}
+
+func TestMACPerMessageExpiry(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 3600,
+		Clock:  func() int64 { return now },
+	}
+
+	short, err := EncodeAuthMessageWithExpiry(o, []byte("reset"), 300)
+	if !assert.NoError(t, err) {
+		return
+	}
+	long, err := EncodeAuthMessageWithExpiry(o, []byte("remember me"), 30*86400)
+	if !assert.NoError(t, err) {
+		return
+	}
+	regular, err := EncodeAuthMessage(o, []byte("regular"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now = 1300
+	_, err = DecodeAuthMessage(o, short)
+	assert.NoError(t, err)
+
+	now = 1301
+	_, err = DecodeAuthMessage(o, short)
+	assert.Equal(t, ErrMACExpired, err)
+	_, err = DecodeAuthMessage(o, regular)
+	assert.NoError(t, err)
+
+	now = 1000 + 7200
+	_, err = DecodeAuthMessage(o, regular)
+	assert.Equal(t, ErrMACExpired, err)
+	v, err := DecodeAuthMessage(o, long)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("remember me"), v)
+
+	now = 1001 + 30*86400
+	_, err = DecodeAuthMessage(o, long)
+	assert.Equal(t, ErrMACExpired, err)
+
+	_, err = EncodeAuthMessageWithExpiry(o, []byte("value"), 0)
+	assert.Error(t, err)
+}
+
+func TestMACNotAfter(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 3600,
+		Clock:  func() int64 { return now },
+	}
+
+	encoded, err := EncodeAuthMessageUntil(o, []byte("billing"), 2000)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, mustBase64Decode(encoded), 11+8+len("billing")+32)
+
+	now = 2000
+	v, err := DecodeAuthMessage(o, encoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("billing"), v)
+	}
+	_, issuedAt, expiresAt, err := DecodeAuthMessageFull(o, encoded)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1000, issuedAt)
+		assert.EqualValues(t, 2000, expiresAt)
+	}
+
+	now = 2001
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// A message already past its expiry time
+	past, err := EncodeAuthMessageUntil(o, []byte("late"), 1500)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(o, past)
+	assert.Equal(t, ErrMACExpired, err)
+	v, _, err = DecodeAuthMessageAllowExpired(o, past)
+	assert.Equal(t, ErrMACExpired, err)
+	assert.Equal(t, []byte("late"), v)
+
+	// The MaxAge of the config still applies
+	now = 1000
+	far, err := EncodeAuthMessageUntil(o, []byte("far"), 1000000)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, expiresAt, err = DecodeAuthMessageFull(o, far)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 4600, expiresAt)
+	}
+	now = 4601
+	_, err = DecodeAuthMessage(o, far)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// The MaxSkew tolerance is applied
+	o.MaxSkew = 10
+	now = 2010
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	now = 2011
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// It is in the time unit of the config
+	ms := &MACConfig{
+		Key:      o.Key,
+		TimeUnit: Milliseconds,
+		Clock:    func() int64 { return 1500000 },
+	}
+	_, _, expiresAt, err = DecodeAuthMessageFull(ms, encoded)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 2000000, expiresAt)
+	}
+
+	_, err = EncodeAuthMessageUntil(o, []byte("value"), 0)
+	assert.Error(t, err)
+	_, err = EncodeAuthMessageUntil(&MACConfig{Key: o.Key, NoTimestamp: true}, []byte("value"), 2000)
+	assert.Error(t, err)
+}
+
+func TestMACVersion(t *testing.T) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	dec := mustBase64Decode(encoded)
+	assert.Equal(t, byte(1), dec[0])
+	v, err := DecodeAuthMessage(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []byte("myvalue"), v)
+
+	for _, version := range []byte{0, 42, 255} {
+		dec[0] = version
+		_, err = DecodeAuthMessage(o, Base64Encode(dec))
+		assert.Equal(t, ErrMACUnsupportedVersion, err)
+	}
+}
+
+func TestMACAllowExpired(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 60,
+		Clock:  func() int64 { return now },
+	}
+
+	encoded, err := EncodeAuthMessage(o, []byte("alice@example.org"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	v, issuedAt, err := DecodeAuthMessageAllowExpired(o, encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("alice@example.org"), v)
+	assert.EqualValues(t, 1000, issuedAt)
+
+	// Expired but authentic: the value is returned with the error
+	now = 1061
+	v, issuedAt, err = DecodeAuthMessageAllowExpired(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+	assert.Equal(t, []byte("alice@example.org"), v)
+	assert.EqualValues(t, 1000, issuedAt)
+	v, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+	assert.Nil(t, v)
+
+	// Tampered: no value
+	dec := mustBase64Decode(encoded)
+	dec[len(dec)-1] ^= 1
+	v, issuedAt, err = DecodeAuthMessageAllowExpired(o, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+	assert.Nil(t, v)
+	assert.EqualValues(t, 0, issuedAt)
+
+	// From the future: no value
+	o.MaxSkew = 10
+	now = 900
+	v, _, err = DecodeAuthMessageAllowExpired(o, encoded)
+	assert.Equal(t, ErrMACFromFuture, err)
+	assert.Nil(t, v)
+}
+
+func TestMACValidate(t *testing.T) {
+	key := []byte("0123456789012345")
+	assert.NoError(t, (&MACConfig{Key: key}).Validate())
+	assert.Equal(t, ErrMissingKey, (&MACConfig{}).Validate())
+	assert.Equal(t, ErrKeyTooShort, (&MACConfig{Key: key[:15]}).Validate())
+	assert.Error(t, (&MACConfig{Key: key, Hash: crypto.MD4}).Validate())
+	assert.Error(t, (&MACConfig{Key: key, KeyID: make([]byte, 256)}).Validate())
+	assert.Error(t, (&MACConfig{Key: key, TagLen: 8}).Validate())
+	assert.Error(t, (&MACConfig{Key: key, Encoding: MessageEncoding(42)}).Validate())
+	assert.Error(t, (&MACConfig{Key: key, MaxAge: -1}).Validate())
+	assert.Error(t, (&MACConfig{Key: key, MaxLen: -1}).Validate())
+	assert.NoError(t, (&MACConfig{Key: key, MaxAge: 0, MaxLen: 0}).Validate())
+
+	// The errors are returned instead of panicking
+	_, err := EncodeAuthMessage(&MACConfig{}, []byte("myvalue"))
+	assert.Equal(t, ErrMissingKey, err)
+	_, err = EncodeAuthMessage(&MACConfig{Key: key[:8]}, []byte("myvalue"))
+	assert.Equal(t, ErrKeyTooShort, err)
+	_, err = DecodeAuthMessage(&MACConfig{Key: key[:8]}, []byte("myvalue"))
+	assert.Equal(t, ErrKeyTooShort, err)
+	_, err = EncryptAuthMessage(&MACConfig{}, []byte("myvalue"))
+	assert.Equal(t, ErrMissingKey, err)
+	_, err = SignReader(&MACConfig{}, strings.NewReader("myvalue"))
+	assert.Equal(t, ErrMissingKey, err)
+	_, err = EncodeAuthMessage(&MACConfig{Key: key, MaxAge: -60}, []byte("myvalue"))
+	assert.Error(t, err)
+	_, err = DecodeAuthMessage(&MACConfig{Key: key, MaxLen: -1}, []byte("myvalue"))
+	assert.Error(t, err)
+}
+
+func TestMACWeakKey(t *testing.T) {
+	assert.Equal(t, ErrWeakKey, (&MACConfig{Key: make([]byte, 16)}).Validate())
+	assert.Equal(t, ErrWeakKey, (&MACConfig{Key: make([]byte, 64)}).Validate())
+	assert.Equal(t, ErrWeakKey, (&MACConfig{Key: bytes.Repeat([]byte{0x42}, 32)}).Validate())
+	assert.Equal(t, ErrWeakKey, (&MACConfig{Key: []byte("abcabcabcabcabca")}).Validate())
+	assert.Equal(t, ErrKeyTooShort, (&MACConfig{Key: make([]byte, 8)}).Validate())
+	assert.NoError(t, (&MACConfig{Key: []byte("abcdabcdabcdabcd")}).Validate())
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, (&MACConfig{Key: GenerateRandomBytes(16)}).Validate())
+	}
+	_, err := EncodeAuthMessage(&MACConfig{Key: make([]byte, 32)}, []byte("myvalue"))
+	assert.Equal(t, ErrWeakKey, err)
+
+	// The keys of KeyFunc and of the key rings are checked too
+	c := &MACConfig{Key: []byte("0123456789012345"), KeyID: []byte("1")}
+	enc, err := EncodeAuthMessage(c, []byte("myvalue"))
+	assert.NoError(t, err)
+	c.KeyFunc = func(keyID []byte) ([]byte, error) { return make([]byte, 32), nil }
+	_, err = DecodeAuthMessage(c, enc)
+	assert.Equal(t, ErrMACInvalid, err)
+	kr, err := NewKeyRing([]byte("0123456789012345"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, ErrWeakKey, kr.Rotate(make([]byte, 32)))
+	}
+}
+
+func TestMACTimeUnit(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{
+		Key:      []byte("0123456789012345"),
+		MaxAge:   500,
+		TimeUnit: Milliseconds,
+	}
+
+	// Two messages issued in the same second have different times
+	enc1, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	time.Sleep(2 * time.Millisecond)
+	enc2, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, t1, err := DecodeAuthMessageWithTime(o, enc1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, t2, err := DecodeAuthMessageWithTime(o, enc2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, t2 > t1)
+	assert.InDelta(t, time.Now().UnixNano()/int64(time.Millisecond), t2, 1000)
+
+	// The layout is unchanged, only a flag is set
+	assert.Len(t, mustBase64Decode(enc1), 11+len(value)+32)
+
+	// MaxAge is in milliseconds
+	var now int64 = 1000000
+	o.Clock = func() int64 { return now }
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now += 500
+	_, issuedAt, err := DecodeAuthMessageWithTime(o, encoded)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1000000, issuedAt)
+	now++
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// A config in seconds can verify a message in milliseconds
+	s := &MACConfig{
+		Key:    o.Key,
+		MaxAge: 10,
+		Clock:  func() int64 { return 1005 },
+	}
+	_, issuedAt, err = DecodeAuthMessageWithTime(s, encoded)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1000, issuedAt)
+
+	_, err = EncodeAuthMessage(&MACConfig{Key: o.Key, TimeUnit: TimeUnit(2)}, value)
+	assert.Error(t, err)
+}
+
+func TestMACNoTimestamp(t *testing.T) {
+	value := []byte("myvalue")
+	withTime := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 60,
+	}
+	o := &MACConfig{
+		Key:         withTime.Key,
+		NoTimestamp: true,
+	}
+
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	encodedWithTime, err := EncodeAuthMessage(withTime, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, mustBase64Decode(encoded), 3+len(value)+32)
+	assert.Len(t, mustBase64Decode(encodedWithTime), 11+len(value)+32)
+
+	// Deterministic and never expires
+	o.Clock = func() int64 { return Timestamp() + 86400*365*10 }
+	encoded2, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, encoded, encoded2)
+	v, issuedAt, err := DecodeAuthMessageWithTime(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+	assert.EqualValues(t, 0, issuedAt)
+
+	// The messages with and without a time can't be mixed
+	_, err = DecodeAuthMessage(withTime, encoded)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecodeAuthMessage(o, encodedWithTime)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	_, err = EncodeAuthMessageWithExpiry(o, value, 60)
+	assert.Error(t, err)
+	o.MaxAge = 60
+	assert.Error(t, o.Validate())
+	_, err = EncodeAuthMessage(o, value)
+	assert.Error(t, err)
+}
+
+func FuzzDecodeAuthMessage(f *testing.F) {
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		Name:   "fuzz",
+		MaxAge: 60,
+	}
+	for _, value := range testStrings {
+		encoded, err := EncodeAuthMessage(o, []byte(value))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(encoded)
+		f.Add(encoded[:len(encoded)/2])
+	}
+	encoded, err := EncodeAuthMessageWithExpiry(o, []byte("myvalue"), 30)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(encoded)
+	f.Add([]byte(""))
+	f.Add([]byte("AQ"))
+	f.Add([]byte("AQAA"))
+	f.Add([]byte("AQEA"))
+
+	f.Fuzz(func(t *testing.T, enc []byte) {
+		// The decoding must never panic, and the errors must be clean
+		if _, err := DecodeAuthMessage(o, enc); err != nil {
+			switch err {
+			case ErrMACInvalid, ErrMACTruncated, ErrMACTooLong, ErrMACExpired, ErrMACUnsupportedVersion:
+			default:
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		Inspect(o, enc)
+		DecodeAuthMessageBinary(o, enc)
+		DecryptAuthMessage(o, enc)
+	})
+}
+
+func TestMACShortMessages(t *testing.T) {
+	o := &MACConfig{
+		Key:   []byte("0123456789012345"),
+		Name:  "short",
+		KeyID: []byte("key-1"),
+	}
+	encoded, err := EncodeAuthMessageWithExpiry(o, []byte("myvalue"), 60)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dec := mustBase64Decode(encoded)
+
+	// Every truncation of the message is rejected cleanly: as truncated when
+	// it can't hold a header and a MAC, and as invalid when only the value
+	// has been cut
+	hdrLen := len(dec) - len("myvalue") - o.macLen()
+	expected := func(i int) error {
+		if i < hdrLen+o.macLen() {
+			return ErrMACTruncated
+		}
+		return ErrMACInvalid
+	}
+	for i := 0; i < len(dec); i++ {
+		_, err = DecodeAuthMessage(o, Base64Encode(dec[:i]))
+		assert.Equal(t, expected(i), err, "length %d", i)
+		_, err = DecodeAuthMessageBinary(o, dec[:i])
+		assert.Equal(t, expected(i), err, "length %d", i)
+	}
+	for i := 0; i < len(encoded); i++ {
+		_, err = DecodeAuthMessage(o, encoded[:i])
+		if i < o.minEncodedLen() {
+			assert.Equal(t, ErrMACTruncated, err, "length %d", i)
+		} else if i%4 == 1 {
+			assert.Equal(t, ErrMACInvalid, err, "length %d", i)
+		} else {
+			assert.Equal(t, expected(len(mustBase64Decode(encoded[:i]))), err, "length %d", i)
+		}
+	}
+}
+
+func TestMACExpiresAt(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 3600,
+		Clock:  func() int64 { return now },
+	}
+
+	// From MaxAge
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, issuedAt, expiresAt, err := DecodeAuthMessageFull(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []byte("myvalue"), v)
+	assert.EqualValues(t, 1000, issuedAt)
+	assert.EqualValues(t, 4600, expiresAt)
+
+	// From the ttl of the message
+	encoded, err = EncodeAuthMessageWithExpiry(o, []byte("myvalue"), 300)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, issuedAt, expiresAt, err = DecodeAuthMessageFull(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 1000, issuedAt)
+	assert.EqualValues(t, 1300, expiresAt)
+
+	// Never expires
+	o.MaxAge = 0
+	encoded, err = EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, issuedAt, expiresAt, err = DecodeAuthMessageFull(o, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 1000, issuedAt)
+	assert.EqualValues(t, 0, expiresAt)
+
+	dec := mustBase64Decode(encoded)
+	dec[len(dec)-1] ^= 1
+	v, _, _, err = DecodeAuthMessageFull(o, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+	assert.Nil(t, v)
+}
+
+func TestVerifyAuthMessage(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:      []byte("0123456789012345"),
+		MaxAge:   60,
+		Clock:    func() int64 { return now },
+		Compress: true,
+	}
+	encoded, err := EncodeAuthMessage(o, []byte(strings.Repeat("myvalue", 20)))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	issuedAt, err := VerifyAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1000, issuedAt)
+
+	dec := mustBase64Decode(encoded)
+	for i := range dec {
+		dec[i] ^= 1
+		_, err = VerifyAuthMessage(o, Base64Encode(dec))
+		assert.Error(t, err)
+		dec[i] ^= 1
+	}
+	_, err = VerifyAuthMessage(o, []byte(strings.Repeat("!", 64)))
+	assert.Equal(t, ErrMACInvalid, err)
+
+	now = 1061
+	_, err = VerifyAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+}
+
+func TestMACPurpose(t *testing.T) {
+	value := []byte("myvalue")
+	reset := &MACConfig{
+		Key:     []byte("0123456789012345"),
+		Name:    "token",
+		Purpose: 1,
+	}
+	session := &MACConfig{
+		Key:     reset.Key,
+		Name:    "token",
+		Purpose: 2,
+	}
+	none := &MACConfig{
+		Key:  reset.Key,
+		Name: "token",
+	}
+
+	encoded, err := EncodeAuthMessage(reset, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeAuthMessage(reset, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+	_, err = DecodeAuthMessage(session, encoded)
+	assert.Equal(t, ErrMACWrongPurpose, err)
+	_, err = DecodeAuthMessage(none, encoded)
+	assert.Equal(t, ErrMACWrongPurpose, err)
+
+	encoded, err = EncodeAuthMessage(none, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(reset, encoded)
+	assert.Equal(t, ErrMACWrongPurpose, err)
+
+	// The purpose is bound in the MAC
+	encoded, err = EncodeAuthMessage(reset, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dec := mustBase64Decode(encoded)
+	dec[3] = 2
+	_, err = DecodeAuthMessage(session, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+
+	encrypted, err := EncryptAuthMessage(reset, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecryptAuthMessage(session, encrypted)
+	assert.Equal(t, ErrMACWrongPurpose, err)
+}
+
+func TestMACEncodeAt(t *testing.T) {
+	value := []byte("myvalue")
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "golden",
+	}
+
+	enc1, err := EncodeAuthMessageAt(o, value, 1500000000)
+	if !assert.NoError(t, err) {
+		return
+	}
+	enc2, err := EncodeAuthMessageAt(o, value, 1500000000)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, enc1, enc2)
+	enc3, err := EncodeAuthMessageAt(o, value, 1500000001)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, enc1, enc3)
+
+	v, issuedAt, err := DecodeAuthMessageWithTime(o, enc1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+	assert.EqualValues(t, 1500000000, issuedAt)
+}
+
+func TestMACHooks(t *testing.T) {
+	var now int64 = 1000
+	var expired, invalid, tooLong [][]byte
+	o := &MACConfig{
+		Key:       []byte("0123456789012345"),
+		MaxAge:    60,
+		MaxLen:    128,
+		Clock:     func() int64 { return now },
+		OnExpired: func(enc []byte) { expired = append(expired, enc) },
+		OnInvalid: func(enc []byte) { invalid = append(invalid, enc) },
+		OnTooLong: func(enc []byte) { tooLong = append(tooLong, enc) },
+	}
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Not called on success
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	_, err = VerifyAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	assert.Empty(t, expired)
+	assert.Empty(t, invalid)
+	assert.Empty(t, tooLong)
+
+	dec := mustBase64Decode(encoded)
+	dec[len(dec)-1] ^= 1
+	tampered := Base64Encode(dec)
+	_, err = DecodeAuthMessage(o, tampered)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecodeAuthMessage(o, []byte("!!!"))
+	assert.Equal(t, ErrMACTruncated, err)
+	assert.Equal(t, [][]byte{tampered, []byte("!!!")}, invalid)
+
+	long := make([]byte, 129)
+	_, err = DecodeAuthMessage(o, long)
+	assert.Equal(t, ErrMACTooLong, err)
+	_, err = VerifyAuthMessage(o, long)
+	assert.Equal(t, ErrMACTooLong, err)
+	assert.Equal(t, [][]byte{long, long}, tooLong)
+
+	now += 61
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+	assert.Equal(t, [][]byte{encoded}, expired)
+	assert.Len(t, invalid, 2)
+	assert.Len(t, tooLong, 2)
+
+	// The other errors don't call the hooks
+	now -= 61
+	o.Purpose = 1
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACWrongPurpose, err)
+	assert.Len(t, expired, 1)
+	assert.Len(t, invalid, 2)
+	assert.Len(t, tooLong, 2)
+}
+
+func TestVerifyAuthMessageInto(t *testing.T) {
+	for _, encoding := range []MessageEncoding{Base64RawURL, Base64URL} {
+		o := &MACConfig{
+			Key:      []byte("0123456789012345"),
+			Encoding: encoding,
+		}
+		scratch := make([]byte, 256)
+		for i := 0; i < 8; i++ {
+			encoded, err := EncodeAuthMessage(o, GenerateRandomBytes(i))
+			if !assert.NoError(t, err) {
+				return
+			}
+			expected, err := VerifyAuthMessage(o, encoded)
+			if !assert.NoError(t, err) {
+				return
+			}
+			issuedAt, err := VerifyAuthMessageInto(o, scratch, encoded)
+			if assert.NoError(t, err) {
+				assert.Equal(t, expected, issuedAt)
+			}
+
+			// A buffer too small is replaced
+			_, err = VerifyAuthMessageInto(o, nil, encoded)
+			assert.NoError(t, err)
+
+			dec, err := encoding.decode(encoded)
+			if !assert.NoError(t, err) {
+				return
+			}
+			dec[len(dec)-1] ^= 1
+			tampered := encoding.appendEncode(nil, dec)
+			_, err = VerifyAuthMessageInto(o, scratch, tampered)
+			assert.Equal(t, ErrMACInvalid, err)
+		}
+
+		// The scratch buffer avoids all the allocations
+		if raceEnabled {
+			continue
+		}
+		encoded, err := EncodeAuthMessage(o, GenerateRandomBytes(32))
+		if !assert.NoError(t, err) {
+			return
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := VerifyAuthMessageInto(o, scratch, encoded); err != nil {
+				t.Fatal(err)
+			}
+		})
+		assert.Zero(t, allocs)
+	}
+
+	o := &MACConfig{Key: []byte("0123456789012345")}
+	long := strings.Repeat("A", 64)
+	for _, encoded := range []string{"AWludmFsaWQ==", "AWlu.mFsaWQ", "AWludmFsaWQ\n", "A"} {
+		_, err := VerifyAuthMessageInto(o, make([]byte, 64), []byte(long+encoded))
+		assert.Equal(t, ErrMACInvalid, err, encoded)
+	}
+	o.Encoding = Base64URL
+	for _, encoded := range []string{"AWludmFsaWQ==", "AWludmFsaW=Q", "AWludmFsa===", "AWludmFsa=="} {
+		_, err := VerifyAuthMessageInto(o, make([]byte, 64), []byte(long+encoded))
+		assert.Equal(t, ErrMACInvalid, err, encoded)
+	}
+
+	// The messages too short for a header and a MAC are rejected before
+	// being decoded
+	_, err := VerifyAuthMessageInto(o, make([]byte, 64), []byte("A"))
+	assert.Equal(t, ErrMACTruncated, err)
+}
+
+func TestMACAltNames(t *testing.T) {
+	value := []byte("myvalue")
+	old := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "old",
+	}
+	older := old.WithName("older")
+	oldEnc, err := EncodeAuthMessage(old, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	olderEnc, err := EncodeAuthMessage(older, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// After the rename
+	o := old.WithName("new")
+	o.AltNames = []string{"old", "older"}
+	newEnc, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(old, newEnc)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	for _, tc := range []struct {
+		enc  []byte
+		name string
+	}{
+		{newEnc, "new"},
+		{oldEnc, "old"},
+		{olderEnc, "older"},
+	} {
+		v, name, err := DecodeAuthMessageWithName(o, tc.enc)
+		if assert.NoError(t, err) {
+			assert.Equal(t, value, v)
+			assert.Equal(t, tc.name, name)
+		}
+		_, err = VerifyAuthMessage(o, tc.enc)
+		assert.NoError(t, err)
+	}
+
+	// None of the names match
+	other, err := EncodeAuthMessage(old.WithName("other"), value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, err = DecodeAuthMessageWithName(o, other)
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// The alternative names can be changed
+	o.AltNames = []string{"older"}
+	_, err = DecodeAuthMessage(o, oldEnc)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = DecodeAuthMessage(o, olderEnc)
+	assert.NoError(t, err)
+
+	// The other errors are returned without trying the other names
+	var now int64 = 1000
+	old.Clock = func() int64 { return now }
+	expiring, err := EncodeAuthMessage(old, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	o.AltNames = []string{"old"}
+	o.Clock = old.Clock
+	_, err = DecodeAuthMessage(o, expiring)
+	assert.NoError(t, err)
+	o.MaxAge = 60
+	now += 61
+	_, err = DecodeAuthMessage(o, expiring)
+	assert.Equal(t, ErrMACExpired, err)
+}
+
+func TestMACEmptyValue(t *testing.T) {
+	for _, c := range []*MACConfig{
+		{Key: []byte("0123456789012345")},
+		{Key: []byte("0123456789012345"), Name: "empty", Compress: true},
+		{Key: []byte("0123456789012345"), NoTimestamp: true},
+		{Key: []byte("0123456789012345"), Algorithm: Poly1305},
+	} {
+		for _, value := range [][]byte{nil, {}} {
+			encoded, err := EncodeAuthMessage(c, value)
+			if !assert.NoError(t, err) {
+				return
+			}
+			dec := mustBase64Decode(encoded)
+			hdrLen := 11
+			if c.NoTimestamp {
+				hdrLen = 3
+			}
+			assert.Len(t, dec, hdrLen+c.macLen())
+
+			v, err := DecodeAuthMessage(c, encoded)
+			if assert.NoError(t, err) {
+				assert.NotNil(t, v)
+				assert.Len(t, v, 0)
+			}
+			_, err = VerifyAuthMessage(c, encoded)
+			assert.NoError(t, err)
+
+			msg, err := EncodeAuthMessageBinary(c, value)
+			if !assert.NoError(t, err) {
+				return
+			}
+			v, err = DecodeAuthMessageBinary(c, msg)
+			if assert.NoError(t, err) {
+				assert.NotNil(t, v)
+				assert.Len(t, v, 0)
+			}
+
+			// A message too short to contain a MAC is still rejected
+			_, err = DecodeAuthMessage(c, Base64Encode(dec[:len(dec)-1]))
+			assert.Equal(t, ErrMACTruncated, err)
+			_, err = DecodeAuthMessage(c, Base64Encode(dec[:hdrLen]))
+			assert.Equal(t, ErrMACTruncated, err)
+		}
+	}
+
+	s, err := EncodeAuthMessageString(&MACConfig{Key: []byte("0123456789012345")}, "")
+	if assert.NoError(t, err) {
+		v, err := DecodeAuthMessageString(&MACConfig{Key: []byte("0123456789012345")}, s)
+		assert.NoError(t, err)
+		assert.Equal(t, "", v)
+	}
+}
+
+func TestMACBase32(t *testing.T) {
+	o := &MACConfig{
+		Key:      []byte("0123456789012345"),
+		Name:     "pin",
+		Encoding: Base32,
+	}
+	value := []byte("support-1234")
+
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Regexp(t, "^[A-Z2-7]+$", string(encoded))
+	assert.Len(t, encoded, base32Raw.EncodedLen(11+len(value)+32))
+	v, err := DecodeAuthMessage(o, encoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+	_, err = VerifyAuthMessage(o, encoded)
+	assert.NoError(t, err)
+
+	// The case does not matter
+	v, err = DecodeAuthMessage(o, bytes.ToLower(encoded))
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+	_, err = VerifyAuthMessage(o, bytes.ToLower(encoded))
+	assert.NoError(t, err)
+
+	// Not decoded as base64
+	_, err = DecodeAuthMessage(&MACConfig{Key: o.Key, Name: "pin"}, encoded)
+	assert.Error(t, err)
+	_, err = DecodeAuthMessage(o, []byte(strings.Repeat("AB", 40)+"=CD"))
+	assert.Equal(t, ErrMACInvalid, err)
+
+	// MaxLen is checked on the base32 length
+	o.MaxLen = len(encoded) - 1
+	_, err = EncodeAuthMessage(o, value)
+	assert.Equal(t, ErrMACTooLong, err)
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACTooLong, err)
+}
+
+func TestMigrateToken(t *testing.T) {
+	var now int64 = 1000
+	old := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		Name:   "session",
+		MaxAge: 3600,
+		Clock:  func() int64 { return now },
+	}
+	// The format version stays 1: the new config changes the hash and the key
+	// of the messages.
+	new := &MACConfig{
+		Key:    []byte("5432109876543210"),
+		Name:   "session",
+		Hash:   crypto.SHA512,
+		KeyID:  []byte("2"),
+		MaxAge: 3600,
+		Clock:  func() int64 { return now },
+	}
+	value := []byte("myvalue")
+	encoded, err := EncodeAuthMessage(old, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now = 2000
+	migrated, err := MigrateToken(old, new, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, mustBase64Decode(migrated), 12+len(value)+64)
+	_, err = DecodeAuthMessage(old, migrated)
+	assert.Equal(t, ErrMACInvalid, err)
+	v, issuedAt, err := DecodeAuthMessageWithTime(new, migrated)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+		assert.EqualValues(t, 1000, issuedAt)
+	}
+
+	// The issued time is converted to the unit of the new config
+	ms := new.Clone()
+	ms.TimeUnit = Milliseconds
+	ms.MaxAge = 3600 * 1000
+	ms.Clock = func() int64 { return now * 1000 }
+	migrated, err = MigrateToken(old, ms, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, issuedAt, err = DecodeAuthMessageWithTime(ms, migrated)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1000000, issuedAt)
+	}
+
+	// The expiry of the message is kept
+	short, err := EncodeAuthMessageWithExpiry(old, value, 300)
+	if !assert.NoError(t, err) {
+		return
+	}
+	until, err := EncodeAuthMessageUntil(old, value, 2500)
+	if !assert.NoError(t, err) {
+		return
+	}
+	migratedShort, err := MigrateToken(old, new, short)
+	if !assert.NoError(t, err) {
+		return
+	}
+	migratedUntil, err := MigrateToken(old, new, until)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, expiresAt, err := DecodeAuthMessageFull(new, migratedShort)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 2300, expiresAt)
+	}
+	_, _, expiresAt, err = DecodeAuthMessageFull(new, migratedUntil)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 2500, expiresAt)
+	}
+	_, err = MigrateToken(old, &MACConfig{Key: new.Key, NoTimestamp: true}, short)
+	assert.Error(t, err)
+
+	// The errors of the old config are returned
+	_, err = MigrateToken(old, new, migrated)
+	assert.Equal(t, ErrMACInvalid, err)
+	now = 1000 + 3601
+	_, err = MigrateToken(old, new, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+}
+
+func TestMACTooShort(t *testing.T) {
+	invalid := 0
+	o := &MACConfig{
+		Key:         []byte("0123456789012345"),
+		Clock:       func() int64 { return 1 },
+		CompactTime: true,
+		OnInvalid:   func(enc []byte) { invalid++ },
+	}
+	encoded, err := EncodeAuthMessage(o, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dec := mustBase64Decode(encoded)
+	assert.Len(t, dec, o.minLen())
+
+	// Valid base64, but too short for a header and a MAC
+	short := Base64Encode(dec[:len(dec)-1])
+	_, err = DecodeAuthMessage(o, short)
+	assert.Equal(t, ErrMACTruncated, err)
+	_, err = VerifyAuthMessage(o, short)
+	assert.Equal(t, ErrMACTruncated, err)
+	_, err = DecodeAuthMessageBinary(o, dec[:len(dec)-1])
+	assert.Equal(t, ErrMACTruncated, err)
+	_, err = DecodeAuthMessage(o, []byte("AQ"))
+	assert.Equal(t, ErrMACTruncated, err)
+	assert.Equal(t, 4, invalid)
+
+	// Even when they are not valid base64, as they are rejected from their
+	// length, before being decoded
+	_, diag, err := DecodeAuthMessageDiag(o, []byte("!!"))
+	assert.Equal(t, ErrMACTruncated, err)
+	assert.Equal(t, DiagLength, diag.Stage)
+	_, err = VerifyAuthMessageInto(o, make([]byte, 64), []byte("!!"))
+	assert.Equal(t, ErrMACTruncated, err)
+	assert.Equal(t, 6, invalid)
+
+	// But a message with a correct length and a bad MAC is invalid
+	dec[len(dec)-1] ^= 1
+	_, err = DecodeAuthMessage(o, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+	_, err = VerifyAuthMessage(o, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+	dec[len(dec)-1] ^= 1
+	assert.Equal(t, 8, invalid)
+
+	// The shortest messages are still accepted
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	o.NoTimestamp = true
+	encoded, err = EncodeAuthMessage(o, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, invalid)
+}
+
+func TestMACWithKeyID(t *testing.T) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	value := []byte("myvalue")
+
+	encoded, keyID, err := EncodeAuthMessageWithKeyID(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, keyID, 4)
+	assert.Equal(t, KeyFingerprint(o.Key), keyID)
+	assert.Len(t, mustBase64Decode(encoded), 11+4+len(value)+32)
+	v, decodedID, err := DecodeAuthMessageWithKeyID(o, encoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+		assert.Equal(t, keyID, decodedID)
+	}
+
+	// Stable for a key, and different across keys
+	_, again, err := EncodeAuthMessageWithKeyID(&MACConfig{Key: []byte("0123456789012345")}, value)
+	assert.NoError(t, err)
+	assert.Equal(t, keyID, again)
+	other := &MACConfig{Key: []byte("5432109876543210")}
+	_, otherID, err := EncodeAuthMessageWithKeyID(other, value)
+	assert.NoError(t, err)
+	assert.NotEqual(t, keyID, otherID)
+
+	// The fingerprints can be used to resolve the keys
+	rotated := &MACConfig{
+		Key: other.Key,
+		KeyFunc: func(id []byte) ([]byte, error) {
+			for _, key := range [][]byte{other.Key, o.Key} {
+				if bytes.Equal(KeyFingerprint(key), id) {
+					return key, nil
+				}
+			}
+			return nil, ErrMissingKey
+		},
+	}
+	v, err = DecodeAuthMessage(rotated, encoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+
+	// The KeyID of the config is kept
+	o.KeyID = []byte("2024-01")
+	encoded, keyID, err = EncodeAuthMessageWithKeyID(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []byte("2024-01"), keyID)
+	_, decodedID, err = DecodeAuthMessageWithKeyID(o, encoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, keyID, decodedID)
+	}
+
+	// No key id
+	plain, err := EncodeAuthMessage(&MACConfig{Key: o.Key}, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, decodedID, err = DecodeAuthMessageWithKeyID(&MACConfig{Key: o.Key}, plain)
+	assert.NoError(t, err)
+	assert.Nil(t, decodedID)
+}
+
+func TestMACTimeOverflow(t *testing.T) {
+	key := []byte("0123456789012345")
+	value := []byte("myvalue")
+
+	// The absurd durations are rejected
+	assert.Error(t, (&MACConfig{Key: key, MaxAge: math.MaxInt64 - 1}).Validate())
+	assert.Error(t, (&MACConfig{Key: key, MaxAge: 101 * 365 * 86400}).Validate())
+	assert.NoError(t, (&MACConfig{Key: key, MaxAge: 99 * 365 * 86400}).Validate())
+	assert.NoError(t, (&MACConfig{Key: key, MaxAge: 99 * 365 * 86400 * 1000, TimeUnit: Milliseconds}).Validate())
+	assert.Error(t, (&MACConfig{Key: key, MaxSkew: math.MaxInt64}).Validate())
+	assert.Error(t, (&MACConfig{Key: key, MaxSkew: -1}).Validate())
+
+	// An old message is not accepted because of a wraparound
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:     key,
+		MaxAge:  60,
+		MaxSkew: 10,
+		Clock:   func() int64 { return now },
+	}
+	old, err := EncodeAuthMessageAt(o, value, math.MinInt64+1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(o, old)
+	assert.Equal(t, ErrMACExpired, err)
+	now = math.MinInt64 + 20
+	_, err = DecodeAuthMessage(o, old)
+	assert.NoError(t, err)
+	now = math.MinInt64 + 72
+	_, err = DecodeAuthMessage(o, old)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// Nor a message from the future
+	now = math.MaxInt64 - 5
+	future, err := EncodeAuthMessageAt(o, value, math.MaxInt64)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = DecodeAuthMessage(o, future)
+	assert.NoError(t, err)
+	now = -1000
+	_, err = DecodeAuthMessage(o, future)
+	assert.Equal(t, ErrMACFromFuture, err)
+
+	// A huge ttl does not overflow once converted to milliseconds
+	now = 1000
+	forever, err := EncodeAuthMessageWithExpiry(o, value, math.MaxInt64)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ms := &MACConfig{
+		Key:      key,
+		TimeUnit: Milliseconds,
+		Clock:    func() int64 { return 2000000 },
+	}
+	_, _, expiresAt, err := DecodeAuthMessageFull(ms, forever)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, int64(math.MaxInt64), expiresAt)
+	}
+	_, _, expiresAt, err = DecodeAuthMessageFull(o, forever)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, int64(math.MaxInt64), expiresAt)
+	}
+}
+
+func TestSupportedVersions(t *testing.T) {
+	versions := SupportedVersions()
+	assert.Equal(t, []uint8{1}, versions)
+	assert.Equal(t, macVersion, versions[len(versions)-1])
+
+	// A message of each version, for the key 0123456789012345, the name
+	// "fixture", and the value "myvalue", issued at 1000000000
+	fixtures := map[uint8]string{
+		1: "AQAAAAAAADuaygBteXZhbHVl6AkZVKDLcDF6BUeEfp3IseawdjxO2tBnv8-070OxiZg",
+	}
+	o := &MACConfig{
+		Key:   []byte("0123456789012345"),
+		Name:  "fixture",
+		Clock: func() int64 { return 1000000000 },
+	}
+	for _, version := range versions {
+		fixture, ok := fixtures[version]
+		if !assert.True(t, ok, "no fixture for the version %d", version) {
+			continue
+		}
+		v, issuedAt, err := DecodeAuthMessageWithTime(o, []byte(fixture))
+		if assert.NoError(t, err, "version %d", version) {
+			assert.Equal(t, []byte("myvalue"), v)
+			assert.EqualValues(t, 1000000000, issuedAt)
+		}
+		assert.Equal(t, version, mustBase64Decode([]byte(fixture))[0])
+	}
+
+	// The other versions are rejected
+	dec := mustBase64Decode([]byte(fixtures[1]))
+	dec[0] = versions[len(versions)-1] + 1
+	_, err := DecodeAuthMessage(o, Base64Encode(dec))
+	assert.Equal(t, ErrMACUnsupportedVersion, err)
+}
+
+func TestMACExpiryGrace(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:         []byte("0123456789012345"),
+		MaxAge:      60,
+		ExpiryGrace: 5,
+		Clock:       func() int64 { return now },
+	}
+	encoded, err := EncodeAuthMessage(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Just inside and just outside the grace
+	now = 1065
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	ttl, err := RemainingTTL(o, encoded)
+	assert.NoError(t, err)
+	assert.EqualValues(t, -5, ttl)
+	now = 1066
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// The grace is added after MaxSkew, and is not applied to the future
+	o.MaxSkew = 10
+	now = 1075
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	now = 1076
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+	o.MaxSkew = 0
+	now = 990
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	o.MaxSkew = 1
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACFromFuture, err)
+	o.MaxSkew = 0
+
+	// A grace of 0 is strict
+	o.ExpiryGrace = 0
+	now = 1060
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	now = 1061
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// The ttl and the expiry time of the messages get the grace too
+	o.ExpiryGrace = 5
+	now = 1000
+	withTTL, err := EncodeAuthMessageWithExpiry(o, []byte("myvalue"), 10)
+	assert.NoError(t, err)
+	until, err := EncodeAuthMessageUntil(o, []byte("myvalue"), 1020)
+	assert.NoError(t, err)
+	now = 1015
+	_, err = DecodeAuthMessage(o, withTTL)
+	assert.NoError(t, err)
+	now = 1016
+	_, err = DecodeAuthMessage(o, withTTL)
+	assert.Equal(t, ErrMACExpired, err)
+	now = 1025
+	_, err = DecodeAuthMessage(o, until)
+	assert.NoError(t, err)
+	now = 1026
+	_, err = DecodeAuthMessage(o, until)
+	assert.Equal(t, ErrMACExpired, err)
+
+	o.ExpiryGrace = -1
+	assert.Error(t, o.Validate())
+}
+
+func TestRemainingTTL(t *testing.T) {
+	var now int64 = 1000
+	o := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 3600,
+		Clock:  func() int64 { return now },
+	}
+	encoded, err := EncodeAuthMessage(o, []byte("session"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ttl, err := RemainingTTL(o, encoded)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 3600, ttl)
+	}
+	now = 1000 + 3590
+	ttl, err = RemainingTTL(o, encoded)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 10, ttl)
+	}
+	now = 1000 + 3601
+	_, err = RemainingTTL(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+
+	// Within the tolerance of MaxSkew
+	o.MaxSkew = 5
+	ttl, err = RemainingTTL(o, encoded)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, -1, ttl)
+	}
+	o.MaxSkew = 0
+
+	// The per-message expiry, or no expiry
+	now = 1000
+	short, err := EncodeAuthMessageWithExpiry(o, []byte("reset"), 300)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ttl, err = RemainingTTL(o, short)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 300, ttl)
+	}
+	o.MaxAge = 0
+	ttl, err = RemainingTTL(o, encoded)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, int64(math.MaxInt64), ttl)
+	}
+
+	dec := mustBase64Decode(encoded)
+	dec[len(dec)-1] ^= 1
+	_, err = RemainingTTL(o, Base64Encode(dec))
+	assert.Equal(t, ErrMACInvalid, err)
+}
+
+func TestMACUnpredictable(t *testing.T) {
+	o := &MACConfig{
+		Key:           []byte("0123456789012345"),
+		Name:          "salt",
+		Clock:         func() int64 { return 1000 },
+		Unpredictable: true,
+	}
+	value := []byte("myvalue")
+
+	enc1, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	enc2, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, enc1, enc2)
+	assert.Len(t, mustBase64Decode(enc1), 12+8+len(value)+32)
+	for _, enc := range [][]byte{enc1, enc2} {
+		v, issuedAt, err := DecodeAuthMessageWithTime(o, enc)
+		if assert.NoError(t, err) {
+			assert.Equal(t, value, v)
+			assert.EqualValues(t, 1000, issuedAt)
+		}
+	}
+
+	// The same config decodes the messages without salt, and the other way
+	plain := o.Clone()
+	plain.Unpredictable = false
+	enc3, err := EncodeAuthMessage(plain, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	enc4, err := EncodeAuthMessage(plain, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, enc3, enc4)
+	_, err = DecodeAuthMessage(o, enc3)
+	assert.NoError(t, err)
+	_, err = DecodeAuthMessage(plain, enc1)
+	assert.NoError(t, err)
+
+	// The salt is covered by the MAC
+	dec := mustBase64Decode(enc1)
+	for i := 11; i < 11+8; i++ {
+		dec[i] ^= 1
+		_, err = DecodeAuthMessage(o, Base64Encode(dec))
+		assert.Equal(t, ErrMACInvalid, err)
+		dec[i] ^= 1
+	}
+
+	// The unknown extended flags are rejected
+	for _, ext := range []byte{0, 8, 0x80} {
+		dec[2] = ext
+		_, _, err = readMACHeader(dec)
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+
+	// Also with the other options of the header
+	o.Purpose = 3
+	o.KeyID = []byte("key")
+	encoded, err := EncodeAuthMessageWithExpiry(o, value, 60)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeAuthMessage(o, encoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+	encrypted, err := EncryptAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err = DecryptAuthMessage(o, encrypted)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+}
+
+func TestMACCompactTime(t *testing.T) {
+	now := int64(1700000000)
+	o := &MACConfig{
+		Key:         []byte("0123456789012345"),
+		Name:        "url",
+		MaxAge:      60,
+		Clock:       func() int64 { return now },
+		CompactTime: true,
+	}
+	value := []byte("myvalue")
+
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	plain := o.Clone()
+	plain.CompactTime = false
+	encoded2, err := EncodeAuthMessage(plain, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// 1 byte of extended flags, and 5 bytes instead of 8 for the time
+	assert.Len(t, mustBase64Decode(encoded), len(mustBase64Decode(encoded2))-2)
+	assert.True(t, len(encoded) < len(encoded2))
+
+	// The messages are decoded by all the configs
+	for _, c := range []*MACConfig{o, plain} {
+		for _, enc := range [][]byte{encoded, encoded2} {
+			v, issuedAt, err := DecodeAuthMessageWithTime(c, enc)
+			if assert.NoError(t, err) {
+				assert.Equal(t, value, v)
+				assert.Equal(t, now, issuedAt)
+			}
+		}
+	}
+
+	// Expiry, with the ttl and the not after time after the compact time
+	withTTL, err := EncodeAuthMessageWithExpiry(o, value, 10)
+	if !assert.NoError(t, err) {
+		return
+	}
+	until, err := EncodeAuthMessageUntil(o, value, now+20)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now += 15
+	_, err = DecodeAuthMessage(o, withTTL)
+	assert.Equal(t, ErrMACExpired, err)
+	_, err = DecodeAuthMessage(o, until)
+	assert.NoError(t, err)
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.NoError(t, err)
+	now += 46
+	_, err = DecodeAuthMessage(o, encoded)
+	assert.Equal(t, ErrMACExpired, err)
+	now -= 61
+
+	// The time is covered by the MAC
+	dec := mustBase64Decode(encoded)
+	for i := 4; i < 4+5; i++ {
+		dec[i] ^= 1
+		_, err = DecodeAuthMessage(o, Base64Encode(dec))
+		assert.Equal(t, ErrMACInvalid, err)
+		dec[i] ^= 1
+	}
+
+	// The small, negative and large times, in milliseconds
+	ms := o.Clone()
+	ms.TimeUnit = Milliseconds
+	ms.MaxAge = 0
+	for _, now = range []int64{0, 1, -1, 63, 64, math.MaxInt64, math.MinInt64} {
+		enc, err := EncodeAuthMessage(ms, value)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, issuedAt, err := DecodeAuthMessageWithTime(ms, enc)
+		if assert.NoError(t, err, "time %d", now) {
+			assert.Equal(t, now, issuedAt)
+		}
+	}
+
+	// A time that is not written with its shortest varint is rejected
+	hdr := []byte{macVersion, flagExtended, extFlagCompactTime, 0, 0x81, 0x00}
+	_, _, err = readMACHeader(hdr)
+	assert.Equal(t, ErrMACInvalid, err)
+	_, _, err = readMACHeader(hdr[:5])
+	assert.Equal(t, ErrMACInvalid, err)
+	hdr = []byte{macVersion, flagExtended, extFlagCompactTime, 0, 0x02}
+	h, n, err := readMACHeader(hdr)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 5, n)
+		assert.EqualValues(t, 1, h.time)
+	}
+
+	// And a compact time without time
+	hdr = []byte{macVersion, flagExtended | flagNoTime, extFlagCompactTime, 0}
+	_, _, err = readMACHeader(hdr)
+	assert.Equal(t, ErrMACInvalid, err)
+	o.NoTimestamp = true
+	o.MaxAge = 0
+	encoded, err = EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, mustBase64Decode(encoded), 3+len(value)+32)
+}
+
+func TestMACPrefix(t *testing.T) {
+	sk := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		Name:   "api",
+		Prefix: "sk_",
+	}
+	pk := sk.Clone()
+	pk.Prefix = "pk_"
+	plain := sk.Clone()
+	plain.Prefix = ""
+	value := []byte("myvalue")
+
+	encoded, err := EncodeAuthMessage(sk, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, bytes.HasPrefix(encoded, []byte("sk_")))
+	v, err := DecodeAuthMessage(sk, encoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+	_, err = VerifyAuthMessage(sk, encoded)
+	assert.NoError(t, err)
+
+	// The prefix is stripped, and covered by the MAC
+	unprefixed, err := EncodeAuthMessage(plain, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, encoded, len(unprefixed)+3)
+	assert.NotEqual(t, unprefixed, encoded[3:])
+	swapped := append([]byte("pk_"), encoded[3:]...)
+	for _, c := range []struct {
+		config *MACConfig
+		enc    []byte
+	}{
+		{sk, encoded[3:]},
+		{sk, append([]byte("sk"), encoded[3:]...)},
+		{sk, swapped},
+		{pk, swapped},
+		{plain, encoded[3:]},
+		{sk, append([]byte("sk_"), unprefixed...)},
+	} {
+		_, err = DecodeAuthMessage(c.config, c.enc)
+		assert.Equal(t, ErrMACInvalid, err, "%s", c.enc)
+		_, err = VerifyAuthMessage(c.config, c.enc)
+		assert.Equal(t, ErrMACInvalid, err, "%s", c.enc)
+	}
+
+	// Also for the other kinds of messages
+	encrypted, err := EncryptAuthMessage(sk, value)
+	if assert.NoError(t, err) {
+		assert.True(t, bytes.HasPrefix(encrypted, []byte("sk_")))
+		v, err = DecryptAuthMessage(sk, encrypted)
+		assert.NoError(t, err)
+		assert.Equal(t, value, v)
+		_, err = DecryptAuthMessage(pk, append([]byte("pk_"), encrypted[3:]...))
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+	buf := new(bytes.Buffer)
+	if assert.NoError(t, NewEncoder(sk, buf).Encode(value)) {
+		v, _, err = NewDecoder(sk, bytes.NewReader(buf.Bytes())).Decode()
+		assert.NoError(t, err)
+		assert.Equal(t, value, v)
+		_, _, err = NewDecoder(pk, bytes.NewReader(buf.Bytes())).Decode()
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+	raw, err := EncodeAuthMessageBinary(sk, value)
+	if assert.NoError(t, err) {
+		_, err = DecodeAuthMessageBinary(sk, raw)
+		assert.NoError(t, err)
+		_, err = DecodeAuthMessageBinary(plain, raw)
+		assert.Equal(t, ErrMACInvalid, err)
+	}
+
+	// The prefix counts in MaxLen
+	sk.MaxLen = len(encoded) - 1
+	_, err = EncodeAuthMessage(sk, value)
+	assert.Equal(t, ErrMACTooLong, err)
+	sk.Prefix = strings.Repeat("x", 256)
+	assert.Error(t, sk.Validate())
+}
+
+func TestPeekHeader(t *testing.T) {
+	key := GenerateRandomBytes(32)
+	value := []byte("me@example.org")
+	for _, c := range []*MACConfig{
+		{Key: key, Name: "plain"},
+		{Key: key, Name: "sk", Prefix: "sk_"},
+		{Key: key, Name: "live", Prefix: "pk_live_", KeyID: []byte("2024")},
+		{Key: key, Name: "long", Prefix: strings.Repeat("x", 255), KeyID: bytes.Repeat([]byte{7}, 255)},
+		{Key: key, Name: "padded", Prefix: "tok.", KeyID: []byte("k1"), Encoding: Base64URL, Purpose: 3},
+		{Key: key, Name: "compact", Prefix: "c:", KeyID: []byte{0}, CompactTime: true, Unpredictable: true},
+	} {
+		for _, encode := range []func(*MACConfig, []byte) ([]byte, error){EncodeAuthMessage, EncryptAuthMessage} {
+			enc, err := encode(c, value)
+			if !assert.NoError(t, err, c.Name) {
+				continue
+			}
+			version, prefix, keyID, err := PeekHeader(enc)
+			if assert.NoError(t, err, c.Name) {
+				assert.Equal(t, uint8(1), version, c.Name)
+				assert.Equal(t, c.Prefix, prefix, c.Name)
+				assert.Equal(t, append([]byte{}, c.KeyID...), keyID, c.Name)
+			}
+
+			// The result selects the config, but the message is still verified
+			forged := append([]byte("other_"), enc[len(c.Prefix):]...)
+			_, prefix, _, err = PeekHeader(forged)
+			assert.NoError(t, err, c.Name)
+			assert.Equal(t, "other_", prefix, c.Name)
+			_, err = DecodeAuthMessage(c, forged)
+			assert.Error(t, err, c.Name)
+		}
+	}
+
+	// The returned key id is a copy
+	c := &MACConfig{Key: key, KeyID: []byte("kid")}
+	enc, err := EncodeAuthMessage(c, value)
+	assert.NoError(t, err)
+	_, _, keyID, _ := PeekHeader(enc)
+	keyID[0] = 'x'
+	_, _, keyID, _ = PeekHeader(enc)
+	assert.Equal(t, []byte("kid"), keyID)
+
+	// The malformed messages
+	for _, enc := range [][]byte{nil, []byte(""), []byte("!!!"), []byte("AQ"), []byte("s")} {
+		_, _, _, err = PeekHeader(enc)
+		assert.Equal(t, ErrMACInvalid, err, string(enc))
+	}
+	version, _, _, err := PeekHeader([]byte("KgAAAA")) // {42, 0, 0, 0}
+	assert.Equal(t, ErrMACUnsupportedVersion, err)
+	assert.Equal(t, uint8(42), version)
+}
+
+// cancelledContext is a context that is cancelled after its Err method has
+// been called the given number of times.
+type cancelledContext struct {
+	context.Context
+	after int
+	calls int
+}
+
+func (c *cancelledContext) Err() error {
+	c.calls++
+	if c.calls > c.after {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestDecodeAuthMessageContext(t *testing.T) {
+	invalid := 0
+	o := &MACConfig{
+		Key:       []byte("0123456789012345"),
+		MaxLen:    1 << 20,
+		OnInvalid: func(enc []byte) { invalid++ },
+	}
+	value := []byte("myvalue")
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeAuthMessageContext(context.Background(), o, encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, value, v)
+
+	// A cancelled context gives its error, without verifying the message
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	v, err = DecodeAuthMessageContext(ctx, o, encoded)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, v)
+	_, err = DecodeAuthMessageContext(ctx, o, []byte("invalid"))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, invalid)
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	_, err = DecodeAuthMessageContext(ctx, o, encoded)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// The context is checked again after decoding a large message
+	large, err := EncodeAuthMessage(o, GenerateRandomBytes(2*contextCheckLen))
+	if !assert.NoError(t, err) {
+		return
+	}
+	second := &cancelledContext{Context: context.Background(), after: 1}
+	_, err = DecodeAuthMessageContext(second, o, large)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 2, second.calls)
+	second = &cancelledContext{Context: context.Background(), after: 1}
+	_, err = DecodeAuthMessageContext(second, o, encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, second.calls)
+
+	// The other errors are unchanged
+	_, err = DecodeAuthMessageContext(context.Background(), o, []byte(strings.Repeat("!nvalid", 10)))
+	assert.Equal(t, ErrMACInvalid, err)
+	assert.Equal(t, 1, invalid)
+}
+
+func TestMACRand(t *testing.T) {
+	value := []byte("myvalue")
+	newConfig := func() *MACConfig {
+		return &MACConfig{
+			Key:           []byte("0123456789012345"),
+			Unpredictable: true,
+			Clock:         func() int64 { return 1000 },
+			Rand:          bytes.NewReader(bytes.Repeat([]byte("0123456789abcdef"), 64)),
+		}
+	}
+
+	// The same reader gives the same messages
+	for name, encode := range map[string]func(*MACConfig, []byte) ([]byte, error){
+		"message":    EncodeAuthMessage,
+		"encrypted":  EncryptAuthMessage,
+		"single-use": EncodeSingleUse,
+		"secure":     EncodeSecureValue,
+	} {
+		a, err := encode(newConfig(), value)
+		assert.NoError(t, err, name)
+		b, err := encode(newConfig(), value)
+		assert.NoError(t, err, name)
+		assert.Equal(t, a, b, name)
+	}
+	a, idA, err := EncodeRevocable(newConfig(), value)
+	assert.NoError(t, err)
+	b, idB, err := EncodeRevocable(newConfig(), value)
+	assert.NoError(t, err)
+	assert.Equal(t, a, b)
+	assert.Equal(t, []byte("01234567"), idA[:8])
+	assert.Equal(t, idA, idB)
+
+	// The random bytes are read from the reader
+	c := newConfig()
+	enc, err := EncodeAuthMessage(c, value)
+	if assert.NoError(t, err) {
+		dec := mustBase64Decode(enc)
+		assert.Equal(t, []byte("01234567"), dec[len(dec)-c.macLen()-len(value)-saltLen:][:saltLen])
+		v, err := DecodeAuthMessage(c, enc)
+		assert.NoError(t, err)
+		assert.Equal(t, value, v)
+	}
+	poly := newConfig()
+	poly.Algorithm = Poly1305
+	enc, err = EncodeAuthMessage(poly, value)
+	if assert.NoError(t, err) {
+		dec := mustBase64Decode(enc)
+		assert.Equal(t, []byte("89abcdef"), dec[len(dec)-poly.macLen():][:8])
+	}
+
+	// And the error of a failing reader is returned
+	c.Rand = bytes.NewReader([]byte("0123456789"))
+	_, err = EncodeAuthMessage(c, value)
+	assert.NoError(t, err)
+	_, err = EncodeAuthMessage(c, value)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	for name, encode := range map[string]func(*MACConfig, []byte) ([]byte, error){
+		"message":    EncodeAuthMessage,
+		"encrypted":  EncryptAuthMessage,
+		"single-use": EncodeSingleUse,
+		"secure":     EncodeSecureValue,
+		"poly1305": func(c *MACConfig, value []byte) ([]byte, error) {
+			c.Algorithm = Poly1305
+			c.Unpredictable = false
+			return EncodeAuthMessage(c, value)
+		},
+		"revocable": func(c *MACConfig, value []byte) ([]byte, error) {
+			enc, _, err := EncodeRevocable(c, value)
+			return enc, err
+		},
+		"csrf": func(c *MACConfig, value []byte) ([]byte, error) {
+			token, err := NewCSRFToken(c, value)
+			if err != nil {
+				return nil, err
+			}
+			return []byte(token), nil
+		},
+	} {
+		c := newConfig()
+		c.Rand = bytes.NewReader(nil)
+		enc, err := encode(c, value)
+		assert.Equal(t, io.EOF, err, name)
+		assert.Nil(t, enc, name)
+	}
+
+	// Without a reader, the messages are random
+	c.Rand = nil
+	enc, err = EncodeAuthMessage(c, value)
+	assert.NoError(t, err)
+	other, err := EncodeAuthMessage(c, value)
+	assert.NoError(t, err)
+	assert.NotEqual(t, enc, other)
+}
+
+func TestDecodeAuthMessageHeader(t *testing.T) {
+	o := &MACConfig{
+		Key:     []byte("0123456789012345"),
+		Name:    "session",
+		Prefix:  "sess_",
+		KeyID:   []byte("2024"),
+		Purpose: 3,
+		MaxAge:  3600,
+		Clock:   func() int64 { return 1000 },
+	}
+	value := []byte("myvalue")
+	encoded, err := EncodeAuthMessage(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, hdr, err := DecodeAuthMessageHeader(o, encoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+		assert.Equal(t, Header{
+			Version:   macVersion,
+			Prefix:    "sess_",
+			KeyID:     []byte("2024"),
+			Name:      "session",
+			Purpose:   3,
+			IssuedAt:  1000,
+			ExpiresAt: 4600,
+		}, hdr)
+	}
+
+	// The header is the same as the one of the other functions
+	version, prefix, keyID, err := PeekHeader(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{hdr.Version, hdr.Prefix, hdr.KeyID}, []interface{}{version, prefix, keyID})
+	_, issuedAt, expiresAt, err := DecodeAuthMessageFull(o, encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{hdr.IssuedAt, hdr.ExpiresAt}, []int64{issuedAt, expiresAt})
+
+	// The alternative names and the messages without time
+	old := o.WithName("legacy")
+	old.Purpose = 0
+	old.NoTimestamp = true
+	old.MaxAge = 0
+	encoded, err = EncodeAuthMessage(old, value)
+	if assert.NoError(t, err) {
+		c := old.WithName("session")
+		c.AltNames = []string{"legacy"}
+		_, hdr, err = DecodeAuthMessageHeader(c, encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, "legacy", hdr.Name)
+		assert.EqualValues(t, 0, hdr.IssuedAt)
+		assert.EqualValues(t, 0, hdr.ExpiresAt)
+		assert.EqualValues(t, 0, hdr.Purpose)
+	}
+
+	// No header is returned for an invalid message
+	dec := mustBase64Decode(encoded[len(old.Prefix):])
+	dec[len(dec)-1] ^= 1
+	v, hdr, err = DecodeAuthMessageHeader(old, append([]byte(old.Prefix), Base64Encode(dec)...))
+	assert.Equal(t, ErrMACInvalid, err)
+	assert.Nil(t, v)
+	assert.Equal(t, Header{}, hdr)
+}
+
+func TestMACMaxAgeByPurpose(t *testing.T) {
+	const reset, session, other = 1, 2, 3
+	var now int64 = 1000
+	base := &MACConfig{
+		Key:    []byte("0123456789012345"),
+		MaxAge: 3600,
+		MaxAgeByPurpose: map[uint8]int64{
+			reset:   5 * 60,
+			session: 30 * 86400,
+		},
+		Clock: func() int64 { return now },
+	}
+	value := []byte("myvalue")
+	tokens := map[uint8][]byte{}
+	for _, purpose := range []uint8{0, reset, session, other} {
+		enc, err := EncodeAuthMessage(base.WithPurpose(purpose), value)
+		if !assert.NoError(t, err) {
+			return
+		}
+		tokens[purpose] = enc
+	}
+
+	// Each purpose has its own expiry, and the others get MaxAge
+	for _, tc := range []struct {
+		purpose uint8
+		maxAge  int64
+	}{{0, 3600}, {reset, 300}, {session, 30 * 86400}, {other, 3600}} {
+		c := base.WithPurpose(tc.purpose)
+		now = 1000 + tc.maxAge
+		_, err := DecodeAuthMessage(c, tokens[tc.purpose])
+		assert.NoError(t, err, "purpose %d", tc.purpose)
+		_, _, expiresAt, err := DecodeAuthMessageFull(c, tokens[tc.purpose])
+		assert.NoError(t, err)
+		assert.Equal(t, 1000+tc.maxAge, expiresAt)
+		now++
+		_, err = DecodeAuthMessage(c, tokens[tc.purpose])
+		assert.Equal(t, ErrMACExpired, err, "purpose %d", tc.purpose)
+	}
+
+	// The purpose is still verified
+	now = 1000
+	_, err := DecodeAuthMessage(base.WithPurpose(session), tokens[reset])
+	assert.Equal(t, ErrMACWrongPurpose, err)
+
+	// The clones have their own copy of the policy
+	c := base.WithPurpose(reset)
+	c.MaxAgeByPurpose[reset] = 0
+	assert.EqualValues(t, 300, base.MaxAgeByPurpose[reset])
+
+	base.MaxAgeByPurpose[other] = -1
+	assert.Error(t, base.Validate())
+	base.MaxAgeByPurpose = map[uint8]int64{reset: 60}
+	base.MaxAge = 0
+	base.NoTimestamp = true
+	assert.Error(t, base.Validate())
+}
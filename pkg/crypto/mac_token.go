@@ -0,0 +1,58 @@
+package crypto
+
+import (
+	"log/slog"
+)
+
+// tokenRedactedLen is the number of characters of a token kept by Redacted.
+// It only covers the start of the header, and never the tag.
+const tokenRedactedLen = 8
+
+// Token is an encoded message, as returned by EncodeAuthMessage. It can be
+// passed to DecodeAuthMessage, and it is marshalled to its encoded form in
+// the text formats like JSON.
+type Token []byte
+
+// EncodeToken is EncodeAuthMessage returning a Token.
+func EncodeToken(c *MACConfig, value []byte) (Token, error) {
+	enc, err := EncodeAuthMessage(c, value)
+	if err != nil {
+		return nil, err
+	}
+	return Token(enc), nil
+}
+
+// String returns the encoded form of the token.
+func (t Token) String() string {
+	return string(t)
+}
+
+// Redacted returns a form of the token that is safe to log: only its first
+// characters are kept, and the tag is never included.
+func (t Token) Redacted() string {
+	if len(t) <= 2*tokenRedactedLen {
+		return "[redacted]"
+	}
+	return string(t[:tokenRedactedLen]) + "...[redacted]"
+}
+
+// LogValue implements slog.LogValuer, so that a token can be logged safely:
+// only its redacted form and its length are written.
+func (t Token) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("token", t.Redacted()),
+		slog.Int("len", len(t)),
+	)
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (t Token) MarshalText() ([]byte, error) {
+	return cloneBytes(t), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface. The token
+// is not verified.
+func (t *Token) UnmarshalText(text []byte) error {
+	*t = append(Token{}, text...)
+	return nil
+}
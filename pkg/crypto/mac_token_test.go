@@ -0,0 +1,114 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMACToken(t *testing.T) {
+	o := &MACConfig{
+		Key:  []byte("0123456789012345"),
+		Name: "token",
+	}
+	value := []byte("myvalue")
+
+	token, err := EncodeToken(o, value)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v, err := DecodeAuthMessage(o, token)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, value, v)
+
+	type doc struct {
+		Token Token `json:"token"`
+	}
+	b, err := json.Marshal(doc{Token: token})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, `{"token":"`+token.String()+`"}`, string(b))
+	var d doc
+	if !assert.NoError(t, json.Unmarshal(b, &d)) {
+		return
+	}
+	assert.Equal(t, token, d.Token)
+	v, err = DecodeAuthMessage(o, d.Token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, v)
+	}
+
+	// The unmarshalled token does not share its memory with the text
+	text := []byte(token.String())
+	var u Token
+	assert.NoError(t, u.UnmarshalText(text))
+	text[0] ^= 1
+	assert.Equal(t, token, u)
+}
+
+func TestMACTokenRedacted(t *testing.T) {
+	o := &MACConfig{
+		Key: []byte("0123456789012345"),
+	}
+	token, err := EncodeToken(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	redacted := token.Redacted()
+	assert.True(t, strings.HasPrefix(redacted, token.String()[:tokenRedactedLen]))
+	assert.NotContains(t, redacted, token.String()[tokenRedactedLen:])
+	// Only characters of the header are kept
+	assert.True(t, tokenRedactedLen <= len(Base64Encode(make([]byte, 11)))-1)
+
+	assert.Equal(t, "[redacted]", Token("short").Redacted())
+	assert.Equal(t, "[redacted]", Token(nil).Redacted())
+}
+
+func TestMACLogValue(t *testing.T) {
+	key := []byte("0123456789012345")
+	o := &MACConfig{
+		Key:    key,
+		Name:   "session",
+		KeyID:  []byte("k1"),
+		MaxAge: 3600,
+		Prefix: "sk_",
+	}
+	token, err := EncodeToken(o, []byte("myvalue"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, newHandler := range []func(w io.Writer) slog.Handler{
+		func(w io.Writer) slog.Handler { return slog.NewTextHandler(w, nil) },
+		func(w io.Writer) slog.Handler { return slog.NewJSONHandler(w, nil) },
+	} {
+		buf := new(bytes.Buffer)
+		logger := slog.New(newHandler(buf))
+		logger.Info("decode", "config", o, "token", token)
+		out := buf.String()
+		assert.NotContains(t, out, string(key))
+		assert.NotContains(t, out, "MDEyMzQ1Njc4OTAxMjM0NT")
+		assert.NotContains(t, out, token.String()[tokenRedactedLen:])
+		assert.Contains(t, out, "session")
+		assert.Contains(t, out, "[redacted]")
+		assert.Contains(t, out, "3600")
+		assert.Contains(t, out, token.String()[:tokenRedactedLen])
+	}
+
+	// The key is also hidden when the config is in a group, or with a signer
+	buf := new(bytes.Buffer)
+	logger := slog.New(slog.NewJSONHandler(buf, nil)).WithGroup("mac")
+	o.Signer = &remoteSigner{key: key}
+	logger.Info("decode", slog.Any("config", o))
+	assert.NotContains(t, buf.String(), string(key))
+	assert.Contains(t, buf.String(), `"signer":"[redacted]"`)
+	assert.Equal(t, "", (&MACConfig{}).LogValue().Resolve().Group()[1].Value.String())
+}
@@ -0,0 +1,71 @@
+package crypto
+
+// TestVector is a known answer for the format of the messages: Token is the
+// message returned by EncodeAuthMessageAt for Value and Time, with a config
+// with only Key and Name set.
+type TestVector struct {
+	Key   []byte
+	Name  string
+	Time  int64
+	Value []byte
+	Token string
+}
+
+// TestVectors returns the known answers of the format of the messages, with
+// its default options: HMAC-SHA256, times in seconds, and unpadded base64url.
+// They can be used to check that another implementation of the format, in
+// another language, produces the same messages.
+//
+// The vectors are stable: they only change with a new version of the format,
+// and the messages they give can always be decoded.
+func TestVectors() []TestVector {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = byte(i % 251)
+	}
+	return []TestVector{
+		{
+			Key:   key,
+			Name:  "empty",
+			Time:  1500000000,
+			Value: []byte{},
+			Token: "AQAAAAAAAFloLwAUT09qHkUH-9XIMQ2v4wx6om0ckA2VphzCGumUzsB0AA",
+		},
+		{
+			Key:   key,
+			Name:  "session",
+			Time:  1500000000,
+			Value: []byte("me@example.org"),
+			Token: "AQAAAAAAAFloLwBtZUBleGFtcGxlLm9yZ1HvOxvXuZYeDOwkYvyNhip-6zwfoV4M3OffZXiQxDZ2",
+		},
+		{
+			Key:   key,
+			Name:  "binary",
+			Time:  1700000000,
+			Value: []byte{0x00, 0x01, 0x02, 0x7f, 0x80, 0xfe, 0xff},
+			Token: "AQAAAAAAAGVT8QAAAQJ_gP7_i-MCRqRVctF0G-FasoThKdR92WkP677npLl-aR5_e-I",
+		},
+		{
+			Key:   key,
+			Name:  "long",
+			Time:  1700000000,
+			Value: long,
+			Token: "AQAAAAAAAGVT8QAAAQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyAhIiMk" +
+				"JSYnKCkqKywtLi8wMTIzNDU2Nzg5Ojs8PT4_QEFCQ0RFRkdISUpLTE1OT1BRUlNU" +
+				"VVZXWFlaW1xdXl9gYWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXp7fH1-f4CBgoOE" +
+				"hYaHiImKi4yNjo-QkZKTlJWWl5iZmpucnZ6foKGio6SlpqeoqaqrrK2ur7CxsrO0" +
+				"tba3uLm6u7y9vr_AwcLDxMXGx8jJysvMzc7P0NHS09TV1tfY2drb3N3e3-Dh4uPk" +
+				"5ebn6Onq6-zt7u_w8fLz9PX29_j5-gABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZ" +
+				"GhscHR4fICEiIyQlJicoKSorLC0uLzD_zUBS0KadFz8XvcmQW4fX74xu1HDDUdIh" +
+				"BMxUQPl3XA",
+		},
+		{
+			Key:   key,
+			Name:  "",
+			Time:  0,
+			Value: []byte("no name"),
+			Token: "AQAAAAAAAAAAAABubyBuYW1luu-aCDVzokDdVB46UxWCyBUo8E9C3xUJhkKOX3sQKqc",
+		},
+	}
+}
@@ -0,0 +1,34 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMACTestVectors(t *testing.T) {
+	vectors := TestVectors()
+	assert.Len(t, vectors, 5)
+	for _, v := range vectors {
+		c := &MACConfig{
+			Key:   v.Key,
+			Name:  v.Name,
+			Clock: func() int64 { return v.Time },
+		}
+		enc, err := EncodeAuthMessageAt(c, v.Value, v.Time)
+		if assert.NoError(t, err, v.Name) {
+			assert.Equal(t, v.Token, string(enc), v.Name)
+		}
+		value, issuedAt, err := DecodeAuthMessageWithTime(c, []byte(v.Token))
+		if assert.NoError(t, err, v.Name) {
+			assert.Equal(t, v.Value, value, v.Name)
+			assert.Equal(t, v.Time, issuedAt, v.Name)
+		}
+	}
+
+	// The vectors are copies, that can be modified by the caller
+	vectors[0].Value = append(vectors[0].Value, 1)
+	vectors[3].Value[0] = 42
+	assert.Equal(t, []byte{}, TestVectors()[0].Value)
+	assert.Equal(t, byte(0), TestVectors()[3].Value[0])
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package crypto
+
+// raceEnabled is true when the tests are run with the race detector, that
+// makes sync.Pool drop some of its items and so allocate.
+const raceEnabled = true
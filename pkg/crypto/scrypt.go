@@ -3,7 +3,6 @@ package crypto
 // Params describes the input parameters to the scrypt
 import (
 	"bytes"
-	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -33,6 +32,8 @@ var (
 	ErrInvalidHash                 = errors.New("Invalid hash format")
 	ErrMismatchedHashAndPassphrase = errors.New("hash and password are different")
 	ErrNoUpdateNeeded              = errors.New("hash already has correct parameters")
+	ErrKeyLengthTooSmall           = errors.New("key length is too small")
+	ErrInvalidKeyParams            = errors.New("invalid scrypt parameters")
 )
 
 var sep = []byte("$")
@@ -101,7 +102,7 @@ func (h *scryptHash) Compare(passphrase []byte) error {
 	}
 
 	// Constant time comparison
-	if subtle.ConstantTimeCompare(h.dk, other) == 1 {
+	if ConstantTimeEqual(h.dk, other) {
 		return nil
 	}
 
@@ -150,3 +151,43 @@ func CompareHashAndPassphrase(hash []byte, passphrase []byte) (needUpdate bool,
 	}
 	return h.NeedUpdate(), nil
 }
+
+// KeyParams are the scrypt parameters used to derive a key from a password.
+type KeyParams struct {
+	N int
+	R int
+	P int
+}
+
+// DefaultKeyParams are the default parameters of DeriveKeyFromPassword.
+var DefaultKeyParams = KeyParams{N: 32768, R: 8, P: 1}
+
+// DeriveKeyFromPassword derives a key of keyLen bytes from a password with
+// scrypt and the default parameters. It can be used for the key of a
+// MACConfig when the secret is a passphrase chosen by a human. The salt
+// should be random, and must be kept to derive the same key again.
+func DeriveKeyFromPassword(password, salt []byte, keyLen int) ([]byte, error) {
+	return DeriveKeyFromPasswordWithParams(password, salt, keyLen, DefaultKeyParams)
+}
+
+// DeriveKeyFromPasswordWithParams is the same as DeriveKeyFromPassword, with
+// the given scrypt parameters.
+func DeriveKeyFromPasswordWithParams(password, salt []byte, keyLen int, params KeyParams) ([]byte, error) {
+	if keyLen < minKeyLen {
+		return nil, ErrKeyLengthTooSmall
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return scrypt.Key(password, salt, params.N, params.R, params.P, keyLen)
+}
+
+// validate checks the parameters like scrypt.Key does: N must be a power of
+// two greater than 1, R and P must be positive, and R*P less than 2^30.
+func (p KeyParams) validate() error {
+	if p.N <= 1 || p.N&(p.N-1) != 0 || p.R <= 0 || p.P <= 0 ||
+		uint64(p.R)*uint64(p.P) >= 1<<30 {
+		return ErrInvalidKeyParams
+	}
+	return nil
+}
@@ -42,3 +42,38 @@ func TestUpdateHashNeedUpdate(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, needUpdate)
 }
+
+func TestDeriveKeyFromPassword(t *testing.T) {
+	salt1 := []byte("0123456789abcdef")
+	salt2 := []byte("fedcba9876543210")
+
+	k1, err := DeriveKeyFromPassword(pass, salt1, 32)
+	assert.NoError(t, err)
+	assert.Len(t, k1, 32)
+	k2, err := DeriveKeyFromPassword(pass, salt1, 32)
+	assert.NoError(t, err)
+	assert.Equal(t, k1, k2, "same salt should give the same key")
+	k3, err := DeriveKeyFromPassword(pass, salt2, 32)
+	assert.NoError(t, err)
+	assert.NotEqual(t, k1, k3, "different salts should give different keys")
+
+	params := KeyParams{N: 1024, R: 8, P: 1}
+	k4, err := DeriveKeyFromPasswordWithParams(pass, salt1, 32, params)
+	assert.NoError(t, err)
+	assert.NotEqual(t, k1, k4, "different params should give different keys")
+
+	_, err = DeriveKeyFromPassword(pass, salt1, 8)
+	assert.Equal(t, ErrKeyLengthTooSmall, err)
+	for _, params := range []KeyParams{
+		{N: 1000, R: 8, P: 1},
+		{N: 1, R: 8, P: 1},
+		{N: 0, R: 8, P: 1},
+		{N: -1024, R: 8, P: 1},
+		{N: 1024, R: 0, P: 1},
+		{N: 1024, R: 8, P: -1},
+		{N: 1024, R: 1 << 15, P: 1 << 15},
+	} {
+		_, err = DeriveKeyFromPasswordWithParams(pass, salt1, 32, params)
+		assert.Equal(t, ErrInvalidKeyParams, err, "%v", params)
+	}
+}
@@ -2,11 +2,15 @@ package crypto
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
 	"io"
 	"time"
 )
 
+var errBase64Invalid = errors.New("crypto: invalid base64 data")
+
 // GenerateRandomBytes returns securely generated random bytes. It will return
 // an error if the system's secure random number generator fails to function
 // correctly, in which case the caller should not continue.
@@ -18,11 +22,58 @@ func GenerateRandomBytes(n int) []byte {
 	return b
 }
 
+// defaultAlphabet is the alphabet of GenerateRandomString when none is given,
+// with the characters that can be used in the URLs without escaping.
+const defaultAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// GenerateRandomString returns a securely generated random string of n
+// characters taken from the alphabet, or from a URL-safe alphabet of 64
+// characters when it is empty. The alphabet is a list of bytes, of at most 256
+// of them. The random bytes that would give a biased choice of character are
+// rejected, so all the characters have the same probability.
+func GenerateRandomString(n int, alphabet string) (string, error) {
+	if alphabet == "" {
+		alphabet = defaultAlphabet
+	}
+	if n < 0 || len(alphabet) > 256 {
+		return "", errors.New("crypto: invalid length or alphabet")
+	}
+
+	// The largest multiple of the alphabet size that fits in a byte
+	limit := 256 - 256%len(alphabet)
+	str := make([]byte, 0, n)
+	buf := make([]byte, n+n/4+1)
+	for len(str) < n {
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(str) < n {
+				str = append(str, alphabet[int(b)%len(alphabet)])
+			}
+		}
+	}
+	return string(str), nil
+}
+
 // Timestamp returns the current timestamp, in seconds.
 func Timestamp() int64 {
 	return time.Now().UTC().Unix()
 }
 
+// ConstantTimeEqual returns true if a and b are equal, in a time that does not
+// depend on their content, so it can be used to compare secrets like tokens
+// or MACs. When the lengths differ, it returns false after the same work as
+// for comparing a with a value of its length: the time only tells the length
+// of a, not the length of b.
+func ConstantTimeEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		subtle.ConstantTimeCompare(a, a)
+		return false
+	}
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
 // Base64Encode encodes a value using base64.
 func Base64Encode(value []byte) []byte {
 	enc := make([]byte, base64.RawURLEncoding.EncodedLen(len(value)))
@@ -39,3 +90,75 @@ func Base64Decode(value []byte) ([]byte, error) {
 	}
 	return dec[:b], nil
 }
+
+// base64DecodeInto decodes src, encoded with the base64 URL encoding without
+// padding, into dst, and returns the number of bytes written. dst must have
+// room for base64.RawURLEncoding.DecodedLen(len(src)) bytes.
+//
+// Contrary to Base64Decode, it does not allocate, and the characters are
+// decoded in constant time, without branching on their value: the time taken
+// only depends on the length of src, and not on the content of the data nor
+// on the position of an invalid character. The line breaks are not ignored.
+func base64DecodeInto(dst, src []byte) (int, error) {
+	if len(src)%4 == 1 {
+		return 0, errBase64Invalid
+	}
+	n := base64.RawURLEncoding.DecodedLen(len(src))
+	if len(dst) < n {
+		return 0, io.ErrShortBuffer
+	}
+
+	invalid := 0
+	si, di := 0, 0
+	for ; si+4 <= len(src); si, di = si+4, di+3 {
+		c0 := base64DecodeChar(src[si])
+		c1 := base64DecodeChar(src[si+1])
+		c2 := base64DecodeChar(src[si+2])
+		c3 := base64DecodeChar(src[si+3])
+		invalid |= c0 | c1 | c2 | c3
+		v := c0<<18 | c1<<12 | c2<<6 | c3
+		dst[di] = byte(v >> 16)
+		dst[di+1] = byte(v >> 8)
+		dst[di+2] = byte(v)
+	}
+	switch len(src) - si {
+	case 2:
+		c0 := base64DecodeChar(src[si])
+		c1 := base64DecodeChar(src[si+1])
+		invalid |= c0 | c1
+		dst[di] = byte((c0<<18 | c1<<12) >> 16)
+	case 3:
+		c0 := base64DecodeChar(src[si])
+		c1 := base64DecodeChar(src[si+1])
+		c2 := base64DecodeChar(src[si+2])
+		invalid |= c0 | c1 | c2
+		v := c0<<18 | c1<<12 | c2<<6
+		dst[di] = byte(v >> 16)
+		dst[di+1] = byte(v >> 8)
+	}
+
+	if invalid < 0 {
+		return 0, errBase64Invalid
+	}
+	return n, nil
+}
+
+// base64DecodeChar returns the value of a character of the base64 URL
+// alphabet, or -1 if it is not in the alphabet. Each range of characters is
+// selected with a mask computed from the sign of the bounds differences,
+// without branching.
+func base64DecodeChar(c byte) int {
+	x := int(c)
+	ret := -1
+	// A-Z
+	ret += (((0x40 - x) & (x - 0x5b)) >> 8) & (x - 64)
+	// a-z
+	ret += (((0x60 - x) & (x - 0x7b)) >> 8) & (x - 70)
+	// 0-9
+	ret += (((0x2f - x) & (x - 0x3a)) >> 8) & (x + 5)
+	// -
+	ret += (((0x2c - x) & (x - 0x2e)) >> 8) & 63
+	// _
+	ret += (((0x5e - x) & (x - 0x60)) >> 8) & 64
+	return ret
+}
@@ -12,6 +12,57 @@ func TestGenerateRandomBytes(t *testing.T) {
 	assert.NotEmpty(t, string(val))
 }
 
+func TestGenerateRandomString(t *testing.T) {
+	for _, n := range []int{0, 1, 16, 100} {
+		str, err := GenerateRandomString(n, "")
+		if assert.NoError(t, err) {
+			assert.Len(t, str, n)
+			for _, c := range str {
+				assert.Contains(t, defaultAlphabet, string(c))
+			}
+		}
+	}
+
+	// The characters are only taken from the alphabet, all of them are used,
+	// and the strings are not repeated
+	seen := make(map[string]bool)
+	chars := make(map[rune]int)
+	for i := 0; i < 1000; i++ {
+		str, err := GenerateRandomString(20, "abc")
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.False(t, seen[str], "repeated string %s", str)
+		seen[str] = true
+		for _, c := range str {
+			chars[c]++
+		}
+	}
+	assert.Len(t, chars, 3)
+	for _, count := range chars {
+		assert.InDelta(t, 20000/3, count, 600)
+	}
+
+	str, err := GenerateRandomString(10, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "xxxxxxxxxx", str)
+	_, err = GenerateRandomString(-1, "")
+	assert.Error(t, err)
+	_, err = GenerateRandomString(10, string(make([]byte, 257)))
+	assert.Error(t, err)
+}
+
+func TestConstantTimeEqual(t *testing.T) {
+	assert.True(t, ConstantTimeEqual([]byte("secret"), []byte("secret")))
+	assert.True(t, ConstantTimeEqual(nil, []byte{}))
+	assert.False(t, ConstantTimeEqual([]byte("secret"), []byte("secreT")))
+	assert.False(t, ConstantTimeEqual([]byte("secret"), []byte("Secret")))
+	assert.False(t, ConstantTimeEqual([]byte("secret"), []byte("secret!")))
+	assert.False(t, ConstantTimeEqual([]byte("secret"), []byte("secre")))
+	assert.False(t, ConstantTimeEqual([]byte("secret"), nil))
+	assert.False(t, ConstantTimeEqual(nil, []byte("secret")))
+}
+
 func TestEncoding(t *testing.T) {
 	for _, value := range testStrings {
 		encoded := Base64Encode([]byte(value))
@@ -24,3 +75,51 @@ func TestEncoding(t *testing.T) {
 		}
 	}
 }
+
+func TestBase64DecodeInto(t *testing.T) {
+	dst := make([]byte, 64)
+	for i := 0; i < 48; i++ {
+		value := GenerateRandomBytes(i)
+		encoded := Base64Encode(value)
+		n, err := base64DecodeInto(dst, encoded)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, value, dst[:n])
+	}
+
+	// Same results as the standard decoder
+	for _, encoded := range []string{
+		"", "A", "AB", "ABC", "ABCD", "ABCDE", "-_-_", "AB=", "AB==",
+		"AB+/", "AB.D", "AB D", "ABC\x00", "ABC\xff", "QUJD", "QUI", "QUJ",
+		"QUJDRA", "QR", "QUJDRA==",
+	} {
+		expected, expectedErr := Base64Decode([]byte(encoded))
+		n, err := base64DecodeInto(dst, []byte(encoded))
+		if expectedErr != nil {
+			assert.Error(t, err, encoded)
+			continue
+		}
+		if assert.NoError(t, err, encoded) {
+			assert.Equal(t, expected, dst[:n], encoded)
+		}
+	}
+
+	// Every byte is either in the alphabet or rejected
+	for c := 0; c < 256; c++ {
+		encoded := []byte{'A', 'A', 'A', byte(c)}
+		expected, expectedErr := Base64Decode(encoded)
+		if c == '\r' || c == '\n' {
+			continue
+		}
+		n, err := base64DecodeInto(dst, encoded)
+		if expectedErr != nil {
+			assert.Error(t, err, "%q", c)
+		} else if assert.NoError(t, err, "%q", c) {
+			assert.Equal(t, expected, dst[:n], "%q", c)
+		}
+	}
+
+	_, err := base64DecodeInto(make([]byte, 2), []byte("ABCD"))
+	assert.Error(t, err)
+}
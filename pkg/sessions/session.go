@@ -1,8 +1,10 @@
 package sessions
 
 import (
+	"bytes"
 	"errors"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -181,7 +183,7 @@ func (s *Session) ToAppCookie(domain string) (*http.Cookie, error) {
 //
 // About MaxLength, for a session of size 100 bytes
 //
-//       8 bytes time
+//      11 bytes header (version, flags, key id length and time)
 //   +  32 bytes HMAC-SHA256
 //   + 100 bytes session
 //   + base64 encoding (4*n/3)
@@ -189,11 +191,23 @@ func (s *Session) ToAppCookie(domain string) (*http.Cookie, error) {
 //
 // 256 bytes should be sufficient enough to support any type of session.
 //
+// The configs are kept by domain, to reuse their HMAC instances from one
+// request to the next, and are replaced when the session secret changes.
 func cookieMACConfig(i *instance.Instance) *crypto.MACConfig {
-	return &crypto.MACConfig{
+	if c, ok := cookieMACConfigs.Load(i.Domain); ok {
+		if c := c.(*crypto.MACConfig); bytes.Equal(c.Key, i.SessionSecret) {
+			return c
+		}
+	}
+	c := &crypto.MACConfig{
 		Name:   SessionCookieName,
-		Key:    i.SessionSecret,
+		Key:    append([]byte(nil), i.SessionSecret...),
 		MaxAge: SessionMaxAge,
 		MaxLen: 256,
 	}
+	cookieMACConfigs.Store(i.Domain, c)
+	return c
 }
+
+// cookieMACConfigs are the configs returned by cookieMACConfig, by domain.
+var cookieMACConfigs sync.Map
@@ -0,0 +1,49 @@
+package sessions
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookieMACConfig(t *testing.T) {
+	inst := &instance.Instance{
+		Domain:        "cookie.example.net",
+		SessionSecret: crypto.GenerateRandomBytes(instance.SessionSecretLen),
+	}
+	c := cookieMACConfig(inst)
+	assert.Equal(t, inst.SessionSecret, c.Key)
+	same := &instance.Instance{
+		Domain:        inst.Domain,
+		SessionSecret: append([]byte(nil), inst.SessionSecret...),
+	}
+	assert.True(t, c == cookieMACConfig(same))
+
+	// A new secret gives a new config
+	inst.SessionSecret = crypto.GenerateRandomBytes(instance.SessionSecretLen)
+	other := cookieMACConfig(inst)
+	assert.False(t, c == other)
+	assert.Equal(t, inst.SessionSecret, other.Key)
+}
+
+// BenchmarkCookieMACConfig checks the cost of a session cookie, when the
+// instance is loaded again for each request.
+func BenchmarkCookieMACConfig(b *testing.B) {
+	secret := crypto.GenerateRandomBytes(instance.SessionSecretLen)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		inst := &instance.Instance{
+			Domain:        "bench.example.net",
+			SessionSecret: append([]byte(nil), secret...),
+		}
+		encoded, err := crypto.EncodeAuthMessage(cookieMACConfig(inst), []byte(sessionID))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = crypto.DecodeAuthMessage(cookieMACConfig(inst), encoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}